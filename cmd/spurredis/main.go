@@ -4,7 +4,9 @@ import (
 	"context"
 	"feedexampleredis/internal/app"
 	"feedexampleredis/internal/commands"
+	"feedexampleredis/internal/metrics"
 	"feedexampleredis/internal/server"
+	"feedexampleredis/internal/spur"
 	"feedexampleredis/internal/storage"
 	"flag"
 	"fmt"
@@ -25,8 +27,11 @@ var (
 	Date    string
 
 	// Flags
-	file string
-	api  bool
+	file                string
+	api                 bool
+	feedName            string
+	includeLegacyIPKeys bool
+	dryRun              bool
 
 	// Args
 	command string
@@ -48,12 +53,41 @@ func main() {
 		"running with config",
 		slog.Int("chunk_size", cfg.ChunkSize),
 		slog.Int("ttl", cfg.TTL),
+		slog.String("backend", cfg.Backend),
+		slog.String("bolt_path", cfg.BoltPath),
 		slog.String("redis_addr", cfg.RedisAddr),
 		slog.Int("redis_db", cfg.RedisDB),
+		slog.String("redis_sentinel_master", cfg.RedisSentinelMaster),
+		slog.Any("redis_sentinel_addrs", cfg.RedisSentinelAddrs),
+		slog.Any("redis_cluster_addrs", cfg.RedisClusterAddrs),
+		slog.String("redis_username", cfg.RedisUsername),
+		slog.Bool("redis_tls", cfg.RedisTLS),
+		slog.String("redis_tls_ca_file", cfg.RedisTLSCAFile),
+		slog.String("redis_tls_server_name", cfg.RedisTLSServerName),
+		slog.Int("redis_pool_size", cfg.RedisPoolSize),
+		slog.String("redis_key_prefix", cfg.RedisKeyPrefix),
+		slog.Bool("redis_atomic_merge", cfg.RedisAtomicMerge),
+		slog.String("redis_layout", cfg.RedisLayout),
+		slog.String("redis_encoding", cfg.RedisEncoding),
+		slog.Bool("redis_indexes", cfg.RedisIndexes),
+		slog.Bool("redis_network_index", cfg.RedisNetworkIndex),
 		slog.Int("concurrent_num", cfg.ConcurrentNum),
-		slog.String("spur_feed_type", string(cfg.SpurFeedType)),
+		slog.Any("spur_feed_types", cfg.SpurFeedTypes),
+		slog.Duration("spur_api_timeout", cfg.SpurAPITimeout),
+		slog.Int("spur_api_max_retries", cfg.SpurAPIMaxRetries),
+		slog.String("cache_dir", cfg.CacheDir),
+		slog.Duration("cache_max_age", cfg.CacheMaxAge),
+		slog.Int("cache_max_size_mb", cfg.CacheMaxSizeMB),
+		slog.Bool("offline", cfg.Offline),
+		slog.String("staging_dir", cfg.StagingDir),
+		slog.String("dead_letter_path", cfg.DeadLetterPath),
+		slog.Float64("max_reject_ratio", cfg.MaxRejectRatio),
+		slog.Any("feed_ttls", cfg.FeedTTLs),
 		slog.Bool("spur_realtime_enabled", cfg.SpurRealtimeEnabled),
 		slog.Int("port", cfg.Port),
+		slog.Int("batch_limit", cfg.BatchLimit),
+		slog.Int("metrics_port", cfg.MetricsPort),
+		slog.Duration("max_feed_age", cfg.MaxFeedAge),
 		slog.String("cert_file", cfg.CertFile),
 		slog.String("key_file", cfg.KeyFile),
 		slog.Bool("ipv6_network_feed_beta", cfg.IPv6NetworkFeedBeta),
@@ -61,6 +95,9 @@ func main() {
 
 	flag.StringVar(&file, "file", "", "path to the feed file or realtime file to process")
 	flag.BoolVar(&api, "api", false, "start the API server")
+	flag.StringVar(&feedName, "feed", "", "feed type the file belongs to for insert, merge, migrate-keys and reprocess-dead-letters, defaults to the first configured feed type")
+	flag.BoolVar(&includeLegacyIPKeys, "include-legacy-ip-keys", false, "migrate-keys also moves records stored under their bare IP by versions without generations")
+	flag.BoolVar(&dryRun, "dry-run", false, "migrate-keys lists the keys it would move without moving them")
 	flag.Parse()
 
 	// Get the command from the args
@@ -68,7 +105,7 @@ func main() {
 	if len(args) > 0 {
 		command = args[0]
 	} else {
-		fmt.Fprintf(os.Stderr, "error: no command specified, it must be one of: daemon, insert, merge\n")
+		fmt.Fprintf(os.Stderr, "error: no command specified, it must be one of: daemon, insert, merge, migrate-keys, reprocess-dead-letters, encoding-report\n")
 		os.Exit(1)
 	}
 
@@ -82,27 +119,133 @@ func main() {
 		return signalHandler(ctx)
 	})
 
-	// Setup redis client, it is used in multiple commands
-	ttl := time.Duration(cfg.TTL) * time.Hour
-	redisClient := storage.NewRedis(cfg.RedisAddr, cfg.RedisPass, cfg.RedisDB, ttl, cfg.ConcurrentNum, cfg.ChunkSize)
-	redisClient.Connect()
-	slog.Info(
-		"redis client created",
-		slog.String("redis_addr", cfg.RedisAddr),
-		slog.String("redis_db", strconv.Itoa(cfg.RedisDB)),
-	)
+	// Setup the storage backend, it is used in multiple commands. Each feed type is kept in its own namespace.
+	feeds := make([]storage.FeedStore, 0, len(cfg.SpurFeedTypes))
+	switch cfg.Backend {
+	case app.BackendBolt:
+		boltStore := storage.NewBolt(cfg.BoltPath, cfg.ConcurrentNum, cfg.ChunkSize)
+		if err := boltStore.Open(); err != nil {
+			fmt.Fprintf(os.Stderr, "error opening bolt database: %v\n", err)
+			os.Exit(1)
+		}
+		defer boltStore.Close()
+		for _, feedType := range cfg.SpurFeedTypes {
+			feedStore, err := boltStore.WithNamespace(cfg.FeedNamespace(feedType))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error opening bolt database for %s: %v\n", feedType, err)
+				os.Exit(1)
+			}
+			feeds = append(feeds, storage.FeedStore{FeedType: feedType, V4: feedStore})
+		}
+		slog.Info("bolt database opened", slog.String("bolt_path", cfg.BoltPath))
+	default:
+		ttl := time.Duration(cfg.TTL) * time.Hour
+		redisClient := storage.NewRedis(storage.RedisOptions{
+			Addr:               cfg.RedisAddr,
+			Username:           cfg.RedisUsername,
+			Password:           cfg.RedisPass,
+			DB:                 cfg.RedisDB,
+			SentinelMasterName: cfg.RedisSentinelMaster,
+			SentinelAddrs:      cfg.RedisSentinelAddrs,
+			SentinelPassword:   cfg.RedisSentinelPass,
+			ClusterAddrs:       cfg.RedisClusterAddrs,
+			TLSEnabled:         cfg.RedisTLS,
+			TLSCAFile:          cfg.RedisTLSCAFile,
+			TLSCertFile:        cfg.RedisTLSCertFile,
+			TLSKeyFile:         cfg.RedisTLSKeyFile,
+			TLSServerName:      cfg.RedisTLSServerName,
+			PoolSize:           cfg.RedisPoolSize,
+			DialTimeout:        cfg.RedisDialTimeout,
+			ReadTimeout:        cfg.RedisReadTimeout,
+			WriteTimeout:       cfg.RedisWriteTimeout,
+			KeyPrefix:          cfg.RedisKeyPrefix,
+			AtomicMerge:        cfg.RedisAtomicMerge,
+			Layout:             cfg.RedisLayout,
+			Encoding:           cfg.RedisEncoding,
+			Indexes:            cfg.RedisIndexes,
+			NetworkIndex:       cfg.RedisNetworkIndex,
+			TTL:                ttl,
+			Concurrency:        cfg.ConcurrentNum,
+			ChunkSize:          cfg.ChunkSize,
+		})
+		if err := redisClient.Connect(); err != nil {
+			fmt.Fprintf(os.Stderr, "error connecting to redis: %v\n", err)
+			os.Exit(1)
+		}
+		defer redisClient.Close()
+		redisClient.AddHook(metrics.RedisHook())
+		for _, feedType := range cfg.SpurFeedTypes {
+			feedTTL := time.Duration(cfg.FeedTTL(feedType)) * time.Hour
+			feedStore := redisClient.WithNamespace(cfg.FeedNamespace(feedType), feedTTL)
+			feeds = append(feeds, storage.FeedStore{FeedType: feedType, V4: feedStore})
+		}
+		slog.Info(
+			"redis client created",
+			slog.String("redis_addr", cfg.RedisAddr),
+			slog.String("redis_db", strconv.Itoa(cfg.RedisDB)),
+			slog.String("redis_sentinel_master", cfg.RedisSentinelMaster),
+			slog.Any("redis_cluster_addrs", cfg.RedisClusterAddrs),
+		)
+	}
 
-	// Setup ipv6 lookup client
-	v6Client := storage.NewMMDB()
+	// Setup the ipv6 lookup stores for the feed types that have an ipv6 feed, they are held in memory
+	for i := range feeds {
+		if _, err := feeds[i].FeedType.V6FeedType(); err == nil {
+			feeds[i].V6 = storage.NewMMDB()
+		}
+	}
+
+	// Lines the stores can't load are dead-lettered, and full feed loads rejecting too many of them fail
+	var deadLetters *storage.DeadLetterFile
+	if cfg.DeadLetterPath != "" {
+		deadLetters, err = storage.OpenDeadLetterFile(cfg.DeadLetterPath, int64(cfg.DeadLetterMaxSizeMB)<<20, cfg.DeadLetterMaxFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		defer deadLetters.Close()
+	}
+	for _, feed := range feeds {
+		for source, store := range map[string]storage.Store{deadLetterSource(feed.FeedType, false): feed.V4, deadLetterSource(feed.FeedType, true): feed.V6} {
+			if rejecter, ok := store.(storage.Rejecter); ok {
+				rejecter.SetRejectPolicy(storage.RejectPolicy{DeadLetters: deadLetters, Source: source, MaxRatio: cfg.MaxRejectRatio})
+			}
+		}
+	}
+
+	// insert, merge, migrate-keys, reprocess-dead-letters and encoding-report work on a single feed
+	feed, err := selectFeed(feeds, feedName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Start the main process
 	switch command {
 	case "daemon":
+		if err := metrics.RegisterFeeds(feeds); err != nil {
+			fmt.Fprintf(os.Stderr, "error registering metrics: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Metrics are served by the API server, and on their own port when one is set. Without the API server they
+		// are always served on their own port so they can be scraped.
+		metricsPort := cfg.MetricsPort
+		if metricsPort == 0 && !api {
+			metricsPort = app.DefaultMetricsPort
+		}
+		if metricsPort != 0 {
+			g.Go(func() error {
+				defer cancel()
+				return server.StartMetrics(ctx, metricsPort)
+			})
+		}
+
 		// Start the API server if the flag is set
 		if api {
 			g.Go(func() error {
 				defer cancel()
-				api := server.NewServer(cfg, redisClient, v6Client)
+				api := server.NewServer(cfg, feeds)
 				if cfg.CertFile != "" && cfg.KeyFile != "" {
 					return api.StartTLS(ctx)
 				}
@@ -111,7 +254,7 @@ func main() {
 		}
 		g.Go(func() error {
 			defer cancel()
-			return commands.Daemon(ctx, cfg, redisClient, v6Client)
+			return commands.Daemon(ctx, cfg, feeds)
 		})
 	case "insert":
 		// TODO
@@ -121,7 +264,7 @@ func main() {
 		}
 		g.Go(func() error {
 			defer cancel()
-			return commands.InsertFeedFile(ctx, file, redisClient)
+			return commands.InsertFeedFile(ctx, file, feed.V4)
 		})
 	case "merge":
 		// TODO
@@ -131,10 +274,39 @@ func main() {
 		}
 		g.Go(func() error {
 			defer cancel()
-			return commands.MergeRealtimeFile(ctx, file, redisClient)
+			return commands.MergeRealtimeFile(ctx, file, feed.V4)
+		})
+	case "migrate-keys":
+		redisClient, ok := feed.V4.(*storage.Redis)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "error: migrate-keys requires the redis backend\n")
+			os.Exit(1)
+		}
+		g.Go(func() error {
+			defer cancel()
+			return commands.MigrateKeys(ctx, redisClient, storage.MigrateOptions{IncludeLegacyIPKeys: includeLegacyIPKeys, DryRun: dryRun})
+		})
+	case "encoding-report":
+		redisClient, ok := feed.V4.(*storage.Redis)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "error: encoding-report requires the redis backend\n")
+			os.Exit(1)
+		}
+		g.Go(func() error {
+			defer cancel()
+			return commands.EncodingReport(ctx, redisClient)
+		})
+	case "reprocess-dead-letters":
+		if deadLetters == nil {
+			fmt.Fprintf(os.Stderr, "error: reprocess-dead-letters requires SPUR_REDIS_DEAD_LETTER_PATH\n")
+			os.Exit(1)
+		}
+		g.Go(func() error {
+			defer cancel()
+			return commands.ReprocessDeadLetters(ctx, deadLetters, deadLetterSource(feed.FeedType, false), feed.V4)
 		})
 	default:
-		fmt.Fprintf(os.Stderr, "error: invalid command specified, it must be one of: daemon, insert, merge\n")
+		fmt.Fprintf(os.Stderr, "error: invalid command specified, it must be one of: daemon, insert, merge, migrate-keys, reprocess-dead-letters, encoding-report\n")
 		os.Exit(1)
 	}
 
@@ -150,6 +322,29 @@ func main() {
 	}
 }
 
+// selectFeed - the stores for the named feed type, or the first configured feed type if no name is given
+func selectFeed(feeds []storage.FeedStore, name string) (storage.FeedStore, error) {
+	if name == "" {
+		return feeds[0], nil
+	}
+
+	for _, feed := range feeds {
+		if string(feed.FeedType) == name {
+			return feed, nil
+		}
+	}
+
+	return storage.FeedStore{}, fmt.Errorf("feed type %s is not configured in SPUR_REDIS_FEED_TYPE", name)
+}
+
+// deadLetterSource - the source recorded with the lines rejected by a feed type's IPv4 or IPv6 store
+func deadLetterSource(feedType spur.FeedType, v6 bool) string {
+	if v6 {
+		return string(feedType) + "/ipv6"
+	}
+	return string(feedType)
+}
+
 var ErrorStop = fmt.Errorf("received signal to stop")
 
 // signalHandler - listens for signals to stop the process.
@@ -7,24 +7,87 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Storage backends the feed data can be kept in
+const (
+	BackendRedis = "redis"
+	BackendBolt  = "bolt"
+)
+
+// Layouts records can be stored in with the redis backend
+const (
+	RedisLayoutString = "string"
+	RedisLayoutHash   = "hash"
+)
+
+// Encodings records can be stored in with the redis string layout
+const (
+	RedisEncodingJSON         = "json"
+	RedisEncodingMsgpack      = "msgpack"
+	RedisEncodingMsgpackFlate = "msgpack-flate"
+)
+
+// DefaultMetricsPort - the port metrics are served on by a daemon running without the API server when
+// SPUR_REDIS_METRICS_PORT isn't set
+const DefaultMetricsPort = 9090
+
 // Config - the configuration for the process, parsed from environment variables
 type Config struct {
-	ChunkSize           int
-	TTL                 int
-	RedisAddr           string
-	RedisPass           string
-	RedisDB             int
-	ConcurrentNum       int
-	SpurAPIToken        string
-	SpurFeedType        spur.FeedType
-	SpurRealtimeEnabled bool
-	Port                int
-	LocalAPIAuthTokens  []string
-	CertFile            string
-	KeyFile             string
-	IPv6NetworkFeedBeta bool
+	ChunkSize               int
+	TTL                     int
+	Backend                 string
+	BoltPath                string
+	RedisAddr               string
+	RedisUsername           string
+	RedisPass               string
+	RedisDB                 int
+	RedisSentinelMaster     string
+	RedisSentinelAddrs      []string
+	RedisSentinelPass       string
+	RedisClusterAddrs       []string
+	RedisTLS                bool
+	RedisTLSCAFile          string
+	RedisTLSCertFile        string
+	RedisTLSKeyFile         string
+	RedisTLSServerName      string
+	RedisPoolSize           int
+	RedisDialTimeout        time.Duration
+	RedisReadTimeout        time.Duration
+	RedisWriteTimeout       time.Duration
+	RedisKeyPrefix          string
+	RedisAtomicMerge        bool
+	RedisLayout             string
+	RedisEncoding           string
+	RedisIndexes            bool
+	RedisNetworkIndex       bool
+	ConcurrentNum           int
+	SpurAPIToken            string
+	SpurAPITimeout          time.Duration
+	SpurAPIMaxRetries       int
+	SpurAPIBreakerThreshold int
+	SpurAPIBreakerCooldown  time.Duration
+	CacheDir                string
+	CacheMaxAge             time.Duration
+	CacheMaxSizeMB          int
+	Offline                 bool
+	StagingDir              string
+	DeadLetterPath          string
+	DeadLetterMaxSizeMB     int
+	DeadLetterMaxFiles      int
+	MaxRejectRatio          float64
+	SpurFeedTypes           []spur.FeedType
+	FeedTTLs                map[spur.FeedType]int
+	SpurRealtimeEnabled     bool
+	Port                    int
+	LocalAPIAuthTokens      []string
+	BatchLimit              int
+	MetricsPort             int
+	MaxFeedAge              time.Duration
+	CertFile                string
+	KeyFile                 string
+	IPv6NetworkFeedBeta     bool
 }
 
 // parseConfig - parse the configuration from environment variables
@@ -32,17 +95,27 @@ func ParseConfigFromEnvironment() (Config, error) {
 	cfg := Config{
 		ChunkSize:           5000,
 		TTL:                 24,
+		Backend:             BackendRedis,
+		RedisLayout:         RedisLayoutString,
+		RedisEncoding:       RedisEncodingJSON,
+		BoltPath:            "spurredis.db",
 		RedisAddr:           "localhost:6379",
 		RedisPass:           "",
 		RedisDB:             0,
 		ConcurrentNum:       1,
 		SpurAPIToken:        "",
-		SpurFeedType:        spur.AnonymousFeed,
+		SpurFeedTypes:       []spur.FeedType{spur.AnonymousFeed},
+		FeedTTLs:            map[spur.FeedType]int{},
 		SpurRealtimeEnabled: false,
 		Port:                8080,
 		LocalAPIAuthTokens:  nil,
+		BatchLimit:          1000,
 		CertFile:            "",
 		KeyFile:             "",
+		SpurAPIMaxRetries:   spur.DefaultMaxRetries,
+		CacheMaxAge:         72 * time.Hour,
+		DeadLetterMaxSizeMB: 10,
+		DeadLetterMaxFiles:  5,
 	}
 
 	envChunkSize := os.Getenv("SPUR_REDIS_CHUNK_SIZE")
@@ -63,11 +136,31 @@ func ParseConfigFromEnvironment() (Config, error) {
 		cfg.TTL = intTTL
 	}
 
+	envBackend := os.Getenv("SPUR_REDIS_BACKEND")
+	if envBackend != "" {
+		switch envBackend {
+		case BackendRedis, BackendBolt:
+			cfg.Backend = envBackend
+		default:
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_BACKEND: %s", envBackend)
+		}
+	}
+
+	envBoltPath := os.Getenv("SPUR_REDIS_BOLT_PATH")
+	if envBoltPath != "" {
+		cfg.BoltPath = envBoltPath
+	}
+
 	envRedisAddr := os.Getenv("SPUR_REDIS_ADDR")
 	if envRedisAddr != "" {
 		cfg.RedisAddr = envRedisAddr
 	}
 
+	envRedisUsername := os.Getenv("SPUR_REDIS_USERNAME")
+	if envRedisUsername != "" {
+		cfg.RedisUsername = envRedisUsername
+	}
+
 	envRedisPass := os.Getenv("SPUR_REDIS_PASS")
 	if envRedisPass != "" {
 		cfg.RedisPass = envRedisPass
@@ -82,6 +175,164 @@ func ParseConfigFromEnvironment() (Config, error) {
 		cfg.RedisDB = intRedisDB
 	}
 
+	envRedisSentinelMaster := os.Getenv("SPUR_REDIS_SENTINEL_MASTER")
+	if envRedisSentinelMaster != "" {
+		cfg.RedisSentinelMaster = envRedisSentinelMaster
+	}
+
+	envRedisSentinelAddrs := os.Getenv("SPUR_REDIS_SENTINEL_ADDRS")
+	if envRedisSentinelAddrs != "" {
+		// Addresses are comma separated
+		cfg.RedisSentinelAddrs = strings.Split(envRedisSentinelAddrs, ",")
+	}
+
+	envRedisSentinelPass := os.Getenv("SPUR_REDIS_SENTINEL_PASS")
+	if envRedisSentinelPass != "" {
+		cfg.RedisSentinelPass = envRedisSentinelPass
+	}
+
+	if (cfg.RedisSentinelMaster == "") != (len(cfg.RedisSentinelAddrs) == 0) {
+		return Config{}, fmt.Errorf("SPUR_REDIS_SENTINEL_MASTER and SPUR_REDIS_SENTINEL_ADDRS must be set together")
+	}
+
+	envRedisClusterAddrs := os.Getenv("SPUR_REDIS_CLUSTER_ADDRS")
+	if envRedisClusterAddrs != "" {
+		// Addresses are comma separated
+		cfg.RedisClusterAddrs = strings.Split(envRedisClusterAddrs, ",")
+
+		if cfg.RedisSentinelMaster != "" {
+			return Config{}, fmt.Errorf("SPUR_REDIS_CLUSTER_ADDRS and SPUR_REDIS_SENTINEL_MASTER can't be used together")
+		}
+
+		if cfg.RedisDB != 0 {
+			return Config{}, fmt.Errorf("SPUR_REDIS_DB must be 0 when using SPUR_REDIS_CLUSTER_ADDRS")
+		}
+	}
+
+	envRedisTLS := os.Getenv("SPUR_REDIS_TLS")
+	if envRedisTLS != "" {
+		boolRedisTLS, err := strconv.ParseBool(envRedisTLS)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_TLS: %v", err)
+		}
+		cfg.RedisTLS = boolRedisTLS
+	}
+
+	envRedisTLSCAFile := os.Getenv("SPUR_REDIS_TLS_CA_FILE")
+	if envRedisTLSCAFile != "" {
+		cfg.RedisTLSCAFile = envRedisTLSCAFile
+	}
+
+	envRedisTLSCertFile := os.Getenv("SPUR_REDIS_TLS_CERT_FILE")
+	if envRedisTLSCertFile != "" {
+		cfg.RedisTLSCertFile = envRedisTLSCertFile
+	}
+
+	envRedisTLSKeyFile := os.Getenv("SPUR_REDIS_TLS_KEY_FILE")
+	if envRedisTLSKeyFile != "" {
+		cfg.RedisTLSKeyFile = envRedisTLSKeyFile
+	}
+
+	if (cfg.RedisTLSCertFile == "") != (cfg.RedisTLSKeyFile == "") {
+		return Config{}, fmt.Errorf("SPUR_REDIS_TLS_CERT_FILE and SPUR_REDIS_TLS_KEY_FILE must be set together")
+	}
+
+	envRedisTLSServerName := os.Getenv("SPUR_REDIS_TLS_SERVER_NAME")
+	if envRedisTLSServerName != "" {
+		cfg.RedisTLSServerName = envRedisTLSServerName
+	}
+
+	envRedisPoolSize := os.Getenv("SPUR_REDIS_POOL_SIZE")
+	if envRedisPoolSize != "" {
+		intRedisPoolSize, err := strconv.Atoi(envRedisPoolSize)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_POOL_SIZE: %v", err)
+		}
+		cfg.RedisPoolSize = intRedisPoolSize
+	}
+
+	envRedisDialTimeout := os.Getenv("SPUR_REDIS_DIAL_TIMEOUT")
+	if envRedisDialTimeout != "" {
+		durationRedisDialTimeout, err := time.ParseDuration(envRedisDialTimeout)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_DIAL_TIMEOUT: %v", err)
+		}
+		cfg.RedisDialTimeout = durationRedisDialTimeout
+	}
+
+	envRedisReadTimeout := os.Getenv("SPUR_REDIS_READ_TIMEOUT")
+	if envRedisReadTimeout != "" {
+		durationRedisReadTimeout, err := time.ParseDuration(envRedisReadTimeout)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_READ_TIMEOUT: %v", err)
+		}
+		cfg.RedisReadTimeout = durationRedisReadTimeout
+	}
+
+	envRedisWriteTimeout := os.Getenv("SPUR_REDIS_WRITE_TIMEOUT")
+	if envRedisWriteTimeout != "" {
+		durationRedisWriteTimeout, err := time.ParseDuration(envRedisWriteTimeout)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_WRITE_TIMEOUT: %v", err)
+		}
+		cfg.RedisWriteTimeout = durationRedisWriteTimeout
+	}
+
+	envRedisKeyPrefix := os.Getenv("SPUR_REDIS_KEY_PREFIX")
+	if envRedisKeyPrefix != "" {
+		cfg.RedisKeyPrefix = envRedisKeyPrefix
+	}
+
+	envRedisAtomicMerge := os.Getenv("SPUR_REDIS_ATOMIC_MERGE")
+	if envRedisAtomicMerge != "" {
+		boolRedisAtomicMerge, err := strconv.ParseBool(envRedisAtomicMerge)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_ATOMIC_MERGE: %v", err)
+		}
+		cfg.RedisAtomicMerge = boolRedisAtomicMerge
+	}
+
+	envRedisLayout := os.Getenv("SPUR_REDIS_LAYOUT")
+	if envRedisLayout != "" {
+		switch envRedisLayout {
+		case RedisLayoutString, RedisLayoutHash:
+			cfg.RedisLayout = envRedisLayout
+		default:
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_LAYOUT: %s", envRedisLayout)
+		}
+	}
+
+	envRedisEncoding := os.Getenv("SPUR_REDIS_ENCODING")
+	if envRedisEncoding != "" {
+		switch envRedisEncoding {
+		case RedisEncodingJSON, RedisEncodingMsgpack, RedisEncodingMsgpackFlate:
+			cfg.RedisEncoding = envRedisEncoding
+		default:
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_ENCODING: %s", envRedisEncoding)
+		}
+	}
+	if cfg.RedisEncoding != RedisEncodingJSON && cfg.RedisLayout != RedisLayoutString {
+		return Config{}, fmt.Errorf("SPUR_REDIS_ENCODING %s requires SPUR_REDIS_LAYOUT=%s", cfg.RedisEncoding, RedisLayoutString)
+	}
+
+	envRedisIndexes := os.Getenv("SPUR_REDIS_INDEXES")
+	if envRedisIndexes != "" {
+		boolRedisIndexes, err := strconv.ParseBool(envRedisIndexes)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_INDEXES: %v", err)
+		}
+		cfg.RedisIndexes = boolRedisIndexes
+	}
+
+	envRedisNetworkIndex := os.Getenv("SPUR_REDIS_NETWORK_INDEX")
+	if envRedisNetworkIndex != "" {
+		boolRedisNetworkIndex, err := strconv.ParseBool(envRedisNetworkIndex)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_NETWORK_INDEX: %v", err)
+		}
+		cfg.RedisNetworkIndex = boolRedisNetworkIndex
+	}
+
 	envConcurrentNum := os.Getenv("SPUR_REDIS_CONCURRENT_NUM")
 	if envConcurrentNum != "" {
 		intConcurrentNum, err := strconv.Atoi(envConcurrentNum)
@@ -96,22 +347,156 @@ func ParseConfigFromEnvironment() (Config, error) {
 		}
 	}
 
+	envCacheDir := os.Getenv("SPUR_REDIS_CACHE_DIR")
+	if envCacheDir != "" {
+		cfg.CacheDir = envCacheDir
+	}
+
+	envCacheMaxAge := os.Getenv("SPUR_REDIS_CACHE_MAX_AGE")
+	if envCacheMaxAge != "" {
+		durationCacheMaxAge, err := time.ParseDuration(envCacheMaxAge)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_CACHE_MAX_AGE: %v", err)
+		}
+		cfg.CacheMaxAge = durationCacheMaxAge
+	}
+
+	envCacheMaxSizeMB := os.Getenv("SPUR_REDIS_CACHE_MAX_SIZE_MB")
+	if envCacheMaxSizeMB != "" {
+		intCacheMaxSizeMB, err := strconv.Atoi(envCacheMaxSizeMB)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_CACHE_MAX_SIZE_MB: %v", err)
+		}
+		cfg.CacheMaxSizeMB = intCacheMaxSizeMB
+	}
+
+	envOffline := os.Getenv("SPUR_REDIS_OFFLINE")
+	if envOffline != "" {
+		boolOffline, err := strconv.ParseBool(envOffline)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_OFFLINE: %v", err)
+		}
+		cfg.Offline = boolOffline
+	}
+
+	envStagingDir := os.Getenv("SPUR_REDIS_STAGING_DIR")
+	if envStagingDir != "" {
+		cfg.StagingDir = envStagingDir
+	}
+
+	envDeadLetterPath := os.Getenv("SPUR_REDIS_DEAD_LETTER_PATH")
+	if envDeadLetterPath != "" {
+		cfg.DeadLetterPath = envDeadLetterPath
+	}
+
+	envDeadLetterMaxSizeMB := os.Getenv("SPUR_REDIS_DEAD_LETTER_MAX_SIZE_MB")
+	if envDeadLetterMaxSizeMB != "" {
+		intDeadLetterMaxSizeMB, err := strconv.Atoi(envDeadLetterMaxSizeMB)
+		if err != nil || intDeadLetterMaxSizeMB < 1 {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_DEAD_LETTER_MAX_SIZE_MB: %s", envDeadLetterMaxSizeMB)
+		}
+		cfg.DeadLetterMaxSizeMB = intDeadLetterMaxSizeMB
+	}
+
+	envDeadLetterMaxFiles := os.Getenv("SPUR_REDIS_DEAD_LETTER_MAX_FILES")
+	if envDeadLetterMaxFiles != "" {
+		intDeadLetterMaxFiles, err := strconv.Atoi(envDeadLetterMaxFiles)
+		if err != nil || intDeadLetterMaxFiles < 0 {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_DEAD_LETTER_MAX_FILES: %s", envDeadLetterMaxFiles)
+		}
+		cfg.DeadLetterMaxFiles = intDeadLetterMaxFiles
+	}
+
+	envMaxRejectRatio := os.Getenv("SPUR_REDIS_MAX_REJECT_RATIO")
+	if envMaxRejectRatio != "" {
+		floatMaxRejectRatio, err := strconv.ParseFloat(envMaxRejectRatio, 64)
+		if err != nil || floatMaxRejectRatio < 0 || floatMaxRejectRatio > 1 {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_MAX_REJECT_RATIO: %s, it must be between 0 and 1", envMaxRejectRatio)
+		}
+		cfg.MaxRejectRatio = floatMaxRejectRatio
+	}
+
+	if cfg.Offline && cfg.CacheDir == "" {
+		return Config{}, fmt.Errorf("SPUR_REDIS_OFFLINE requires SPUR_REDIS_CACHE_DIR")
+	}
+
+	// The API token isn't needed when everything comes from the cache
 	envSpurAPIToken := os.Getenv("SPUR_REDIS_API_TOKEN")
 	if envSpurAPIToken != "" {
 		cfg.SpurAPIToken = envSpurAPIToken
-	} else {
+	} else if !cfg.Offline {
 		return Config{}, fmt.Errorf("SPUR_REDIS_API_TOKEN is required")
 	}
 
+	envSpurAPITimeout := os.Getenv("SPUR_REDIS_API_TIMEOUT")
+	if envSpurAPITimeout != "" {
+		durationSpurAPITimeout, err := time.ParseDuration(envSpurAPITimeout)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_API_TIMEOUT: %v", err)
+		}
+		cfg.SpurAPITimeout = durationSpurAPITimeout
+	}
+
+	envSpurAPIMaxRetries := os.Getenv("SPUR_REDIS_API_MAX_RETRIES")
+	if envSpurAPIMaxRetries != "" {
+		intSpurAPIMaxRetries, err := strconv.Atoi(envSpurAPIMaxRetries)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_API_MAX_RETRIES: %v", err)
+		}
+		if intSpurAPIMaxRetries < 0 {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_API_MAX_RETRIES: %d, it can't be negative", intSpurAPIMaxRetries)
+		}
+		cfg.SpurAPIMaxRetries = intSpurAPIMaxRetries
+	}
+
+	envSpurAPIBreakerThreshold := os.Getenv("SPUR_REDIS_API_BREAKER_THRESHOLD")
+	if envSpurAPIBreakerThreshold != "" {
+		intSpurAPIBreakerThreshold, err := strconv.Atoi(envSpurAPIBreakerThreshold)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_API_BREAKER_THRESHOLD: %v", err)
+		}
+		cfg.SpurAPIBreakerThreshold = intSpurAPIBreakerThreshold
+	}
+
+	envSpurAPIBreakerCooldown := os.Getenv("SPUR_REDIS_API_BREAKER_COOLDOWN")
+	if envSpurAPIBreakerCooldown != "" {
+		durationSpurAPIBreakerCooldown, err := time.ParseDuration(envSpurAPIBreakerCooldown)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_API_BREAKER_COOLDOWN: %v", err)
+		}
+		cfg.SpurAPIBreakerCooldown = durationSpurAPIBreakerCooldown
+	}
+
 	envSpurFeedType := os.Getenv("SPUR_REDIS_FEED_TYPE")
 	if envSpurFeedType != "" {
-		feedType := spur.FeedTypeFromString(envSpurFeedType)
-		if feedType == spur.FeedTypeUnknown {
-			return Config{}, fmt.Errorf("invalid SPUR_REDIS_FEED_TYPE: %s", envSpurFeedType)
+		// Feed types are comma separated
+		cfg.SpurFeedTypes = nil
+		for _, name := range strings.Split(envSpurFeedType, ",") {
+			feedType := spur.FeedTypeFromString(strings.TrimSpace(name))
+			if feedType == spur.FeedTypeUnknown {
+				return Config{}, fmt.Errorf("invalid SPUR_REDIS_FEED_TYPE: %s", name)
+			}
+
+			for _, existing := range cfg.SpurFeedTypes {
+				if existing == feedType {
+					return Config{}, fmt.Errorf("invalid SPUR_REDIS_FEED_TYPE: %s is listed more than once", name)
+				}
+			}
+			cfg.SpurFeedTypes = append(cfg.SpurFeedTypes, feedType)
+		}
+	}
+
+	// Each feed type can override the TTL, e.g. SPUR_REDIS_TTL_ANONYMOUS_RESIDENTIAL
+	for _, feedType := range cfg.SpurFeedTypes {
+		name := "SPUR_REDIS_TTL_" + strings.ToUpper(strings.ReplaceAll(string(feedType), "-", "_"))
+		envFeedTTL := os.Getenv(name)
+		if envFeedTTL != "" {
+			intFeedTTL, err := strconv.Atoi(envFeedTTL)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			cfg.FeedTTLs[feedType] = intFeedTTL
 		}
-		cfg.SpurFeedType = feedType
-	} else {
-		cfg.SpurFeedType = spur.AnonymousFeed
 	}
 
 	envSpurRealtimeEnabled := os.Getenv("SPUR_REDIS_REALTIME_ENABLED")
@@ -126,6 +511,20 @@ func ParseConfigFromEnvironment() (Config, error) {
 
 	}
 
+	// Realtime updates only exist for some feed types, at least one configured feed type must have them
+	if cfg.SpurRealtimeEnabled {
+		realtimeFeedTypes := 0
+		for _, feedType := range cfg.SpurFeedTypes {
+			if feedType.HasRealtime() {
+				realtimeFeedTypes++
+			}
+		}
+
+		if realtimeFeedTypes == 0 {
+			return Config{}, fmt.Errorf("SPUR_REDIS_REALTIME_ENABLED is set but none of the feed types %v have realtime data, only %s does", cfg.SpurFeedTypes, spur.AnonymousResidential)
+		}
+	}
+
 	envPort := os.Getenv("SPUR_REDIS_PORT")
 	if envPort != "" {
 		intPort, err := strconv.Atoi(envPort)
@@ -156,6 +555,33 @@ func ParseConfigFromEnvironment() (Config, error) {
 		return Config{}, fmt.Errorf("SPUR_REDIS_LOCAL_API_AUTH_TOKENS is required")
 	}
 
+	envBatchLimit := os.Getenv("SPUR_REDIS_BATCH_LIMIT")
+	if envBatchLimit != "" {
+		intBatchLimit, err := strconv.Atoi(envBatchLimit)
+		if err != nil || intBatchLimit < 1 {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_BATCH_LIMIT: %s", envBatchLimit)
+		}
+		cfg.BatchLimit = intBatchLimit
+	}
+
+	envMetricsPort := os.Getenv("SPUR_REDIS_METRICS_PORT")
+	if envMetricsPort != "" {
+		intMetricsPort, err := strconv.Atoi(envMetricsPort)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_METRICS_PORT: %v", err)
+		}
+		cfg.MetricsPort = intMetricsPort
+	}
+
+	envMaxFeedAge := os.Getenv("SPUR_REDIS_MAX_FEED_AGE")
+	if envMaxFeedAge != "" {
+		durationMaxFeedAge, err := time.ParseDuration(envMaxFeedAge)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SPUR_REDIS_MAX_FEED_AGE: %v", err)
+		}
+		cfg.MaxFeedAge = durationMaxFeedAge
+	}
+
 	envIPv6Enabled := os.Getenv("SPUR_REDIS_IPV6_NETWORK_FEED_BETA")
 	if envIPv6Enabled != "" {
 		boolIPv6Enabled, err := strconv.ParseBool(envIPv6Enabled)
@@ -170,8 +596,43 @@ func ParseConfigFromEnvironment() (Config, error) {
 	return cfg, nil
 }
 
-// String
+// redacted - a secret as it is shown in the config, only whether it is set
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
+}
+
+// redactedAll - a list of secrets as it is shown in the config
+func redactedAll(secrets []string) []string {
+	if secrets == nil {
+		return nil
+	}
+	shown := make([]string, len(secrets))
+	for i, secret := range secrets {
+		shown[i] = redacted(secret)
+	}
+	return shown
+}
+
+// String - the config for logging, with passwords and tokens redacted
 func (c Config) String() string {
-	return fmt.Sprintf("ChunkSize: %d, TTL: %d, RedisAddr: %s, RedisPass: %s, RedisDB: %d, ConcurrentNum: %d, SpurAPIToken: %s, SpurFeedType: %s, SpurRealtimeEnabled: %t, Port: %d, LocalAPIAuthTokens: %v, CertFile: %s, KeyFile: %s, IPv6NetworkFeedBeta: %t",
-		c.ChunkSize, c.TTL, c.RedisAddr, c.RedisPass, c.RedisDB, c.ConcurrentNum, c.SpurAPIToken, c.SpurFeedType, c.SpurRealtimeEnabled, c.Port, c.LocalAPIAuthTokens, c.CertFile, c.KeyFile, c.IPv6NetworkFeedBeta)
+	return fmt.Sprintf("ChunkSize: %d, TTL: %d, Backend: %s, BoltPath: %s, RedisAddr: %s, RedisUsername: %s, RedisPass: %s, RedisDB: %d, RedisSentinelMaster: %s, RedisSentinelAddrs: %v, RedisSentinelPass: %s, RedisClusterAddrs: %v, RedisTLS: %t, RedisTLSCAFile: %s, RedisTLSCertFile: %s, RedisTLSKeyFile: %s, RedisTLSServerName: %s, RedisPoolSize: %d, RedisDialTimeout: %s, RedisReadTimeout: %s, RedisWriteTimeout: %s, RedisKeyPrefix: %s, RedisAtomicMerge: %t, RedisLayout: %s, RedisEncoding: %s, RedisIndexes: %t, RedisNetworkIndex: %t, ConcurrentNum: %d, SpurAPIToken: %s, SpurAPITimeout: %s, SpurAPIMaxRetries: %d, SpurAPIBreakerThreshold: %d, SpurAPIBreakerCooldown: %s, CacheDir: %s, CacheMaxAge: %s, CacheMaxSizeMB: %d, Offline: %t, StagingDir: %s, DeadLetterPath: %s, DeadLetterMaxSizeMB: %d, DeadLetterMaxFiles: %d, MaxRejectRatio: %g, SpurFeedTypes: %v, FeedTTLs: %v, SpurRealtimeEnabled: %t, Port: %d, LocalAPIAuthTokens: %v, BatchLimit: %d, MetricsPort: %d, MaxFeedAge: %s, CertFile: %s, KeyFile: %s, IPv6NetworkFeedBeta: %t",
+		c.ChunkSize, c.TTL, c.Backend, c.BoltPath, c.RedisAddr, c.RedisUsername, redacted(c.RedisPass), c.RedisDB, c.RedisSentinelMaster, c.RedisSentinelAddrs, redacted(c.RedisSentinelPass), c.RedisClusterAddrs, c.RedisTLS, c.RedisTLSCAFile, c.RedisTLSCertFile, c.RedisTLSKeyFile, c.RedisTLSServerName, c.RedisPoolSize, c.RedisDialTimeout, c.RedisReadTimeout, c.RedisWriteTimeout, c.RedisKeyPrefix, c.RedisAtomicMerge, c.RedisLayout, c.RedisEncoding, c.RedisIndexes, c.RedisNetworkIndex, c.ConcurrentNum, redacted(c.SpurAPIToken), c.SpurAPITimeout, c.SpurAPIMaxRetries, c.SpurAPIBreakerThreshold, c.SpurAPIBreakerCooldown, c.CacheDir, c.CacheMaxAge, c.CacheMaxSizeMB, c.Offline, c.StagingDir, c.DeadLetterPath, c.DeadLetterMaxSizeMB, c.DeadLetterMaxFiles, c.MaxRejectRatio, c.SpurFeedTypes, c.FeedTTLs, c.SpurRealtimeEnabled, c.Port, redactedAll(c.LocalAPIAuthTokens), c.BatchLimit, c.MetricsPort, c.MaxFeedAge, c.CertFile, c.KeyFile, c.IPv6NetworkFeedBeta)
+}
+
+// FeedTTL - the TTL in hours for records of the given feed type
+func (c Config) FeedTTL(feedType spur.FeedType) int {
+	if ttl, ok := c.FeedTTLs[feedType]; ok {
+		return ttl
+	}
+
+	return c.TTL
+}
+
+// FeedNamespace - the key namespace for the given feed type. Every feed type gets its own namespace however many are
+// configured, so adding a feed type doesn't move the keys of the ones already loaded.
+func (c Config) FeedNamespace(feedType spur.FeedType) string {
+	return string(feedType) + ":"
 }
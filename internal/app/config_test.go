@@ -0,0 +1,113 @@
+package app
+
+import (
+	"testing"
+
+	"feedexampleredis/internal/spur"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigFeedTypes(t *testing.T) {
+	tests := []struct {
+		name          string
+		feedType      string
+		realtime      string
+		wantErr       bool
+		wantFeedTypes []spur.FeedType
+	}{
+		{name: "Default", wantFeedTypes: []spur.FeedType{spur.AnonymousFeed}},
+		{name: "Multiple", feedType: "anonymous, ipsummary", wantFeedTypes: []spur.FeedType{spur.AnonymousFeed, spur.IPSummaryFeed}},
+		{name: "Unknown", feedType: "anonymous,nope", wantErr: true},
+		{name: "Duplicate", feedType: "anonymous,anonymous", wantErr: true},
+		{name: "Realtime residential", feedType: "anonymous-residential", realtime: "true", wantFeedTypes: []spur.FeedType{spur.AnonymousResidential}},
+		{name: "Realtime mixed", feedType: "anonymous-residential,ipsummary", realtime: "true", wantFeedTypes: []spur.FeedType{spur.AnonymousResidential, spur.IPSummaryFeed}},
+		{name: "Realtime unsupported", feedType: "anonymous", realtime: "true", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SPUR_REDIS_API_TOKEN", "token")
+			t.Setenv("SPUR_REDIS_LOCAL_API_AUTH_TOKENS", "token")
+			t.Setenv("SPUR_REDIS_FEED_TYPE", tt.feedType)
+			t.Setenv("SPUR_REDIS_REALTIME_ENABLED", tt.realtime)
+
+			cfg, err := ParseConfigFromEnvironment()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFeedTypes, cfg.SpurFeedTypes)
+			assert.Equal(t, string(tt.wantFeedTypes[0])+":", cfg.FeedNamespace(tt.wantFeedTypes[0]), "every feed is namespaced")
+		})
+	}
+}
+
+func TestParseConfigFeedTTL(t *testing.T) {
+	t.Setenv("SPUR_REDIS_API_TOKEN", "token")
+	t.Setenv("SPUR_REDIS_LOCAL_API_AUTH_TOKENS", "token")
+	t.Setenv("SPUR_REDIS_FEED_TYPE", "anonymous,anonymous-residential")
+	t.Setenv("SPUR_REDIS_TTL", "12")
+	t.Setenv("SPUR_REDIS_TTL_ANONYMOUS_RESIDENTIAL", "48")
+
+	cfg, err := ParseConfigFromEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, 12, cfg.FeedTTL(spur.AnonymousFeed))
+	assert.Equal(t, 48, cfg.FeedTTL(spur.AnonymousResidential))
+	assert.Equal(t, "anonymous:", cfg.FeedNamespace(spur.AnonymousFeed))
+}
+
+func TestParseConfigAPIMaxRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+		want    int
+	}{
+		{name: "Default", want: spur.DefaultMaxRetries},
+		{name: "Disabled", value: "0", want: 0},
+		{name: "Set", value: "5", want: 5},
+		{name: "Negative", value: "-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SPUR_REDIS_API_TOKEN", "token")
+			t.Setenv("SPUR_REDIS_LOCAL_API_AUTH_TOKENS", "token")
+			t.Setenv("SPUR_REDIS_API_MAX_RETRIES", tt.value)
+
+			cfg, err := ParseConfigFromEnvironment()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg.SpurAPIMaxRetries)
+		})
+	}
+}
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	cfg := Config{
+		RedisUsername:      "spur",
+		RedisPass:          "redis-secret",
+		RedisSentinelPass:  "sentinel-secret",
+		SpurAPIToken:       "api-secret",
+		LocalAPIAuthTokens: []string{"local-secret", "other-secret"},
+	}
+
+	s := cfg.String()
+	for _, secret := range []string{"redis-secret", "sentinel-secret", "api-secret", "local-secret", "other-secret"} {
+		assert.NotContains(t, s, secret)
+	}
+	assert.Contains(t, s, "RedisUsername: spur")
+	assert.Contains(t, s, "RedisPass: ***")
+	assert.Contains(t, s, "LocalAPIAuthTokens: [*** ***]")
+
+	// Unset secrets are shown as unset
+	assert.Contains(t, Config{}.String(), "SpurAPIToken: ,")
+}
@@ -3,92 +3,133 @@ package commands
 import (
 	"context"
 	"feedexampleredis/internal/app"
+	"feedexampleredis/internal/metrics"
 	"feedexampleredis/internal/spur"
 	"feedexampleredis/internal/storage"
 	"fmt"
+	"io"
 	"time"
 
 	"log/slog"
+
+	"golang.org/x/sync/errgroup"
 )
 
-func Daemon(ctx context.Context, cfg app.Config, redisClient *storage.Redis, v6Client *storage.MMDB) error {
+// Daemon - keep every configured feed up to date, each feed is polled and loaded independently of the others
+func Daemon(ctx context.Context, cfg app.Config, feeds []storage.FeedStore) error {
 	slog.Info("starting process")
 	defer slog.Info("stopping process")
 
 	// Setup the spur api client
-	spurAPI := spur.NewAPI("https://feeds.spur.us", "v2", cfg.SpurAPIToken)
+	spurAPI := spur.NewAPIWithOptions("https://feeds.spur.us", "v2", cfg.SpurAPIToken, spur.ClientOptions{
+		Timeout:          cfg.SpurAPITimeout,
+		MaxRetries:       cfg.SpurAPIMaxRetries,
+		BreakerThreshold: cfg.SpurAPIBreakerThreshold,
+		BreakerCooldown:  cfg.SpurAPIBreakerCooldown,
+		CacheDir:         cfg.CacheDir,
+		CacheMaxAge:      cfg.CacheMaxAge,
+		CacheMaxSize:     int64(cfg.CacheMaxSizeMB) << 20,
+		Offline:          cfg.Offline,
+		StagingDir:       cfg.StagingDir,
+	})
 	slog.Info(
 		"spur api client created",
 		slog.String("api_version", spurAPI.Version),
 		slog.String("base_url", spurAPI.BaseURL),
+		slog.String("cache_dir", cfg.CacheDir),
+		slog.Bool("offline", cfg.Offline),
 	)
 
-	// check redis for the latest feed info, in case we restarted
-	lastFeedInfo, err := redisClient.GetLatestFeedInfo(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+	for _, feed := range feeds {
+		feed := feed
+		g.Go(func() error {
+			return feedDaemon(ctx, cfg, feed, spurAPI)
+		})
+	}
+
+	return g.Wait()
+}
+
+// feedDaemon - seed a single feed if it has no data yet, then check for new data every minute
+func feedDaemon(ctx context.Context, cfg app.Config, feed storage.FeedStore, spurAPI *spur.API) error {
+	store, v6Store := feed.V4, feed.V6
+
+	// Realtime updates are only merged into the feed types that have them
+	realtimeEnabled := cfg.SpurRealtimeEnabled && feed.FeedType.HasRealtime()
+	slog.Info("starting feed", slog.String("feed_type", string(feed.FeedType)), slog.Bool("realtime", realtimeEnabled))
+	if cfg.SpurRealtimeEnabled && !realtimeEnabled {
+		slog.Warn(
+			"realtime is enabled but this feed type has no realtime data, only its full feed will be loaded",
+			slog.String("feed_type", string(feed.FeedType)),
+			slog.String("realtime_feed_type", string(spur.AnonymousResidential)),
+		)
+	}
+	defer slog.Info("stopping feed", slog.String("feed_type", string(feed.FeedType)))
+
+	// check the store for the latest feed info, in case we restarted
+	lastFeedInfo, err := store.GetLatestFeedInfo(ctx)
 	if err != nil {
 		lastFeedInfo = &spur.FeedInfo{}
 	}
 
-	// check redis for the latest merged data, in case we restarted
-	lastRealtimeInfo, err := redisClient.GetLatestRealtimeFeedInfo(ctx)
+	// check the store for the latest merged data, in case we restarted
+	lastRealtimeInfo, err := store.GetLatestRealtimeFeedInfo(ctx)
 	if err != nil {
 		lastRealtimeInfo = &spur.RealtimeFeedInfo{}
 	}
 
 	// If we don't have the latest feed info, download and process the latest feed file to seed the initial data
 	if lastFeedInfo.JSON.Date == "" {
-		lastFeedInfo, err = spurAPI.LatestFeedInfo(ctx, cfg.SpurFeedType)
+		lastFeedInfo, err = spurAPI.LatestFeedInfo(ctx, feed.FeedType)
 		if err != nil {
-			return fmt.Errorf("error getting latest feed info: %v", err)
+			return fmt.Errorf("error getting latest %s feed info: %v", feed.FeedType, err)
 		}
 
-		slog.Info("no initial data found, downloading latest feed")
-		feedStream, err := spurAPI.LatestFeed(ctx, cfg.SpurFeedType)
+		slog.Info("no initial data found, downloading latest feed", slog.String("feed_type", string(feed.FeedType)))
+		feedStream, err := spurAPI.LatestFeed(ctx, feed.FeedType, lastFeedInfo)
 		if err != nil {
 			return fmt.Errorf("error getting latest feed: %v", err)
 		}
 
-		count, err := redisClient.StreamingFeedInsert(ctx, feedStream)
+		count, err := insertFeed(ctx, string(feed.FeedType), store, feedStream)
 		if err != nil {
-			return fmt.Errorf("error inserting feed into redis: %v", err)
+			return fmt.Errorf("error inserting feed into redis after %d records: %w", count, err)
 		}
 
-		err = redisClient.PutLatestFeedInfo(ctx, lastFeedInfo)
+		err = store.PutLatestFeedInfo(ctx, lastFeedInfo)
 		if err != nil {
 			return fmt.Errorf("error storing latest feed info: %v", err)
 		}
 
-		slog.Info("feed inserted into redis", slog.Int64("count", count))
+		slog.Info(
+			"feed inserted into redis",
+			slog.String("feed_type", string(feed.FeedType)),
+			slog.Int64("count", count),
+			slog.Int64("removed", removedCount(ctx, store)),
+		)
 
-		// Reprocess all the realtime data from the feed date 00:00:00 until now
-		if cfg.SpurRealtimeEnabled {
-			err := reprocessRealtime(ctx, redisClient, spurAPI, lastFeedInfo.JSON.Date)
-			if err != nil {
-				return fmt.Errorf("error reprocessing realtime data: %v", err)
-			}
+	}
+
+	// Merge the realtime data from the feed date 00:00:00 until now, after a restart this resumes from the checkpoints
+	// of the slots that were already merged
+	gaps := &gapRetrier{}
+	if realtimeEnabled {
+		remaining, err := reprocessRealtime(ctx, feed.FeedType, store, spurAPI, lastFeedInfo.JSON.Date)
+		if err != nil {
+			return fmt.Errorf("error reprocessing realtime data: %v", err)
 		}
+		gaps.update(remaining, nil, time.Now())
 	}
 
 	// Since ipv6 is in memory and not in redis, we need to reprocess it every time the daemon starts
-	v6FeedType, err := cfg.SpurFeedType.V6FeedType()
-	if err == nil && cfg.IPv6NetworkFeedBeta {
+	v6FeedType, err := feed.FeedType.V6FeedType()
+	if err == nil && v6Store != nil && cfg.IPv6NetworkFeedBeta {
 		latestV6Info, err := spurAPI.LatestFeedInfo(ctx, v6FeedType)
 		if err != nil {
 			slog.Warn("error getting latest ipv6 feed info", "error", err.Error())
 		} else {
-			v6Client.SetLastFeedInfo(latestV6Info)
-		}
-
-		ipv6FeedStream, err := spurAPI.LatestFeed(ctx, v6FeedType)
-		if err != nil {
-			slog.Warn("error getting latest ipv6 feed", "error", err.Error())
-		} else {
-			count, err := v6Client.StreamingFeedInsert(ctx, ipv6FeedStream)
-			if err != nil {
-				slog.Warn("error inserting ipv6 feed into mmdb", "error", err.Error())
-			} else {
-				slog.Info("ipv6 feed inserted into mmdb", slog.Int64("count", count))
-			}
+			processLatestV6FeedFile(ctx, v6FeedType, latestV6Info, v6Store, spurAPI)
 		}
 	}
 
@@ -103,54 +144,39 @@ func Daemon(ctx context.Context, cfg app.Config, redisClient *storage.Redis, v6C
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			slog.Info("checking for new full feed data")
-			latestFeedInfo, err := spurAPI.LatestFeedInfo(ctx, cfg.SpurFeedType)
+			slog.Info("checking for new full feed data", slog.String("feed_type", string(feed.FeedType)))
+			latestFeedInfo, err := spurAPI.LatestFeedInfo(ctx, feed.FeedType)
 			if err != nil {
-				slog.Error("error getting latest feed info", "error", err.Error())
+				slog.Error("error getting latest feed info", "feed_type", feed.FeedType, "error", err.Error())
 				continue
 			}
 
-			// Check for new ipv6 data if we have a client, supported feed type, and beta is enabled
-			if v6Client != nil && v6FeedType != spur.FeedTypeUnknown && cfg.IPv6NetworkFeedBeta {
+			// Check for new ipv6 data if we have a store, supported feed type, and beta is enabled
+			if v6Store != nil && v6FeedType != spur.FeedTypeUnknown && cfg.IPv6NetworkFeedBeta {
 				latestV6Info, err := spurAPI.LatestFeedInfo(ctx, v6FeedType)
 				if err != nil {
 					slog.Error("error getting latest ipv6 feed info", "error", err.Error())
-				} else {
-					v6Client.SetLastFeedInfo(latestV6Info)
-				}
-
-				if latestV6Info.JSON.Date != v6Client.GetLastFeedInfo().JSON.Date {
-					ipv6FeedStream, err := spurAPI.LatestFeed(ctx, v6FeedType)
-					if err != nil {
-						slog.Warn("error getting latest ipv6 feed", "error", err.Error())
-					} else {
-						count, err := v6Client.StreamingFeedInsert(ctx, ipv6FeedStream)
-						if err != nil {
-							slog.Warn("error inserting ipv6 feed into mmdb", "error", err.Error())
-						} else {
-							slog.Info("ipv6 feed inserted into mmdb", slog.Int64("count", count))
-						}
-
-						slog.Info("ipv6 feed inserted into mmdb", slog.Int64("count", count))
-					}
+				} else if lastV6Info, err := v6Store.GetLatestFeedInfo(ctx); err != nil || latestV6Info.JSON.Date != lastV6Info.JSON.Date {
+					processLatestV6FeedFile(ctx, v6FeedType, latestV6Info, v6Store, spurAPI)
 				}
 			}
 
 			// If the feed info has changed, get the new data
 			if latestFeedInfo.JSON.Date != lastFeedInfo.JSON.Date {
-				err := processLatestFeedFile(ctx, latestFeedInfo, redisClient, spurAPI)
+				err := processLatestFeedFile(ctx, feed.FeedType, latestFeedInfo, store, spurAPI)
 				if err != nil {
-					slog.Error("error processing latest feed file", "error", err.Error())
+					slog.Error("error processing latest feed file", "feed_type", feed.FeedType, "error", err.Error())
 					continue
 				}
 				lastFeedInfo = latestFeedInfo
 
 				// Reprocess all the realtime data from the feed date 00:00:00 until now
-				if cfg.SpurRealtimeEnabled {
-					err := reprocessRealtime(ctx, redisClient, spurAPI, latestFeedInfo.JSON.Date)
+				if realtimeEnabled {
+					remaining, err := reprocessRealtime(ctx, feed.FeedType, store, spurAPI, latestFeedInfo.JSON.Date)
 					if err != nil {
 						slog.Error("error reprocessing realtime data", "error", err.Error())
 					}
+					gaps.update(remaining, err, time.Now())
 				}
 
 				// Reprocessing will take care of getting the latest realtime info, so we can skip the rest of this loop
@@ -158,12 +184,12 @@ func Daemon(ctx context.Context, cfg app.Config, redisClient *storage.Redis, v6C
 			}
 
 			// Realtime must be enabled to process realtime data
-			if !cfg.SpurRealtimeEnabled {
+			if !realtimeEnabled {
 				continue
 			}
 
-			slog.Info("checking for new realtime feed data")
-			latestRealtimeInfo, err := spurAPI.LatestRealtimeFeedInfo(ctx, spur.AnonymousResidential)
+			slog.Info("checking for new realtime feed data", slog.String("feed_type", string(feed.FeedType)))
+			latestRealtimeInfo, err := spurAPI.LatestRealtimeFeedInfo(ctx, feed.FeedType)
 			if err != nil {
 				slog.Error("error getting latest realtime feed info", "error", err.Error())
 				continue
@@ -171,12 +197,22 @@ func Daemon(ctx context.Context, cfg app.Config, redisClient *storage.Redis, v6C
 
 			// If the realtime info has changed, merge in the new data
 			if latestRealtimeInfo.JSON.Date != lastRealtimeInfo.JSON.Date {
-				err := processLatestRealtimeFeedFile(ctx, latestRealtimeInfo, redisClient, spurAPI)
+				err := processLatestRealtimeFeedFile(ctx, feed.FeedType, lastFeedInfo.JSON.Date, latestRealtimeInfo, store, spurAPI)
 				if err != nil {
 					slog.Error("error processing latest realtime feed file", "error", err.Error())
-					continue
+				} else {
+					lastRealtimeInfo = latestRealtimeInfo
+				}
+			}
+
+			// Fill in any slots that were missed every so often, backing off while they keep failing. Without
+			// checkpoints every slot would look missed, so this needs a store that keeps them.
+			if _, ok := store.(storage.RealtimeCheckpointer); ok && gaps.due(time.Now()) {
+				remaining, err := reprocessRealtime(ctx, feed.FeedType, store, spurAPI, lastFeedInfo.JSON.Date)
+				if err != nil {
+					slog.Error("error reprocessing realtime data", "error", err.Error())
 				}
-				lastRealtimeInfo = latestRealtimeInfo
+				gaps.update(remaining, err, time.Now())
 			}
 		}
 	}
@@ -184,93 +220,250 @@ func Daemon(ctx context.Context, cfg app.Config, redisClient *storage.Redis, v6C
 }
 
 // processLatestFeedFile - download and process the latest feed file
-func processLatestFeedFile(ctx context.Context, latestFeedInfo *spur.FeedInfo, redisClient *storage.Redis, spurAPI *spur.API) error {
-	slog.Info("new feed info found, downloading latest feed")
+func processLatestFeedFile(ctx context.Context, feedType spur.FeedType, latestFeedInfo *spur.FeedInfo, store storage.Store, spurAPI *spur.API) error {
+	slog.Info("new feed info found, downloading latest feed", slog.String("feed_type", string(feedType)))
 
 	// Now download the latest feed file and process it
 	slog.Info("processing the latest feed file")
-	feedStream, err := spurAPI.LatestFeed(ctx, spur.AnonymousResidential)
+	feedStream, err := spurAPI.LatestFeed(ctx, feedType, latestFeedInfo)
 	if err != nil {
 		return fmt.Errorf("error getting latest feed: %v", err)
 	}
 
 	// insert the feed into redis
-	count, err := redisClient.StreamingFeedInsert(ctx, feedStream)
+	count, err := insertFeed(ctx, string(feedType), store, feedStream)
 	if err != nil {
-		return fmt.Errorf("error inserting feed into redis: %v", err)
+		return fmt.Errorf("error inserting feed into redis after %d records: %w", count, err)
 	}
 
 	// we are done so store the latest feed info to redis
-	err = redisClient.PutLatestFeedInfo(ctx, latestFeedInfo)
+	err = store.PutLatestFeedInfo(ctx, latestFeedInfo)
 	if err != nil {
 		return fmt.Errorf("error storing latest feed info: %v", err)
 	}
 
-	slog.Info("feed inserted into redis", slog.Int64("count", count))
+	slog.Info(
+		"feed inserted into redis",
+		slog.String("feed_type", string(feedType)),
+		slog.Int64("count", count),
+		slog.Int64("removed", removedCount(ctx, store)),
+	)
 
 	return nil
 }
 
-// processLatestRealtimeFeedFile - download and process the latest realtime feed file
-func processLatestRealtimeFeedFile(ctx context.Context, latestRealtimeInfo *spur.RealtimeFeedInfo, redisClient *storage.Redis, spurAPI *spur.API) error {
-	slog.Info("new realtime feed info found, downloading latest realtime feed")
+// processLatestV6FeedFile - download the latest ipv6 feed file and rebuild the ipv6 store from it, failures are logged
+// and the previous data is kept
+func processLatestV6FeedFile(ctx context.Context, v6FeedType spur.FeedType, latestV6Info *spur.FeedInfo, v6Store storage.Store, spurAPI *spur.API) {
+	ipv6FeedStream, err := spurAPI.LatestFeed(ctx, v6FeedType, latestV6Info)
+	if err != nil {
+		slog.Warn("error getting latest ipv6 feed", "error", err.Error())
+		return
+	}
+
+	count, err := insertFeed(ctx, string(v6FeedType), v6Store, ipv6FeedStream)
+	if err != nil {
+		slog.Warn("error inserting ipv6 feed into mmdb", "error", err.Error())
+		return
+	}
+
+	err = v6Store.PutLatestFeedInfo(ctx, latestV6Info)
+	if err != nil {
+		slog.Warn("error storing latest ipv6 feed info", "error", err.Error())
+	}
+
+	slog.Info("ipv6 feed inserted into mmdb", slog.String("feed_type", string(v6FeedType)), slog.Int64("count", count))
+}
+
+// processLatestRealtimeFeedFile - download and process the realtime file for the slot of the latest realtime feed info.
+// The file is fetched by its slot rather than as the latest file, so the slot recorded is always the one merged.
+func processLatestRealtimeFeedFile(ctx context.Context, feedType spur.FeedType, feedDate string, latestRealtimeInfo *spur.RealtimeFeedInfo, store storage.Store, spurAPI *spur.API) error {
+	slot := storage.RealtimeSlot(latestRealtimeInfo.JSON.Date)
+	slog.Info("new realtime feed info found, downloading latest realtime feed", slog.String("feed_type", string(feedType)), slog.Time("slot", slot))
 
 	// Now download the latest realtime feed file and process it
 	slog.Info("processing the latest realtime feed file")
-	realtimeFeedStream, err := spurAPI.LatestRealtimeFeed(ctx, spur.AnonymousResidential)
+	realtimeFeedStream, err := spurAPI.RealtimeFeed(ctx, feedType, slot)
 	if err != nil {
 		return fmt.Errorf("error getting latest realtime feed: %v", err)
 	}
 
 	// insert the realtime feed into redis
-	count, err := redisClient.StreamingMergeInsert(ctx, realtimeFeedStream)
+	count, err := mergeFeed(ctx, string(feedType), store, realtimeFeedStream)
 	if err != nil {
-		return fmt.Errorf("error inserting realtime feed into redis: %v", err)
+		return fmt.Errorf("error inserting realtime feed into redis after %d records: %w", count, err)
 	}
 
 	// we are done so store the latest feed info to redis
-	err = redisClient.PutLatestRealtimeFeedInfo(ctx, latestRealtimeInfo)
+	err = store.PutLatestRealtimeFeedInfo(ctx, latestRealtimeInfo)
 	if err != nil {
 		return fmt.Errorf("error storing latest realtime feed info: %v", err)
 	}
 
-	slog.Info("realtime feed merged into redis", slog.Int64("count", count))
+	slog.Info("realtime feed merged into redis", slog.String("feed_type", string(feedType)), slog.Int64("count", count))
+
+	// record the slot so the backfill doesn't merge it again
+	putRealtimeCheckpoint(ctx, store, feedDate, slot)
 
 	return nil
 }
 
-// reprocessRealtime - reprocess all realtime data from the given feed date until now
-func reprocessRealtime(ctx context.Context, redisClient *storage.Redis, spurAPI *spur.API, feedDate string) error {
-	latestFeedDate, err := time.Parse("20060102", feedDate)
+// Realtime slots that fail to download or merge are retried a few times before being left as a gap. Gaps are looked
+// for every realtimeGapInterval, or sooner with backoff while there are gaps left.
+const (
+	realtimeSlotAttempts   = 3
+	realtimeSlotBackoff    = 2 * time.Second
+	realtimeGapInterval    = 10 * time.Minute
+	realtimeGapBackoff     = 1 * time.Minute
+	realtimeGapBackoffMax  = 30 * time.Minute
+	realtimeCheckpointWait = 5 * time.Second
+)
+
+// reprocessRealtime - merge every realtime slot from the given feed date 00:00:00 until now that hasn't been merged
+// yet, oldest first. Slots that still fail after retrying are left as gaps to be filled in on a later run, the number
+// of gaps remaining is returned.
+func reprocessRealtime(ctx context.Context, feedType spur.FeedType, store storage.Store, spurAPI *spur.API, feedDate string) (int, error) {
+	gaps, err := storage.RealtimeGaps(ctx, store, feedDate, time.Now().UTC())
 	if err != nil {
-		return fmt.Errorf("error parsing latest feed date: %v", err)
+		return 0, fmt.Errorf("error finding realtime gaps: %v", err)
 	}
 
-	// Make sure the latest feed date is in UTC
-	latestFeedDate = latestFeedDate.UTC()
-
-	// Starting from latest feed date pull all realtime data until now, incrementing by 5 minutes each time
-	currentTime := latestFeedDate
 	totalCount := int64(0)
-	for currentTime.Before(time.Now().UTC()) {
-		slog.Info("processing realtime file for time", "time", currentTime.Format(time.RFC3339))
-		realtimeFeedStream, err := spurAPI.RealtimeFeed(ctx, spur.AnonymousResidential, currentTime)
+	remaining := 0
+	for _, slot := range gaps {
+		count, err := mergeRealtimeSlot(ctx, feedType, store, spurAPI, feedDate, slot)
 		if err != nil {
-			return fmt.Errorf("error getting realtime feed: %v", err)
-		}
+			if ctx.Err() != nil {
+				return remaining, ctx.Err()
+			}
 
-		count, err := redisClient.StreamingMergeInsert(ctx, realtimeFeedStream)
-		if err != nil {
-			slog.Error("error inserting realtime feed into redis", "error", err.Error())
-			currentTime = currentTime.Add(5 * time.Minute)
+			slog.Error("error merging realtime slot, leaving it as a gap", "time", slot.Format(time.RFC3339), "error", err.Error())
+			remaining++
 			continue
 		}
 
-		currentTime = currentTime.Add(5 * time.Minute)
 		totalCount += count
 	}
 
-	slog.Info("reprocessed historical realtime feed into redis", slog.Int64("count", totalCount))
+	slog.Info(
+		"reprocessed historical realtime feed into redis",
+		slog.String("feed_type", string(feedType)),
+		slog.Int64("count", totalCount),
+		slog.Int("slots", len(gaps)-remaining),
+		slog.Int("gaps", remaining),
+	)
 
-	return nil
+	return remaining, nil
+}
+
+// mergeRealtimeSlot - download and merge the realtime file for a single slot, retrying with exponential backoff, and
+// record the slot once it has been merged
+func mergeRealtimeSlot(ctx context.Context, feedType spur.FeedType, store storage.Store, spurAPI *spur.API, feedDate string, slot time.Time) (int64, error) {
+	backoff := realtimeSlotBackoff
+	for attempt := 1; ; attempt++ {
+		slog.Info("processing realtime file for time", "time", slot.Format(time.RFC3339), "attempt", attempt)
+		count, err := func() (int64, error) {
+			realtimeFeedStream, err := spurAPI.RealtimeFeed(ctx, feedType, slot)
+			if err != nil {
+				return 0, fmt.Errorf("error getting realtime feed: %v", err)
+			}
+
+			count, err := mergeFeed(ctx, string(feedType), store, realtimeFeedStream)
+			if err != nil {
+				return count, fmt.Errorf("error inserting realtime feed into redis after %d records: %w", count, err)
+			}
+
+			return count, nil
+		}()
+		if err == nil {
+			putRealtimeCheckpoint(ctx, store, feedDate, slot)
+			return count, nil
+		}
+
+		if attempt == realtimeSlotAttempts {
+			return 0, err
+		}
+
+		slog.Warn("error merging realtime slot, retrying", "time", slot.Format(time.RFC3339), "backoff", backoff.String(), "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// putRealtimeCheckpoint - record a merged realtime slot if the store keeps checkpoints, failures are only logged since
+// the worst case is the slot being merged again
+func putRealtimeCheckpoint(ctx context.Context, store storage.Store, feedDate string, slot time.Time) {
+	checkpointer, ok := store.(storage.RealtimeCheckpointer)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, realtimeCheckpointWait)
+	defer cancel()
+
+	err := checkpointer.PutRealtimeCheckpoint(ctx, feedDate, slot)
+	if err != nil {
+		slog.Warn("error storing realtime checkpoint", "time", slot.Format(time.RFC3339), "error", err.Error())
+	}
+}
+
+// gapRetrier - schedules retries of realtime gaps, backing off while they keep failing
+type gapRetrier struct {
+	next    time.Time
+	backoff time.Duration
+}
+
+// due - whether the gaps should be retried now
+func (g *gapRetrier) due(now time.Time) bool {
+	return !now.Before(g.next)
+}
+
+// update - schedule the next run from the number of gaps left by the last one, a run that failed outright backs off
+// the same as one that left gaps
+func (g *gapRetrier) update(remaining int, err error, now time.Time) {
+	if remaining == 0 && err == nil {
+		g.backoff = 0
+		g.next = now.Add(realtimeGapInterval)
+		return
+	}
+
+	g.backoff *= 2
+	if g.backoff < realtimeGapBackoff {
+		g.backoff = realtimeGapBackoff
+	}
+	if g.backoff > realtimeGapBackoffMax {
+		g.backoff = realtimeGapBackoffMax
+	}
+	g.next = now.Add(g.backoff)
+}
+
+// insertFeed - load a full feed into a store, counting the load in the ingest metrics
+func insertFeed(ctx context.Context, feedType string, store storage.Store, rc io.ReadCloser) (int64, error) {
+	count, err := store.StreamingFeedInsert(ctx, rc)
+	metrics.ObserveIngest(feedType, storage.IngestKindFeed, count, rejectedLines(store), err)
+	return count, err
+}
+
+// mergeFeed - merge a realtime feed into a store, counting the load in the ingest metrics
+func mergeFeed(ctx context.Context, feedType string, store storage.Store, rc io.ReadCloser) (int64, error) {
+	count, err := store.StreamingMergeInsert(ctx, rc)
+	metrics.ObserveIngest(feedType, storage.IngestKindMerge, count, rejectedLines(store), err)
+	return count, err
+}
+
+// rejectedLines - the number of lines the last load into a store rejected, 0 if the store doesn't report its loads
+func rejectedLines(store storage.Store) int64 {
+	reporter, ok := store.(storage.ProgressReporter)
+	if !ok {
+		return 0
+	}
+	status, ok := reporter.IngestStatus()
+	if !ok {
+		return 0
+	}
+	return status.ParseFailures
 }
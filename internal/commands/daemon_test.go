@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"feedexampleredis/internal/spur"
+	"feedexampleredis/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessLatestRealtimeFeedFileCheckpointsSlot(t *testing.T) {
+	ctx := context.Background()
+
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		gzw := gzip.NewWriter(w)
+		gzw.Write([]byte(`{"ip":"1.1.1.1","organization":"realtime"}` + "\n"))
+		gzw.Close()
+	}))
+	defer srv.Close()
+	spurAPI := spur.NewAPIWithOptions(srv.URL, "v2", "token", spur.ClientOptions{MaxRetries: 1})
+
+	store := storage.NewBolt(filepath.Join(t.TempDir(), "test.db"), 2, 2)
+	require.NoError(t, store.Open())
+	defer store.Close()
+
+	var feed bytes.Buffer
+	gzw := gzip.NewWriter(&feed)
+	gzw.Write([]byte(`{"ip":"1.1.1.1","organization":"feed"}` + "\n"))
+	gzw.Close()
+	_, err := store.StreamingFeedInsert(ctx, io.NopCloser(&feed))
+	require.NoError(t, err)
+
+	// The latest file was published part way through the 00:05 slot
+	info := &spur.RealtimeFeedInfo{}
+	info.JSON.Date = time.Date(2024, 1, 2, 0, 7, 42, 0, time.UTC)
+	require.NoError(t, processLatestRealtimeFeedFile(ctx, spur.AnonymousResidential, "20240102", info, store, spurAPI))
+
+	assert.Equal(t, []string{"/v2/anonymous-residential/realtime/20240102/0005.json.gz"}, requested)
+	record, err := store.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "realtime", record.Organization)
+
+	// The backfill doesn't merge the slot again
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	gaps, err := storage.RealtimeGaps(ctx, store, "20240102", start.Add(20*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{start, start.Add(10 * time.Minute)}, gaps)
+}
@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"feedexampleredis/internal/storage"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// ReprocessDeadLetters - merge the dead-lettered lines rejected by a feed's IPv4 store back into it. Lines that are
+// rejected again are dead-lettered by the store as it merges them, and the lines from other stores go back to the dead
+// letter file untouched. The dead letters are claimed rather than removed, and only released once the lines still to be
+// reprocessed have been written back, so stopping part way loses none of them. The IPv6 store can only be rebuilt from
+// a full feed so its lines aren't reprocessed.
+func ReprocessDeadLetters(ctx context.Context, deadLetters *storage.DeadLetterFile, source string, store storage.Store) error {
+	letters, err := deadLetters.Claim()
+	if err != nil {
+		return fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	var selected, kept []storage.DeadLetter
+	for _, dl := range letters {
+		if dl.Source != source {
+			kept = append(kept, dl)
+			continue
+		}
+
+		selected = append(selected, dl)
+		io.WriteString(gzw, dl.Line+"\n")
+	}
+	gzw.Close()
+
+	var count int64
+	if len(selected) > 0 {
+		count, err = store.StreamingMergeInsert(ctx, io.NopCloser(&buf))
+	}
+	if err != nil {
+		// The merge may have stopped part way, and merging a line twice does no harm, so every line goes back to be
+		// tried again apart from those the merge already dead-lettered
+		unmerged, readErr := unmergedLetters(deadLetters, source, selected)
+		if readErr != nil {
+			return fmt.Errorf("failed to merge dead letters: %w, the claimed dead letters are kept: %v", err, readErr)
+		}
+		kept = append(kept, unmerged...)
+	}
+
+	for _, dl := range kept {
+		if writeErr := deadLetters.Write(dl); writeErr != nil {
+			return fmt.Errorf("failed to restore dead letters, the claimed dead letters are kept: %w", writeErr)
+		}
+	}
+	if releaseErr := deadLetters.Release(); releaseErr != nil {
+		return fmt.Errorf("failed to release dead letters: %w", releaseErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to merge dead letters: %w", err)
+	}
+
+	slog.Info(
+		"dead letters reprocessed",
+		slog.String("source", source),
+		slog.Int("lines", len(selected)),
+		slog.Int64("count", count),
+		slog.Int("kept", len(kept)),
+	)
+
+	return nil
+}
+
+// unmergedLetters - the selected dead letters that weren't dead-lettered again by a failed merge
+func unmergedLetters(deadLetters *storage.DeadLetterFile, source string, selected []storage.DeadLetter) ([]storage.DeadLetter, error) {
+	written, err := deadLetters.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	rejected := make(map[string]int)
+	for _, dl := range written {
+		if dl.Source == source {
+			rejected[dl.Line]++
+		}
+	}
+
+	var unmerged []storage.DeadLetter
+	for _, dl := range selected {
+		if rejected[dl.Line] > 0 {
+			rejected[dl.Line]--
+			continue
+		}
+		unmerged = append(unmerged, dl)
+	}
+	return unmerged, nil
+}
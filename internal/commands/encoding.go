@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"context"
+	"feedexampleredis/internal/storage"
+	"fmt"
+	"log/slog"
+)
+
+// encodingReportSample - how many records the encoding report samples
+const encodingReportSample = 10000
+
+// EncodingReport - log how much memory the current feed would take in Redis with each encoding
+func EncodingReport(ctx context.Context, redisClient *storage.Redis) error {
+	report, err := redisClient.EncodingReport(ctx, encodingReportSample)
+	if err != nil {
+		return fmt.Errorf("failed to build encoding report: %w", err)
+	}
+
+	slog.Info(
+		"encoding report",
+		slog.Int64("generation", report.Generation),
+		slog.String("layout", report.Layout),
+		slog.String("encoding", report.Encoding),
+		slog.Int64("records", report.Records),
+		slog.Int("sampled", report.Sampled),
+		slog.Int("dictionary_strings", report.DictionaryStrings),
+		slog.Int64("dictionary_bytes", report.DictionaryBytes),
+	)
+	for _, size := range report.Sizes {
+		slog.Info(
+			"encoding size",
+			slog.String("encoding", size.Encoding),
+			slog.Float64("avg_bytes", size.AvgBytes),
+			slog.Int64("estimated_mb", size.EstimatedBytes>>20),
+			slog.Float64("ratio", size.Ratio),
+		)
+	}
+
+	return nil
+}
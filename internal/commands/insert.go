@@ -8,7 +8,7 @@ import (
 	"os"
 )
 
-func InsertFeedFile(ctx context.Context, path string, redisClient *storage.Redis) error {
+func InsertFeedFile(ctx context.Context, path string, store storage.Store) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
@@ -16,15 +16,32 @@ func InsertFeedFile(ctx context.Context, path string, redisClient *storage.Redis
 	defer f.Close()
 
 	// Insert the feed
-	count, err := redisClient.StreamingFeedInsert(ctx, f)
+	count, err := store.StreamingFeedInsert(ctx, f)
 	if err != nil {
-		return fmt.Errorf("failed to insert feed: %w", err)
+		return fmt.Errorf("failed to insert feed after %d records: %w", count, err)
 	}
 
 	slog.Info(
 		"feed inserted",
 		slog.Int64("count", count),
+		slog.Int64("removed", removedCount(ctx, store)),
 	)
 
 	return nil
 }
+
+// removedCount - the number of IPs from the previous feed that were not present in the feed just inserted
+func removedCount(ctx context.Context, store storage.Store) int64 {
+	generational, ok := store.(storage.Generational)
+	if !ok {
+		return 0
+	}
+
+	info, err := generational.GetCurrentGenerationInfo(ctx)
+	if err != nil {
+		slog.Warn("error getting generation info", "error", err.Error())
+		return 0
+	}
+
+	return info.Removed
+}
@@ -8,7 +8,7 @@ import (
 	"os"
 )
 
-func MergeRealtimeFile(ctx context.Context, path string, redisClient *storage.Redis) error {
+func MergeRealtimeFile(ctx context.Context, path string, store storage.Store) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
@@ -16,9 +16,9 @@ func MergeRealtimeFile(ctx context.Context, path string, redisClient *storage.Re
 	defer f.Close()
 
 	// Insert the feed
-	count, err := redisClient.StreamingMergeInsert(ctx, f)
+	count, err := store.StreamingMergeInsert(ctx, f)
 	if err != nil {
-		return fmt.Errorf("failed to insert feed: %w", err)
+		return fmt.Errorf("failed to insert feed after %d records: %w", count, err)
 	}
 
 	slog.Info(
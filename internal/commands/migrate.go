@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"context"
+	"feedexampleredis/internal/storage"
+	"fmt"
+	"log/slog"
+)
+
+// MigrateKeys - move the keys written before a key prefix or the feed's namespace was configured under them. A dry run
+// prints the keys that would be moved instead.
+func MigrateKeys(ctx context.Context, redisClient *storage.Redis, opts storage.MigrateOptions) error {
+	if opts.DryRun {
+		opts.Listed = func(key string) { fmt.Println(key) }
+	}
+
+	count, err := redisClient.MigrateUnprefixedKeys(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to migrate keys: %w", err)
+	}
+
+	message := "keys migrated"
+	if opts.DryRun {
+		message = "keys that would be migrated"
+	}
+	slog.Info(
+		message,
+		slog.Int64("count", count),
+	)
+
+	return nil
+}
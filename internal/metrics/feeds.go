@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"feedexampleredis/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	feedGeneratedDesc = prometheus.NewDesc(
+		"spurredis_feed_generated_timestamp_seconds",
+		"When the full feed being served was generated, from the stored feed_info.",
+		[]string{"feed_type"}, nil,
+	)
+	realtimeFeedDesc = prometheus.NewDesc(
+		"spurredis_realtime_feed_timestamp_seconds",
+		"The time of the last realtime file merged, from the stored realtime_feed_info.",
+		[]string{"feed_type"}, nil,
+	)
+	mmdbRecordsDesc = prometheus.NewDesc(
+		"spurredis_mmdb_records",
+		"Networks held in the in-memory IPv6 MMDB.",
+		[]string{"feed_type"}, nil,
+	)
+)
+
+// feedCollector - reads the feed info and MMDB size of every feed whenever the metrics are scraped
+type feedCollector struct {
+	feeds []storage.FeedStore
+}
+
+// RegisterFeeds - export the feed info timestamps and MMDB record counts of the feeds, call it once with every feed
+func RegisterFeeds(feeds []storage.FeedStore) error {
+	return Registry.Register(&feedCollector{feeds: feeds})
+}
+
+func (c *feedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- feedGeneratedDesc
+	ch <- realtimeFeedDesc
+	ch <- mmdbRecordsDesc
+}
+
+func (c *feedCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, feed := range c.feeds {
+		feedType := string(feed.FeedType)
+
+		// Nothing is reported until a feed has been loaded
+		feedInfo, err := feed.V4.GetLatestFeedInfo(ctx)
+		if err == nil && !feedInfo.JSON.GeneratedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(feedGeneratedDesc, prometheus.GaugeValue, float64(feedInfo.JSON.GeneratedAt.Unix()), feedType)
+		}
+
+		realtimeInfo, err := feed.V4.GetLatestRealtimeFeedInfo(ctx)
+		if err == nil && !realtimeInfo.JSON.Date.IsZero() {
+			ch <- prometheus.MustNewConstMetric(realtimeFeedDesc, prometheus.GaugeValue, float64(realtimeInfo.JSON.Date.Unix()), feedType)
+		}
+
+		if mmdb, ok := feed.V6.(*storage.MMDB); ok {
+			ch <- prometheus.MustNewConstMetric(mmdbRecordsDesc, prometheus.GaugeValue, float64(mmdb.Count()), feedType)
+		}
+	}
+}
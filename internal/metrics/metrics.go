@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry - every metric exported on /metrics, along with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// RequestDuration - API request latencies by route, method and status, its _count is the number of requests
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spurredis_http_request_duration_seconds",
+		Help:    "Latency of API requests by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// Lookups - IP lookups by IP version and whether any feed had the IP
+	Lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spurredis_lookups_total",
+		Help: "IP lookups by IP version (4 or 6) and result (hit or miss).",
+	}, []string{"ip_version", "result"})
+
+	// RedisCommandDuration - Redis command latencies by command, pipelines are observed once as "pipeline"
+	RedisCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spurredis_redis_command_duration_seconds",
+		Help:    "Latency of Redis commands by command, pipelines are observed as a whole.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"command"})
+
+	// RedisCommandErrors - Redis commands that failed by command, a missing key isn't a failure
+	RedisCommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spurredis_redis_command_errors_total",
+		Help: "Redis commands that failed by command.",
+	}, []string{"command"})
+
+	// IngestRecords - records loaded by feed type and kind of load, feed or merge
+	IngestRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spurredis_ingest_records_total",
+		Help: "Records loaded by successful loads, by feed type and kind of load (feed or merge).",
+	}, []string{"feed_type", "kind"})
+
+	// IngestRejected - feed lines that couldn't be loaded by feed type and kind of load
+	IngestRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spurredis_ingest_rejected_lines_total",
+		Help: "Feed lines that couldn't be loaded, by feed type and kind of load (feed or merge).",
+	}, []string{"feed_type", "kind"})
+
+	// IngestErrors - loads that failed by feed type and kind of load
+	IngestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spurredis_ingest_errors_total",
+		Help: "Loads that failed, by feed type and kind of load (feed or merge).",
+	}, []string{"feed_type", "kind"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestDuration,
+		Lookups,
+		RedisCommandDuration,
+		RedisCommandErrors,
+		IngestRecords,
+		IngestRejected,
+		IngestErrors,
+	)
+}
+
+// Handler - serves every registered metric in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveLookup - count a lookup of an IPv4 or IPv6 address and whether it was found
+func ObserveLookup(v6 bool, found bool) {
+	version := "4"
+	if v6 {
+		version = "6"
+	}
+	result := "miss"
+	if found {
+		result = "hit"
+	}
+	Lookups.WithLabelValues(version, result).Inc()
+}
+
+// ObserveIngest - count a finished load of a feed type, records are only counted when the load succeeded
+func ObserveIngest(feedType, kind string, records, rejected int64, err error) {
+	if err != nil {
+		IngestErrors.WithLabelValues(feedType, kind).Inc()
+	} else {
+		IngestRecords.WithLabelValues(feedType, kind).Add(float64(records))
+	}
+	if rejected > 0 {
+		IngestRejected.WithLabelValues(feedType, kind).Add(float64(rejected))
+	}
+}
+
+// ObserveRequest - record the latency of an API request
+func ObserveRequest(route, method string, status int, elapsed time.Duration) {
+	RequestDuration.WithLabelValues(route, method, strconv.Itoa(status)).Observe(elapsed.Seconds())
+}
+
+// redisStartKey - the context key holding when a Redis command or pipeline started
+type redisStartKey struct{}
+
+// redisHook - a go-redis hook timing every command and pipeline
+type redisHook struct{}
+
+// RedisHook - a hook for a go-redis client that records its command latencies and errors
+func RedisHook() redis.Hook {
+	return redisHook{}
+}
+
+func (redisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedis(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (redisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmdErr := cmd.Err(); cmdErr != nil && !errors.Is(cmdErr, redis.Nil) {
+			err = cmdErr
+			break
+		}
+	}
+	observeRedis(ctx, "pipeline", err)
+	return nil
+}
+
+// observeRedis - record the latency of a command or pipeline started by the hook
+func observeRedis(ctx context.Context, command string, err error) {
+	start, ok := ctx.Value(redisStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	RedisCommandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, redis.Nil) {
+		RedisCommandErrors.WithLabelValues(command).Inc()
+	}
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisHook(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	client.AddHook(RedisHook())
+
+	require.NoError(t, client.Set(ctx, "key", "value", 0).Err())
+	assert.ErrorIs(t, client.Get(ctx, "missing").Err(), redis.Nil)
+	assert.Error(t, client.Do(ctx, "bogus").Err())
+
+	pipe := client.Pipeline()
+	pipe.Get(ctx, "key")
+	pipe.Get(ctx, "missing")
+	_, err := pipe.Exec(ctx)
+	assert.ErrorIs(t, err, redis.Nil)
+
+	// set, get, bogus and pipeline
+	assert.Equal(t, 4, testutil.CollectAndCount(RedisCommandDuration))
+	assert.Equal(t, float64(0), testutil.ToFloat64(RedisCommandErrors.WithLabelValues("get")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(RedisCommandErrors.WithLabelValues("bogus")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(RedisCommandErrors.WithLabelValues("pipeline")))
+}
+
+func TestObserveIngest(t *testing.T) {
+	ObserveIngest("anonymous", "feed", 10, 2, nil)
+	ObserveIngest("anonymous", "feed", 5, 1, assert.AnError)
+
+	assert.Equal(t, float64(10), testutil.ToFloat64(IngestRecords.WithLabelValues("anonymous", "feed")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(IngestRejected.WithLabelValues("anonymous", "feed")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(IngestErrors.WithLabelValues("anonymous", "feed")))
+}
@@ -1,33 +1,46 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"feedexampleredis/internal/app"
+	"feedexampleredis/internal/metrics"
+	"feedexampleredis/internal/spur"
 	"feedexampleredis/internal/storage"
 	"fmt"
 	"github.com/gorilla/mux"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Server represents the API server.
 type Server struct {
-	cfg app.Config
-	r   *storage.Redis
-	v6  *storage.MMDB
+	cfg   app.Config
+	feeds []storage.FeedStore
 }
 
-// NewServer creates a new Server instance.
-func NewServer(cfg app.Config, r *storage.Redis, v6 *storage.MMDB) *Server {
+// NewServer creates a new Server instance, lookups are served from every feed's stores.
+func NewServer(cfg app.Config, feeds []storage.FeedStore) *Server {
 	return &Server{
-		cfg: cfg,
-		r:   r,
-		v6:  v6,
+		cfg:   cfg,
+		feeds: feeds,
 	}
 }
 
+// contextResponse is an IP context along with the feeds it was found in.
+type contextResponse struct {
+	*spur.IPContext
+	Feeds []spur.FeedType `json:"feeds"`
+}
+
 // authenticateMiddleware checks for the presence and validity of a TOKEN header.
 func (s *Server) authenticateMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,6 +55,41 @@ func (s *Server) authenticateMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// statusRecorder records the status a handler writes, flushes are passed through for streamed responses.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// metricsMiddleware records the latency and status of every request, requests that match no route are recorded as
+// unmatched.
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		metrics.ObserveRequest(route, r.Method, recorder.status, time.Since(start))
+	})
+}
+
 // handleContext is the handler for the /v2/context/{ipAddress} endpoint.
 func (s *Server) handleContext(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -61,72 +109,767 @@ func (s *Server) handleContext(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var response []byte
-	if parsedIP.To4() != nil {
-		// Query redis for the IP context
-		ipContext, err := s.r.GetByIP(r.Context(), ipAddress)
+	fields, err := parseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Look the IP up in every feed, merging the results where it appears in more than one
+	ipContext, err := s.lookup(r.Context(), ipAddress, parsedIP.To4() == nil, fields)
+	metrics.ObserveLookup(parsedIP.To4() == nil, err == nil)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	// Return the IP context as JSON
+	response, err := marshalFields(ipContext, fields)
+	if err != nil {
+		slog.Error("error marshalling IP context", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// set the content type
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// parseFields parses the comma separated fields query parameter, nil when every field is wanted.
+func parseFields(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(spur.IPContextFields, field) {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// marshalFields marshals a lookup result with only the given fields, along with the ip, network and feeds it was found
+// in. Every field is kept when fields is nil.
+func marshalFields(ipContext *contextResponse, fields []string) ([]byte, error) {
+	data, err := json.Marshal(ipContext)
+	if err != nil || fields == nil {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields)+3)
+	for _, field := range append([]string{"ip", "network", "feeds"}, fields...) {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return json.Marshal(selected)
+}
+
+// lookup finds an IP in every feed, IPv4 and IPv6 data are held in separate stores. Only the given fields are read from
+// stores that can look up a subset of them, all of them when fields is nil. Returns storage.ErrorIPNotFound if no feed
+// has it.
+func (s *Server) lookup(ctx context.Context, ipAddress string, v6 bool, fields []string) (*contextResponse, error) {
+	merged := &contextResponse{IPContext: &spur.IPContext{}}
+	for _, feed := range s.feeds {
+		store := feed.V4
+		if v6 {
+			store = feed.V6
+		}
+		if store == nil {
+			continue
+		}
+
+		var ipContext *spur.IPContext
+		var err error
+		if getter, ok := store.(storage.FieldGetter); ok && fields != nil {
+			ipContext, err = getter.GetFieldsByIP(ctx, ipAddress, fields)
+		} else {
+			ipContext, err = store.GetByIP(ctx, ipAddress)
+		}
+		if err == storage.ErrorIPNotFound {
+			continue
+		}
 		if err != nil {
-			http.Error(w, "Not Found", http.StatusNotFound)
-			return
+			slog.Error("error looking up IP", "feed_type", feed.FeedType, "error", err.Error())
+			continue
 		}
 
-		// If there is no ip in the context, return a 404
-		if ipContext == nil {
-			http.Error(w, "Not Found", http.StatusNotFound)
+		merged.add(feed.FeedType, ipContext)
+	}
+
+	if len(merged.Feeds) == 0 {
+		return nil, storage.ErrorIPNotFound
+	}
+
+	return merged, nil
+}
+
+// add merges a feed's record into a lookup result, skipping records with no ip or network.
+func (c *contextResponse) add(feedType spur.FeedType, ipContext *spur.IPContext) {
+	if ipContext == nil || (ipContext.IP == "" && ipContext.Network == "") {
+		return
+	}
+
+	c.Merge(ipContext)
+	if c.Network == "" {
+		c.Network = ipContext.Network
+	}
+	c.Feeds = append(c.Feeds, feedType)
+}
+
+// Statuses of the IPs in a batch lookup
+const (
+	batchFound    = "found"
+	batchNotFound = "not_found"
+	batchInvalid  = "invalid"
+)
+
+// Batch request bodies are read up to batchIPBytes for each IP, plus batchBodyOverhead for the rest of a JSON body. An
+// IPv6 address with its quotes, comma and some whitespace fits well within it.
+const (
+	batchIPBytes      = 64
+	batchBodyOverhead = 1024
+)
+
+// batchRequest is the body of a JSON /v2/context/batch request.
+type batchRequest struct {
+	IPs []string `json:"ips"`
+}
+
+// batchResult is the lookup result for one IP in a batch, Context is only set when it was found.
+type batchResult struct {
+	IP      string          `json:"ip"`
+	Status  string          `json:"status"`
+	Context json.RawMessage `json:"context,omitempty"`
+}
+
+// batchStreamError is the last line of an NDJSON /v2/context/batch response that failed after results were sent, the
+// IPs after the last result weren't looked up.
+type batchStreamError struct {
+	Error string `json:"error"`
+}
+
+// batchResponse is the response to a JSON /v2/context/batch request, results are in the order the IPs were given.
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// handleContextBatch is the handler for the /v2/context/batch endpoint. A JSON body of up to BatchLimit IPs gets a JSON
+// response, an NDJSON body with an IP per line gets an NDJSON response streamed back BatchLimit IPs at a time.
+func (s *Server) handleContextBatch(w http.ResponseWriter, r *http.Request) {
+	fields, err := parseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" {
+		s.streamContextBatch(w, r, fields)
+		return
+	}
+
+	var request batchRequest
+	body := http.MaxBytesReader(w, r.Body, int64(s.cfg.BatchLimit)*batchIPBytes+batchBodyOverhead)
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body too large, at most %d ips are allowed", s.cfg.BatchLimit), http.StatusRequestEntityTooLarge)
 			return
 		}
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if len(request.IPs) == 0 || len(request.IPs) > s.cfg.BatchLimit {
+		http.Error(w, fmt.Sprintf("between 1 and %d ips are required", s.cfg.BatchLimit), http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("received batch request", "ips", len(request.IPs))
 
-		if ipContext.IP == "" {
-			http.Error(w, "Not Found", http.StatusNotFound)
+	results, err := s.lookupBatch(r.Context(), request.IPs, fields)
+	if err != nil {
+		slog.Error("error looking up batch", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(batchResponse{Results: results})
+	if err != nil {
+		slog.Error("error marshalling batch", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// streamContextBatch reads an IP per line and writes a result per line, looking IPs up BatchLimit at a time and flushing
+// each chunk of results as it is written. Lines longer than batchIPBytes are rejected, so at most a chunk of IPs is held
+// in memory however long the stream is. Errors after the first chunk end the stream with an error line.
+func (s *Server) streamContextBatch(w http.ResponseWriter, r *http.Request, fields []string) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, batchIPBytes), batchIPBytes)
+	ips := make([]string, 0, s.cfg.BatchLimit)
+	total := 0
+	written := false
+
+	// Once results have been sent the status can't change, so a failure after that is reported on a final line
+	fail := func(status int, message string) {
+		if !written {
+			http.Error(w, message, status)
 			return
 		}
+		encoder.Encode(batchStreamError{Error: message})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
 
-		// Return the IP context as JSON
-		response, err = json.Marshal(ipContext)
+	flush := func() error {
+		results, err := s.lookupBatch(r.Context(), ips, fields)
 		if err != nil {
-			slog.Error("error marshalling IP context", "error", err.Error())
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return err
+		}
+		written = true
+		for _, result := range results {
+			if err := encoder.Encode(result); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		total += len(ips)
+		ips = ips[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		ip := strings.TrimSpace(scanner.Text())
+		if ip == "" {
+			continue
+		}
+		ips = append(ips, ip)
+		if len(ips) < s.cfg.BatchLimit {
+			continue
+		}
+		if err := flush(); err != nil {
+			slog.Error("error streaming batch", "ips", total, "error", err.Error())
+			fail(http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
-	} else {
-		// Query the MMDB for the IP context
-		ipContext, err := s.v6.GetIP(parsedIP)
-		if err != nil {
-			http.Error(w, "Not Found", http.StatusNotFound)
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("error reading batch", "ips", total, "error", err.Error())
+		if errors.Is(err, bufio.ErrTooLong) {
+			fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("lines must be at most %d bytes", batchIPBytes))
+			return
+		}
+		fail(http.StatusBadRequest, "Bad Request")
+		return
+	}
+	if len(ips) > 0 {
+		if err := flush(); err != nil {
+			slog.Error("error streaming batch", "ips", total, "error", err.Error())
+			fail(http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
+	}
+
+	slog.Info("streamed batch", "ips", total)
+}
+
+// lookupBatch looks up many IPs in every feed, merging the results for each IP like lookup. Each store is asked for all
+// of its IPs at once, with a single round trip for stores that are BatchGetters. A store that fails fails the batch
+// rather than reporting its IPs as not found. Results are in the order of ips.
+func (s *Server) lookupBatch(ctx context.Context, ips []string, fields []string) ([]batchResult, error) {
+	results := make([]batchResult, len(ips))
+	merged := make([]*contextResponse, len(ips))
+
+	// Split the valid IPs between the IPv4 and IPv6 stores, remembering where each one came from
+	var v4, v6 []string
+	var v4Index, v6Index []int
+	for i, ip := range ips {
+		results[i] = batchResult{IP: ip, Status: batchInvalid}
+		parsedIP := net.ParseIP(ip)
+		if parsedIP == nil {
+			continue
+		}
+
+		merged[i] = &contextResponse{IPContext: &spur.IPContext{}}
+		if parsedIP.To4() == nil {
+			v6 = append(v6, ip)
+			v6Index = append(v6Index, i)
+		} else {
+			v4 = append(v4, ip)
+			v4Index = append(v4Index, i)
+		}
+	}
+
+	for _, feed := range s.feeds {
+		for _, group := range []struct {
+			store   storage.Store
+			ips     []string
+			indexes []int
+		}{{feed.V4, v4, v4Index}, {feed.V6, v6, v6Index}} {
+			if group.store == nil || len(group.ips) == 0 {
+				continue
+			}
+
+			records, err := getByIPs(ctx, group.store, group.ips)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up %s: %w", feed.FeedType, err)
+			}
+			for i, record := range records {
+				merged[group.indexes[i]].add(feed.FeedType, record)
+			}
+		}
+	}
 
-		// If there is no ip in the context, return a 404
+	for i, ipContext := range merged {
 		if ipContext == nil {
-			http.Error(w, "Not Found", http.StatusNotFound)
-			return
+			continue
+		}
+		metrics.ObserveLookup(net.ParseIP(ips[i]).To4() == nil, len(ipContext.Feeds) > 0)
+		if len(ipContext.Feeds) == 0 {
+			results[i].Status = batchNotFound
+			continue
 		}
 
-		if ipContext.Network == "" {
-			http.Error(w, "Not Found", http.StatusNotFound)
-			return
+		data, err := marshalFields(ipContext, fields)
+		if err != nil {
+			return nil, err
+		}
+		results[i].Status = batchFound
+		results[i].Context = data
+	}
+
+	return results, nil
+}
+
+// getByIPs looks up many IPs in a store, in one go if it is a BatchGetter or one at a time otherwise. The result at each
+// index is nil if that IP isn't in the store.
+func getByIPs(ctx context.Context, store storage.Store, ips []string) ([]*spur.IPContext, error) {
+	if getter, ok := store.(storage.BatchGetter); ok {
+		return getter.GetByIPs(ctx, ips)
+	}
+
+	records := make([]*spur.IPContext, len(ips))
+	for i, ip := range ips {
+		record, err := store.GetByIP(ctx, ip)
+		if err == storage.ErrorIPNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records[i] = record
+	}
+	return records, nil
+}
+
+// realtimeGapsResponse is the realtime slots that haven't been merged into a feed yet.
+type realtimeGapsResponse struct {
+	FeedType spur.FeedType `json:"feed_type"`
+	FeedDate string        `json:"feed_date"`
+	Gaps     []time.Time   `json:"gaps"`
+}
+
+// handleRealtimeGaps is the handler for the /v2/realtime/gaps endpoint, it lists the missing realtime slots for every
+// feed with realtime updates.
+func (s *Server) handleRealtimeGaps(w http.ResponseWriter, r *http.Request) {
+	gaps := make([]realtimeGapsResponse, 0)
+	for _, feed := range s.feeds {
+		if !s.cfg.SpurRealtimeEnabled || !feed.FeedType.HasRealtime() {
+			continue
+		}
+
+		// Nothing to report until a full feed has been loaded
+		feedInfo, err := feed.V4.GetLatestFeedInfo(r.Context())
+		if err != nil || feedInfo.JSON.Date == "" {
+			continue
 		}
 
-		// Return the IP context as JSON
-		response, err = json.Marshal(ipContext)
+		slots, err := storage.RealtimeGaps(r.Context(), feed.V4, feedInfo.JSON.Date, time.Now().UTC())
 		if err != nil {
-			slog.Error("error marshalling IP context", "error", err.Error())
+			slog.Error("error finding realtime gaps", "feed_type", feed.FeedType, "error", err.Error())
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+
+		gaps = append(gaps, realtimeGapsResponse{FeedType: feed.FeedType, FeedDate: feedInfo.JSON.Date, Gaps: slots})
+	}
+
+	response, err := json.Marshal(gaps)
+	if err != nil {
+		slog.Error("error marshalling realtime gaps", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	// set the content type
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// ingestProgressResponse is the progress of the load running in one of a feed's stores, or the last one to finish.
+type ingestProgressResponse struct {
+	FeedType spur.FeedType `json:"feed_type"`
+	Store    string        `json:"store"`
+	storage.IngestStatus
+}
+
+// handleIngestProgress is the handler for the /v2/ingest/progress endpoint, it lists the progress of the loads running
+// in every feed's stores, or the last ones to finish.
+func (s *Server) handleIngestProgress(w http.ResponseWriter, r *http.Request) {
+	progress := make([]ingestProgressResponse, 0)
+	for _, feed := range s.feeds {
+		for i, store := range []storage.Store{feed.V4, feed.V6} {
+			reporter, ok := store.(storage.ProgressReporter)
+			if !ok {
+				continue
+			}
+
+			status, ok := reporter.IngestStatus()
+			if !ok {
+				continue
+			}
+
+			name := "ipv4"
+			if i == 1 {
+				name = "ipv6"
+			}
+			progress = append(progress, ingestProgressResponse{FeedType: feed.FeedType, Store: name, IngestStatus: status})
+		}
+	}
+
+	response, err := json.Marshal(progress)
+	if err != nil {
+		slog.Error("error marshalling ingest progress", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(response)
 }
 
-// Start starts the API server.
-func (s *Server) Start(ctx context.Context) error {
+// Page sizes for the /v2/ips and /v2/networks endpoints
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// maxSummaryRecords - the most records a /v2/networks summary reads, the summary of a network with more is truncated
+const maxSummaryRecords = 1000000
+
+// ipsResponse is a page of the IPs matching an attribute query, Cursor fetches the next page and is empty on the last.
+type ipsResponse struct {
+	FeedType spur.FeedType `json:"feed_type"`
+	IPs      []string      `json:"ips"`
+	Cursor   string        `json:"cursor"`
+}
+
+// handleIPs is the handler for the /v2/ips endpoint, it pages through the IPv4 addresses in a feed whose indexed
+// attributes match every attribute given in the query.
+func (s *Server) handleIPs(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	query := make(map[string]string)
+	for _, attribute := range storage.IndexAttributes {
+		if value := values.Get(attribute); value != "" {
+			query[attribute] = value
+		}
+	}
+	if len(query) == 0 {
+		http.Error(w, fmt.Sprintf("at least one of %s is required", strings.Join(storage.IndexAttributes, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseLimit(values.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feed, ok := s.feed(values.Get("feed"))
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	indexer, ok := feed.V4.(storage.Indexer)
+	if !ok {
+		http.Error(w, "this backend has no secondary indexes", http.StatusNotImplemented)
+		return
+	}
+
+	ips, cursor, err := indexer.FindIPs(r.Context(), query, values.Get("cursor"), int64(limit))
+	if errors.Is(err, storage.ErrorNotIndexed) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if errors.Is(err, storage.ErrorInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, storage.ErrorStaleCursor) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("error finding IPs", "feed_type", feed.FeedType, "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if ips == nil {
+		ips = []string{}
+	}
+	response, err := json.Marshal(ipsResponse{FeedType: feed.FeedType, IPs: ips, Cursor: cursor})
+	if err != nil {
+		slog.Error("error marshalling IPs", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// parseLimit parses the page size query parameter, defaultPageLimit when it is empty.
+func parseLimit(value string) (int, error) {
+	if value == "" {
+		return defaultPageLimit, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > maxPageLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+	}
+	return n, nil
+}
+
+// networksResponse is a page of the records intersecting a network, Cursor fetches the next page and is empty on the
+// last.
+type networksResponse struct {
+	FeedType spur.FeedType     `json:"feed_type"`
+	Network  string            `json:"network"`
+	Records  []*spur.IPContext `json:"records"`
+	Cursor   string            `json:"cursor"`
+}
+
+// networkSummaryResponse is the number of records intersecting a network, along with how many of them have each risk,
+// tunnel operator and infrastructure. Truncated is set when the network had more records than a summary reads.
+type networkSummaryResponse struct {
+	FeedType       spur.FeedType  `json:"feed_type"`
+	Network        string         `json:"network"`
+	Count          int            `json:"count"`
+	Risks          map[string]int `json:"risks"`
+	Operators      map[string]int `json:"operators"`
+	Infrastructure map[string]int `json:"infrastructure"`
+	Truncated      bool           `json:"truncated"`
+}
+
+// add counts a record in the summary.
+func (n *networkSummaryResponse) add(record *spur.IPContext) {
+	n.Count++
+	for _, risk := range record.Risks {
+		n.Risks[risk]++
+	}
+
+	operators := make(map[string]bool)
+	for _, tunnel := range record.Tunnels {
+		if tunnel.Operator != "" && !operators[tunnel.Operator] {
+			operators[tunnel.Operator] = true
+			n.Operators[tunnel.Operator]++
+		}
+	}
+
+	if record.Infrastructure != "" {
+		n.Infrastructure[record.Infrastructure]++
+	}
+}
+
+// summarize counts every record found a page at a time, only holding one page at once. It stops once limit records have
+// been counted and marks the summary truncated if there were more.
+func (n *networkSummaryResponse) summarize(find func(cursor string, count int) ([]*spur.IPContext, string, error), limit int) error {
+	cursor := ""
+	for {
+		records, next, err := find(cursor, min(limit-n.Count, maxPageLimit))
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			n.add(record)
+		}
+		cursor = next
+		if cursor == "" {
+			return nil
+		}
+		if n.Count >= limit {
+			n.Truncated = true
+			return nil
+		}
+	}
+}
+
+// handleNetworks is the handler for the /v2/networks/{cidr} endpoint, it pages through a feed's IPv4 records or IPv6
+// networks intersecting the network, or summarizes them when summary is set.
+func (s *Server) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	_, network, err := net.ParseCIDR(mux.Vars(r)["cidr"])
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseLimit(values.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summary := false
+	if value := values.Get("summary"); value != "" {
+		if summary, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "summary must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	feed, ok := s.feed(values.Get("feed"))
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	store := feed.V4
+	if network.IP.To4() == nil {
+		store = feed.V6
+	}
+
+	// A feed without IPv6 data has nothing in any IPv6 network
+	var finder storage.NetworkFinder
+	if store != nil {
+		if finder, ok = store.(storage.NetworkFinder); !ok {
+			http.Error(w, "this backend can't search networks", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	find := func(cursor string, count int) ([]*spur.IPContext, string, error) {
+		if finder == nil {
+			return nil, "", nil
+		}
+		return finder.FindNetwork(r.Context(), network, cursor, int64(count))
+	}
+
+	var response interface{}
+	if summary {
+		counts := &networkSummaryResponse{FeedType: feed.FeedType, Network: network.String(), Risks: map[string]int{}, Operators: map[string]int{}, Infrastructure: map[string]int{}}
+		err = counts.summarize(find, maxSummaryRecords)
+		response = counts
+	} else {
+		var records []*spur.IPContext
+		var cursor string
+		records, cursor, err = find(values.Get("cursor"), limit)
+		if records == nil {
+			records = []*spur.IPContext{}
+		}
+		response = networksResponse{FeedType: feed.FeedType, Network: network.String(), Records: records, Cursor: cursor}
+	}
+	if errors.Is(err, storage.ErrorNotIndexed) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if errors.Is(err, storage.ErrorInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, storage.ErrorStaleCursor) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("error finding network", "feed_type", feed.FeedType, "network", network.String(), "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("error marshalling network", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// feed finds a feed's stores by name, the first feed when name is empty.
+func (s *Server) feed(name string) (storage.FeedStore, bool) {
+	if name == "" && len(s.feeds) > 0 {
+		return s.feeds[0], true
+	}
+	for _, feed := range s.feeds {
+		if string(feed.FeedType) == name {
+			return feed, true
+		}
+	}
+	return storage.FeedStore{}, false
+}
+
+// router builds the routes served by the API server.
+func (s *Server) router() *mux.Router {
 	r := mux.NewRouter()
+	r.Handle("/v2/context/batch", s.authenticateMiddleware(http.HandlerFunc(s.handleContextBatch))).Methods("POST")
 	r.Handle("/v2/context/{ipAddress}", s.authenticateMiddleware(http.HandlerFunc(s.handleContext))).Methods("GET")
+	r.Handle("/v2/realtime/gaps", s.authenticateMiddleware(http.HandlerFunc(s.handleRealtimeGaps))).Methods("GET")
+	r.Handle("/v2/ingest/progress", s.authenticateMiddleware(http.HandlerFunc(s.handleIngestProgress))).Methods("GET")
+	r.Handle("/v2/ips", s.authenticateMiddleware(http.HandlerFunc(s.handleIPs))).Methods("GET")
+	r.Handle("/v2/networks/{cidr:.+}", s.authenticateMiddleware(http.HandlerFunc(s.handleNetworks))).Methods("GET")
+	r.Handle("/v2/status", s.authenticateMiddleware(http.HandlerFunc(s.handleStatus))).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", s.handleHealth).Methods("GET")
+	r.HandleFunc("/readyz", s.handleReady).Methods("GET")
+	r.Use(s.metricsMiddleware)
+
+	// Middleware only runs for matched routes, so the fallthrough handlers record their own requests
+	r.NotFoundHandler = s.metricsMiddleware(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = s.metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}))
+	return r
+}
+
+// Start starts the API server.
+func (s *Server) Start(ctx context.Context) error {
+	r := s.router()
 	address := fmt.Sprintf(":%d", s.cfg.Port)
 	srv := &http.Server{
 		Addr:    address,
@@ -146,8 +889,7 @@ func (s *Server) Start(ctx context.Context) error {
 
 // StartTLS starts the API server with TLS (HTTPS).
 func (s *Server) StartTLS(ctx context.Context) error {
-	r := mux.NewRouter()
-	r.Handle("/v2/context/{ipAddress}", s.authenticateMiddleware(http.HandlerFunc(s.handleContext))).Methods("GET")
+	r := s.router()
 	address := fmt.Sprintf(":%d", s.cfg.Port)
 	srv := &http.Server{
 		Addr:    address,
@@ -165,3 +907,24 @@ func (s *Server) StartTLS(ctx context.Context) error {
 	<-ctx.Done()
 	return ctx.Err()
 }
+
+// StartMetrics serves only the /metrics endpoint on its own port, for daemons running without the API server.
+func StartMetrics(ctx context.Context, port int) error {
+	r := mux.NewRouter()
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	address := fmt.Sprintf(":%d", port)
+	srv := &http.Server{
+		Addr:    address,
+		Handler: r,
+	}
+	go func() {
+		slog.Info("Starting metrics server", "address", address)
+		if err := srv.ListenAndServe(); err != nil {
+			slog.Error("error starting metrics server", "error", err.Error())
+		}
+	}()
+
+	<-ctx.Done()
+
+	return ctx.Err()
+}
@@ -0,0 +1,596 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"feedexampleredis/internal/app"
+	"feedexampleredis/internal/metrics"
+	"feedexampleredis/internal/spur"
+	"feedexampleredis/internal/storage"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore - an in memory storage.Store for testing the API without a backend
+type fakeStore struct {
+	records     map[string]*spur.IPContext
+	feedInfo    *spur.FeedInfo
+	checkpoints []time.Time
+	ingest      storage.IngestStatus
+}
+
+func (f *fakeStore) GetByIP(ctx context.Context, ip string) (*spur.IPContext, error) {
+	record, ok := f.records[ip]
+	if !ok {
+		return nil, storage.ErrorIPNotFound
+	}
+	return record, nil
+}
+
+func (f *fakeStore) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
+	return 0, storage.ErrorNotSupported
+}
+
+func (f *fakeStore) StreamingMergeInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
+	return 0, storage.ErrorNotSupported
+}
+
+func (f *fakeStore) GetLatestFeedInfo(ctx context.Context) (*spur.FeedInfo, error) {
+	if f.feedInfo == nil {
+		return &spur.FeedInfo{}, nil
+	}
+	return f.feedInfo, nil
+}
+
+func (f *fakeStore) PutLatestFeedInfo(ctx context.Context, fi *spur.FeedInfo) error {
+	return nil
+}
+
+func (f *fakeStore) GetLatestRealtimeFeedInfo(ctx context.Context) (*spur.RealtimeFeedInfo, error) {
+	return &spur.RealtimeFeedInfo{}, nil
+}
+
+func (f *fakeStore) PutLatestRealtimeFeedInfo(ctx context.Context, fi *spur.RealtimeFeedInfo) error {
+	return nil
+}
+
+func (f *fakeStore) PutRealtimeCheckpoint(ctx context.Context, feedDate string, slot time.Time) error {
+	f.checkpoints = append(f.checkpoints, slot)
+	return nil
+}
+
+func (f *fakeStore) IngestStatus() (storage.IngestStatus, bool) {
+	return f.ingest, f.ingest.Kind != ""
+}
+
+func (f *fakeStore) GetRealtimeCheckpoints(ctx context.Context, feedDate string) ([]time.Time, error) {
+	return f.checkpoints, nil
+}
+
+// fakeIndexer - a fakeStore that finds IPs by their risks or network, a page at a time
+type fakeIndexer struct {
+	fakeStore
+}
+
+func (f *fakeIndexer) FindNetwork(ctx context.Context, network *net.IPNet, cursor string, count int64) ([]*spur.IPContext, string, error) {
+	var ips []string
+	for ip := range f.records {
+		if network.Contains(net.ParseIP(ip)) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+
+	start := 0
+	if cursor == "stale" {
+		return nil, "", storage.ErrorStaleCursor
+	}
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil || start > len(ips) {
+			return nil, "", storage.ErrorInvalidCursor
+		}
+	}
+	end := min(start+int(count), len(ips))
+	var records []*spur.IPContext
+	for _, ip := range ips[start:end] {
+		records = append(records, f.records[ip])
+	}
+	if end == len(ips) {
+		return records, "", nil
+	}
+	return records, strconv.Itoa(end), nil
+}
+
+func (f *fakeIndexer) FindIPs(ctx context.Context, query map[string]string, cursor string, count int64) ([]string, string, error) {
+	if cursor == "stale" {
+		return nil, "", storage.ErrorStaleCursor
+	}
+
+	var ips []string
+	for ip, record := range f.records {
+		for _, risk := range record.Risks {
+			if risk == query[storage.IndexRisk] {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	sort.Strings(ips)
+
+	start, _ := strconv.Atoi(cursor)
+	end := min(start+int(count), len(ips))
+	if end == len(ips) {
+		return ips[start:end], "", nil
+	}
+	return ips[start:end], strconv.Itoa(end), nil
+}
+
+func newTestServer() *Server {
+	anonymous := storage.FeedStore{
+		FeedType: spur.AnonymousFeed,
+		V4: &fakeStore{records: map[string]*spur.IPContext{
+			"1.2.3.4": {IP: "1.2.3.4", Organization: "v4 org", Risks: []string{"TUNNEL"}},
+		}},
+		V6: &fakeStore{records: map[string]*spur.IPContext{
+			"2001:db8::1": {Network: "2001:db8::/64", Organization: "v6 org"},
+		}},
+	}
+	ipsummary := storage.FeedStore{
+		FeedType: spur.IPSummaryFeed,
+		V4: &fakeStore{records: map[string]*spur.IPContext{
+			"1.2.3.4": {IP: "1.2.3.4", Infrastructure: "DATACENTER", Risks: []string{"SPAM"}},
+			"5.6.7.8": {IP: "5.6.7.8", Organization: "summary org"},
+		}},
+	}
+	cfg := app.Config{LocalAPIAuthTokens: []string{"testtoken"}, BatchLimit: 4}
+	return NewServer(cfg, []storage.FeedStore{anonymous, ipsummary})
+}
+
+func TestHandleContext(t *testing.T) {
+	s := newTestServer()
+
+	tests := []struct {
+		name       string
+		ip         string
+		token      string
+		wantStatus int
+		wantOrg    string
+		wantFeeds  []spur.FeedType
+	}{
+		{name: "IPv4 found in both feeds", ip: "1.2.3.4", token: "testtoken", wantStatus: http.StatusOK, wantOrg: "v4 org", wantFeeds: []spur.FeedType{spur.AnonymousFeed, spur.IPSummaryFeed}},
+		{name: "IPv4 found in one feed", ip: "5.6.7.8", token: "testtoken", wantStatus: http.StatusOK, wantOrg: "summary org", wantFeeds: []spur.FeedType{spur.IPSummaryFeed}},
+		{name: "IPv6 found", ip: "2001:db8::1", token: "testtoken", wantStatus: http.StatusOK, wantOrg: "v6 org", wantFeeds: []spur.FeedType{spur.AnonymousFeed}},
+		{name: "IPv4 not found", ip: "4.3.2.1", token: "testtoken", wantStatus: http.StatusNotFound},
+		{name: "Invalid IP", ip: "not-an-ip", token: "testtoken", wantStatus: http.StatusBadRequest},
+		{name: "Bad token", ip: "1.2.3.4", token: "wrong", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/context/"+tt.ip, nil)
+			req.Header.Set("TOKEN", tt.token)
+			rec := httptest.NewRecorder()
+
+			s.router().ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				spur.IPContext
+				Feeds []spur.FeedType `json:"feeds"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantOrg, resp.Organization)
+			assert.Equal(t, tt.wantFeeds, resp.Feeds)
+		})
+	}
+}
+
+func TestHandleContextMergesFeeds(t *testing.T) {
+	s := newTestServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/context/1.2.3.4", nil)
+	req.Header.Set("TOKEN", "testtoken")
+	rec := httptest.NewRecorder()
+
+	s.router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var ipCtx spur.IPContext
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ipCtx))
+	assert.Equal(t, "1.2.3.4", ipCtx.IP)
+	assert.Equal(t, "DATACENTER", ipCtx.Infrastructure)
+	assert.Equal(t, []string{"TUNNEL", "SPAM"}, ipCtx.Risks)
+}
+
+func TestHandleRealtimeGaps(t *testing.T) {
+	feedDate := time.Now().UTC().AddDate(0, 0, -1)
+	fi := &spur.FeedInfo{}
+	fi.JSON.Date = feedDate.Format("20060102")
+	start, _ := time.Parse("20060102", fi.JSON.Date)
+
+	residential := &fakeStore{feedInfo: fi, checkpoints: []time.Time{start}}
+	feeds := []storage.FeedStore{
+		{FeedType: spur.AnonymousResidential, V4: residential},
+		{FeedType: spur.AnonymousFeed, V4: &fakeStore{feedInfo: fi}},
+	}
+	cfg := app.Config{LocalAPIAuthTokens: []string{"testtoken"}, SpurRealtimeEnabled: true}
+	s := NewServer(cfg, feeds)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/realtime/gaps", nil)
+	req.Header.Set("TOKEN", "testtoken")
+	rec := httptest.NewRecorder()
+
+	s.router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var gaps []realtimeGapsResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &gaps))
+
+	// Only the feed type with realtime data is reported, and the merged first slot isn't a gap
+	require.Len(t, gaps, 1)
+	assert.Equal(t, spur.AnonymousResidential, gaps[0].FeedType)
+	assert.Equal(t, fi.JSON.Date, gaps[0].FeedDate)
+	require.NotEmpty(t, gaps[0].Gaps)
+	assert.True(t, start.Add(spur.RealtimeInterval).Equal(gaps[0].Gaps[0]))
+}
+
+func TestHandleIngestProgress(t *testing.T) {
+	feeds := []storage.FeedStore{
+		{FeedType: spur.AnonymousFeed, V4: &fakeStore{ingest: storage.IngestStatus{Kind: storage.IngestKindFeed, Running: true, LinesRead: 10, RecordsWritten: 8}}, V6: &fakeStore{}},
+		{FeedType: spur.IPSummaryFeed, V4: &fakeStore{}},
+	}
+	cfg := app.Config{LocalAPIAuthTokens: []string{"testtoken"}}
+	s := NewServer(cfg, feeds)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/ingest/progress", nil)
+	req.Header.Set("TOKEN", "testtoken")
+	rec := httptest.NewRecorder()
+
+	s.router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var progress []ingestProgressResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &progress))
+
+	// Stores that haven't loaded anything yet are left out
+	require.Len(t, progress, 1)
+	assert.Equal(t, spur.AnonymousFeed, progress[0].FeedType)
+	assert.Equal(t, "ipv4", progress[0].Store)
+	assert.True(t, progress[0].Running)
+	assert.Equal(t, int64(10), progress[0].LinesRead)
+	assert.Equal(t, int64(8), progress[0].RecordsWritten)
+}
+
+func TestHandleContextFields(t *testing.T) {
+	s := newTestServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/context/1.2.3.4?fields=risks,infrastructure", nil)
+	req.Header.Set("TOKEN", "testtoken")
+	rec := httptest.NewRecorder()
+
+	s.router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"ip":"1.2.3.4","infrastructure":"DATACENTER","risks":["TUNNEL","SPAM"],"feeds":["anonymous","ipsummary"]}`, rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/context/1.2.3.4?fields=risks,password", nil)
+	req.Header.Set("TOKEN", "testtoken")
+	rec = httptest.NewRecorder()
+
+	s.router().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandleIPs(t *testing.T) {
+	indexed := &fakeIndexer{fakeStore{records: map[string]*spur.IPContext{
+		"1.1.1.1": {IP: "1.1.1.1", Risks: []string{"CALLBACK_PROXY"}},
+		"2.2.2.2": {IP: "2.2.2.2", Risks: []string{"CALLBACK_PROXY", "TUNNEL"}},
+		"3.3.3.3": {IP: "3.3.3.3", Risks: []string{"TUNNEL"}},
+	}}}
+	feeds := []storage.FeedStore{
+		{FeedType: spur.AnonymousFeed, V4: indexed},
+		{FeedType: spur.IPSummaryFeed, V4: &fakeStore{}},
+	}
+	s := NewServer(app.Config{LocalAPIAuthTokens: []string{"testtoken"}}, feeds)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("TOKEN", "testtoken")
+		rec := httptest.NewRecorder()
+		s.router().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/v2/ips?risk=CALLBACK_PROXY&limit=1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"feed_type":"anonymous","ips":["1.1.1.1"],"cursor":"1"}`, rec.Body.String())
+
+	rec = get("/v2/ips?feed=anonymous&risk=CALLBACK_PROXY&limit=1&cursor=1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"feed_type":"anonymous","ips":["2.2.2.2"],"cursor":""}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusConflict, get("/v2/ips?risk=CALLBACK_PROXY&cursor=stale").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/v2/ips").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/v2/ips?risk=TUNNEL&limit=0").Code)
+	assert.Equal(t, http.StatusNotFound, get("/v2/ips?feed=unknown&risk=TUNNEL").Code)
+	assert.Equal(t, http.StatusNotImplemented, get("/v2/ips?feed=ipsummary&risk=TUNNEL").Code)
+}
+
+func TestHandleContextBatch(t *testing.T) {
+	s := newTestServer()
+
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v2/context/batch?fields=organization", strings.NewReader(body))
+		req.Header.Set("TOKEN", "testtoken")
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		s.router().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("application/json", `{"ips":["1.2.3.4","2001:db8::1","4.3.2.1","not-an-ip"]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"results":[
+		{"ip":"1.2.3.4","status":"found","context":{"ip":"1.2.3.4","organization":"v4 org","feeds":["anonymous","ipsummary"]}},
+		{"ip":"2001:db8::1","status":"found","context":{"network":"2001:db8::/64","organization":"v6 org","feeds":["anonymous"]}},
+		{"ip":"4.3.2.1","status":"not_found"},
+		{"ip":"not-an-ip","status":"invalid"}
+	]}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, post("application/json", `{"ips":[]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post("application/json", `{"ips":["1.1.1.1","1.1.1.2","1.1.1.3","1.1.1.4","1.1.1.5"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post("application/json", `not json`).Code)
+
+	// NDJSON has no limit, the IPs are looked up BatchLimit at a time
+	rec = post("application/x-ndjson", "1.1.1.1\n1.1.1.2\n\n1.1.1.3\n1.1.1.4\n5.6.7.8\nbogus\n")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 6)
+	assert.JSONEq(t, `{"ip":"1.1.1.1","status":"not_found"}`, lines[0])
+	assert.JSONEq(t, `{"ip":"5.6.7.8","status":"found","context":{"ip":"5.6.7.8","organization":"summary org","feeds":["ipsummary"]}}`, lines[4])
+	assert.JSONEq(t, `{"ip":"bogus","status":"invalid"}`, lines[5])
+
+	// Bodies are bounded by BatchLimit before they are decoded
+	huge := `{"ips":["1.1.1.1"],"padding":"` + strings.Repeat("x", 2000) + `"}`
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("application/json", huge).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("application/x-ndjson", strings.Repeat("1", 100)+"\n").Code)
+}
+
+// failingStore - a fakeStore whose lookups start failing after a number of them have succeeded
+type failingStore struct {
+	fakeStore
+	remaining int
+}
+
+func (f *failingStore) GetByIP(ctx context.Context, ip string) (*spur.IPContext, error) {
+	if f.remaining == 0 {
+		return nil, errors.New("connection reset")
+	}
+	f.remaining--
+	return f.fakeStore.GetByIP(ctx, ip)
+}
+
+func TestHandleContextBatchStoreFailure(t *testing.T) {
+	post := func(s *Server, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v2/context/batch", strings.NewReader(body))
+		req.Header.Set("TOKEN", "testtoken")
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		s.router().ServeHTTP(rec, req)
+		return rec
+	}
+	newServer := func(remaining int) *Server {
+		store := &failingStore{fakeStore: fakeStore{records: map[string]*spur.IPContext{}}, remaining: remaining}
+		cfg := app.Config{LocalAPIAuthTokens: []string{"testtoken"}, BatchLimit: 4}
+		return NewServer(cfg, []storage.FeedStore{{FeedType: spur.AnonymousFeed, V4: store}})
+	}
+
+	// A failed lookup isn't reported as IPs that weren't found
+	assert.Equal(t, http.StatusInternalServerError, post(newServer(0), "application/json", `{"ips":["1.1.1.1"]}`).Code)
+	assert.Equal(t, http.StatusInternalServerError, post(newServer(0), "application/x-ndjson", "1.1.1.1\n").Code)
+
+	// Once the first chunk has been sent the stream ends with an error line instead
+	rec := post(newServer(4), "application/x-ndjson", "1.1.1.1\n1.1.1.2\n1.1.1.3\n1.1.1.4\n1.1.1.5\n1.1.1.6\n")
+	require.Equal(t, http.StatusOK, rec.Code)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.JSONEq(t, `{"ip":"1.1.1.4","status":"not_found"}`, lines[3])
+	assert.JSONEq(t, `{"error":"Internal Server Error"}`, lines[4])
+
+	// As does a line that is too long
+	rec = post(newServer(4), "application/x-ndjson", "1.1.1.1\n1.1.1.2\n1.1.1.3\n1.1.1.4\n"+strings.Repeat("1", 100)+"\n")
+	require.Equal(t, http.StatusOK, rec.Code)
+	lines = strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.JSONEq(t, `{"error":"lines must be at most 64 bytes"}`, lines[4])
+}
+
+func TestHandleNetworks(t *testing.T) {
+	indexed := &fakeIndexer{fakeStore{records: map[string]*spur.IPContext{
+		"203.0.113.1":  {IP: "203.0.113.1", Risks: []string{"TUNNEL"}, Tunnels: []spur.Tunnel{{Operator: "NORD_VPN"}, {Operator: "NORD_VPN"}}},
+		"203.0.113.2":  {IP: "203.0.113.2", Risks: []string{"TUNNEL", "SPAM"}, Infrastructure: "DATACENTER"},
+		"198.51.100.1": {IP: "198.51.100.1", Risks: []string{"SPAM"}},
+	}}}
+	feeds := []storage.FeedStore{
+		{FeedType: spur.AnonymousFeed, V4: indexed},
+		{FeedType: spur.IPSummaryFeed, V4: &fakeStore{}},
+	}
+	s := NewServer(app.Config{LocalAPIAuthTokens: []string{"testtoken"}, BatchLimit: 1}, feeds)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("TOKEN", "testtoken")
+		rec := httptest.NewRecorder()
+		s.router().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/v2/networks/203.0.113.0/24?limit=1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var page networksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, "203.0.113.1", page.Records[0].IP)
+	assert.Equal(t, "1", page.Cursor)
+
+	rec = get("/v2/networks/203.0.113.0/24?limit=1&cursor=1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, "203.0.113.2", page.Records[0].IP)
+	assert.Equal(t, "", page.Cursor)
+
+	// Summaries count the whole network
+	rec = get("/v2/networks/203.0.113.5/24?summary=true")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"feed_type":"anonymous","network":"203.0.113.0/24","count":2,"risks":{"TUNNEL":2,"SPAM":1},"operators":{"NORD_VPN":1},"infrastructure":{"DATACENTER":1},"truncated":false}`, rec.Body.String())
+
+	// and stop at the most records they read
+	counts := &networkSummaryResponse{Risks: map[string]int{}, Operators: map[string]int{}, Infrastructure: map[string]int{}}
+	_, network, _ := net.ParseCIDR("203.0.113.0/24")
+	find := func(cursor string, count int) ([]*spur.IPContext, string, error) {
+		return indexed.FindNetwork(context.Background(), network, cursor, int64(count))
+	}
+	require.NoError(t, counts.summarize(find, 1))
+	assert.Equal(t, 1, counts.Count)
+	assert.True(t, counts.Truncated)
+
+	// The feed has no IPv6 data
+	rec = get("/v2/networks/2001:db8::/32")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"feed_type":"anonymous","network":"2001:db8::/32","records":[],"cursor":""}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusConflict, get("/v2/networks/203.0.113.0/24?cursor=stale").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/v2/networks/203.0.113.0").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/v2/networks/203.0.113.0/24?summary=maybe").Code)
+	assert.Equal(t, http.StatusNotFound, get("/v2/networks/203.0.113.0/24?feed=unknown").Code)
+	assert.Equal(t, http.StatusNotImplemented, get("/v2/networks/203.0.113.0/24?feed=ipsummary").Code)
+}
+
+func TestHandleMetrics(t *testing.T) {
+	s := newTestServer()
+
+	for _, ip := range []string{"1.2.3.4", "4.3.2.1", "2001:db8::1"} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/context/"+ip, nil)
+		req.Header.Set("TOKEN", "testtoken")
+		s.router().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Requests that match no route are recorded too
+	s.router().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nope", nil))
+	s.router().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/healthz", nil))
+
+	// An IPv4-mapped IPv6 address is looked up, and counted, as IPv4
+	v4Lookups := testutil.ToFloat64(metrics.Lookups.WithLabelValues("4", "miss"))
+	req := httptest.NewRequest(http.MethodPost, "/v2/context/batch", strings.NewReader(`{"ips":["::ffff:1.2.3.4"]}`))
+	req.Header.Set("TOKEN", "testtoken")
+	req.Header.Set("Content-Type", "application/json")
+	s.router().ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, v4Lookups+1, testutil.ToFloat64(metrics.Lookups.WithLabelValues("4", "miss")))
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `spurredis_lookups_total{ip_version="4",result="miss"}`)
+	assert.Contains(t, body, `spurredis_lookups_total{ip_version="6",result="hit"}`)
+	assert.Contains(t, body, `spurredis_http_request_duration_seconds_count{method="GET",route="/v2/context/{ipAddress}",status="404"}`)
+	assert.Contains(t, body, `spurredis_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"}`)
+	assert.Contains(t, body, `spurredis_http_request_duration_seconds_count{method="POST",route="unmatched",status="405"}`)
+	assert.Contains(t, body, "go_goroutines")
+}
+
+// unreachableStore - a fakeStore whose backend can't be reached
+type unreachableStore struct {
+	fakeStore
+}
+
+func (u *unreachableStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHandleStatus(t *testing.T) {
+	fi := &spur.FeedInfo{}
+	fi.JSON.Date = "20240102"
+	fi.JSON.GeneratedAt = time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	slot := time.Date(2024, 1, 2, 10, 5, 0, 0, time.UTC)
+	anonymous := &fakeStore{feedInfo: fi, checkpoints: []time.Time{slot, slot.Add(-5 * time.Minute)}}
+
+	get := func(s *Server, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("TOKEN", "testtoken")
+		rec := httptest.NewRecorder()
+		s.router().ServeHTTP(rec, req)
+		return rec
+	}
+
+	cfg := app.Config{LocalAPIAuthTokens: []string{"testtoken"}, MaxFeedAge: 24 * time.Hour}
+	s := NewServer(cfg, []storage.FeedStore{{FeedType: spur.AnonymousFeed, V4: anonymous, V6: storage.NewMMDB()}})
+
+	rec := get(s, "/healthz")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = get(s, "/readyz")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"ready":true,"problems":[]}`, rec.Body.String())
+
+	rec = get(s, "/v2/status")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status statusResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	require.Len(t, status.Feeds, 1)
+	feed := status.Feeds[0]
+	assert.Equal(t, "20240102", feed.FeedDate)
+	assert.True(t, fi.JSON.GeneratedAt.Equal(*feed.GeneratedAt))
+	assert.InDelta(t, 2*time.Hour.Seconds(), feed.AgeSeconds, 60)
+	assert.False(t, feed.Stale)
+	assert.True(t, slot.Equal(*feed.RealtimeSlot))
+	assert.Equal(t, int64(0), *feed.IPv6Records)
+
+	// A stale feed, missing IPv6 networks and an unreachable store all fail readiness
+	cfg.MaxFeedAge = time.Hour
+	cfg.IPv6NetworkFeedBeta = true
+	s = NewServer(cfg, []storage.FeedStore{
+		{FeedType: spur.AnonymousFeed, V4: anonymous, V6: storage.NewMMDB()},
+		{FeedType: spur.IPSummaryFeed, V4: &unreachableStore{}},
+	})
+
+	rec = get(s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.False(t, status.Ready)
+	assert.Len(t, status.Problems, 3)
+	assert.Contains(t, status.Problems[0], "older than 1h0m0s")
+	assert.Equal(t, "anonymous: no ipv6 networks have been loaded", status.Problems[1])
+	assert.Equal(t, "ipsummary: store unreachable: connection refused", status.Problems[2])
+
+	// Feeds that haven't been loaded aren't ready
+	s = NewServer(cfg, []storage.FeedStore{{FeedType: spur.AnonymousFeed, V4: &fakeStore{}}})
+	rec = get(s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"ready":false,"problems":["anonymous: no feed has been loaded"]}`, rec.Body.String())
+
+	// Only the probes are served without a token
+	rec = httptest.NewRecorder()
+	s.router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/status", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"feedexampleredis/internal/spur"
+	"feedexampleredis/internal/storage"
+)
+
+// feedStatus is the state of the data being served for a feed. Fields are left out when the stores can't report them.
+type feedStatus struct {
+	FeedType     spur.FeedType `json:"feed_type"`
+	FeedDate     string        `json:"feed_date"`
+	GeneratedAt  *time.Time    `json:"generated_at,omitempty"`
+	AgeSeconds   float64       `json:"age_seconds"`
+	Stale        bool          `json:"stale"`
+	RealtimeSlot *time.Time    `json:"realtime_slot,omitempty"`
+	Records      *int64        `json:"records,omitempty"`
+	IPv6Records  *int64        `json:"ipv6_records,omitempty"`
+}
+
+// statusResponse is whether every feed is ready to serve lookups, the problems stopping them if not, and the state of
+// each feed.
+type statusResponse struct {
+	Ready    bool         `json:"ready"`
+	Problems []string     `json:"problems"`
+	Feeds    []feedStatus `json:"feeds,omitempty"`
+}
+
+// status checks every feed's stores. A feed isn't ready until its store can be reached and a full feed has been loaded,
+// along with its IPv6 networks when the IPv6 feed is enabled, and stops being ready once its feed is older than
+// MaxFeedAge.
+func (s *Server) status(ctx context.Context) statusResponse {
+	response := statusResponse{Problems: []string{}, Feeds: []feedStatus{}}
+	now := time.Now().UTC()
+	for _, feed := range s.feeds {
+		status := feedStatus{FeedType: feed.FeedType}
+		problem := func(format string, args ...interface{}) {
+			response.Problems = append(response.Problems, string(feed.FeedType)+": "+fmt.Sprintf(format, args...))
+		}
+
+		if pinger, ok := feed.V4.(storage.Pinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				problem("store unreachable: %v", err)
+				response.Feeds = append(response.Feeds, status)
+				continue
+			}
+		}
+
+		feedInfo, err := feed.V4.GetLatestFeedInfo(ctx)
+		if err != nil || feedInfo.JSON.Date == "" {
+			problem("no feed has been loaded")
+		} else {
+			status.FeedDate = feedInfo.JSON.Date
+			if generatedAt := feedInfo.JSON.GeneratedAt; !generatedAt.IsZero() {
+				status.GeneratedAt = &generatedAt
+				status.AgeSeconds = now.Sub(generatedAt).Seconds()
+				if s.cfg.MaxFeedAge > 0 && now.Sub(generatedAt) > s.cfg.MaxFeedAge {
+					status.Stale = true
+					problem("feed generated at %s is older than %s", generatedAt.Format(time.RFC3339), s.cfg.MaxFeedAge)
+				}
+			}
+			status.RealtimeSlot = lastRealtimeSlot(ctx, feed.V4, feedInfo.JSON.Date)
+		}
+
+		if generational, ok := feed.V4.(storage.Generational); ok {
+			if info, err := generational.GetCurrentGenerationInfo(ctx); err == nil {
+				status.Records = &info.Count
+			}
+		}
+
+		if mmdb, ok := feed.V6.(*storage.MMDB); ok {
+			count := mmdb.Count()
+			status.IPv6Records = &count
+			if s.cfg.IPv6NetworkFeedBeta && count == 0 {
+				problem("no ipv6 networks have been loaded")
+			}
+		}
+
+		response.Feeds = append(response.Feeds, status)
+	}
+
+	response.Ready = len(response.Problems) == 0
+	return response
+}
+
+// lastRealtimeSlot is the latest realtime slot merged on top of the feed for the given date, nil if there isn't one or
+// the store doesn't record them.
+func lastRealtimeSlot(ctx context.Context, store storage.Store, feedDate string) *time.Time {
+	checkpointer, ok := store.(storage.RealtimeCheckpointer)
+	if !ok {
+		return nil
+	}
+
+	slots, err := checkpointer.GetRealtimeCheckpoints(ctx, feedDate)
+	if err != nil || len(slots) == 0 {
+		return nil
+	}
+
+	last := slots[0]
+	for _, slot := range slots[1:] {
+		if slot.After(last) {
+			last = slot
+		}
+	}
+	return &last
+}
+
+// handleHealth is the handler for the /healthz endpoint, it only shows the process is up.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady is the handler for the /readyz endpoint, it responds with 503 and the problems found until every feed is
+// ready to serve lookups.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	status := s.status(r.Context())
+	status.Feeds = nil
+
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	s.writeStatus(w, code, status)
+}
+
+// handleStatus is the handler for the /v2/status endpoint, it reports the state of every feed along with its readiness.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.writeStatus(w, http.StatusOK, s.status(r.Context()))
+}
+
+// writeStatus writes a status response as JSON.
+func (s *Server) writeStatus(w http.ResponseWriter, code int, status statusResponse) {
+	response, err := json.Marshal(status)
+	if err != nil {
+		slog.Error("error marshalling status", "error", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -3,45 +3,48 @@ package spur
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"time"
 )
 
-// NewAPI - create new API struct
+// NewAPI - create new API struct using the default client options
 func NewAPI(baseURL, version, token string) *API {
+	return NewAPIWithOptions(baseURL, version, token, ClientOptions{MaxRetries: DefaultMaxRetries})
+}
+
+// NewAPIWithOptions - create new API struct, zero valued options other than MaxRetries use the defaults
+func NewAPIWithOptions(baseURL, version, token string, opts ClientOptions) *API {
+	opts = opts.withDefaults()
 	return &API{
 		BaseURL: baseURL,
 		Version: version,
 		Token:   token,
+		opts:    opts,
+		client:  newHTTPClient(opts),
+		breaker: &circuitBreaker{threshold: opts.BreakerThreshold, cooldown: opts.BreakerCooldown},
+		cache:   newFeedCache(opts),
 	}
 }
 
 func (api *API) LatestFeedInfo(ctx context.Context, feedType FeedType) (*FeedInfo, error) {
+	if api.opts.Offline {
+		return api.cache.latestFeedInfo(feedType)
+	}
+
 	url := latestFeedInfoUrl(api.BaseURL, api.Version, string(feedType))
 	slog.Info("getting latest feed info", slog.String("url", url))
-	req, err := api.constructSpurHttpRequest(ctx, url)
-	if err != nil {
-		return nil, err
-	}
+	ctx, cancel := context.WithTimeout(ctx, api.opts.Timeout)
+	defer cancel()
 
-	r, err := http.DefaultClient.Do(req)
+	r, err := api.get(ctx, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Body.Close()
 
-	if r.StatusCode != http.StatusOK {
-		var feedError FeedError
-		err = json.NewDecoder(r.Body).Decode(&feedError)
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, &feedError
-	}
-
 	var feedInfo FeedInfo
 	err = json.NewDecoder(r.Body).Decode(&feedInfo)
 	if err != nil {
@@ -57,59 +60,46 @@ func (api *API) LatestFeedInfo(ctx context.Context, feedType FeedType) (*FeedInf
 		slog.String("location", feedInfo.JSON.Location),
 	)
 
+	if api.cache != nil {
+		api.cache.putFeedInfo(feedType, &feedInfo)
+	}
+
 	return &feedInfo, nil
 }
 
-func (api *API) LatestFeed(ctx context.Context, feedType FeedType) (io.ReadCloser, error) {
+// LatestFeed - download the full feed described by feedInfo, the latest feed info already fetched. The dated file at
+// its location is downloaded rather than latest.json.gz, so a feed published since the info was fetched isn't mistaken
+// for it. The feed is staged on disk before it is returned, so a dropped connection is resumed and the file is checked
+// against its length and checksum before anything reads it. With a cache the feed is kept under the info's date, and an
+// already cached feed for that date is used instead of downloading it again.
+func (api *API) LatestFeed(ctx context.Context, feedType FeedType, feedInfo *FeedInfo) (io.ReadCloser, error) {
 	url := latestFeedUrl(api.BaseURL, api.Version, string(feedType))
-	slog.Info("getting latest feed", slog.String("url", url))
-	req, err := api.constructSpurHttpRequest(ctx, url)
-	if err != nil {
-		return nil, err
-	}
-
-	r, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	if feedInfo.JSON.Location != "" {
+		url = feedLocationUrl(api.BaseURL, api.Version, string(feedType), feedInfo.JSON.Location)
 	}
-
-	if r.StatusCode != http.StatusOK {
-		var feedError FeedError
-		err = json.NewDecoder(r.Body).Decode(&feedError)
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, &feedError
+	if api.cache == nil {
+		return api.download(ctx, url, "", true)
 	}
 
-	return r.Body, nil
+	return api.download(ctx, url, api.cache.feedPath(feedType, feedInfo.JSON.Date), true)
 }
 
 func (api *API) LatestRealtimeFeedInfo(ctx context.Context, feedType FeedType) (*RealtimeFeedInfo, error) {
+	if api.opts.Offline {
+		return api.cache.latestRealtimeFeedInfo(feedType)
+	}
+
 	url := latestRealtimeFeedInfoUrl(api.BaseURL, api.Version, string(feedType))
 	slog.Info("getting latest realtime feed info", slog.String("url", url))
-	req, err := api.constructSpurHttpRequest(ctx, url)
-	if err != nil {
-		return nil, err
-	}
+	ctx, cancel := context.WithTimeout(ctx, api.opts.Timeout)
+	defer cancel()
 
-	r, err := http.DefaultClient.Do(req)
+	r, err := api.get(ctx, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Body.Close()
 
-	if r.StatusCode != http.StatusOK {
-		var feedError FeedError
-		err = json.NewDecoder(r.Body).Decode(&feedError)
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, &feedError
-	}
-
 	var feedInfo RealtimeFeedInfo
 	err = json.NewDecoder(r.Body).Decode(&feedInfo)
 	if err != nil {
@@ -126,56 +116,49 @@ func (api *API) LatestRealtimeFeedInfo(ctx context.Context, feedType FeedType) (
 	return &feedInfo, nil
 }
 
-func (api *API) LatestRealtimeFeed(ctx context.Context, feedType FeedType) (io.ReadCloser, error) {
-	url := latestRealtimeFeedUrl(api.BaseURL, api.Version, string(feedType))
-	slog.Info("getting latest realtime feed", slog.String("url", url))
-	req, err := api.constructSpurHttpRequest(ctx, url)
-	if err != nil {
-		return nil, err
-	}
+// LatestRealtimeFeed - download the realtime file for the slot of feedInfo, the latest realtime feed info already
+// fetched. It is the file RealtimeFeed downloads for that slot, so it is cached under the slot it holds.
+func (api *API) LatestRealtimeFeed(ctx context.Context, feedType FeedType, feedInfo *RealtimeFeedInfo) (io.ReadCloser, error) {
+	return api.RealtimeFeed(ctx, feedType, feedInfo.JSON.Date.Truncate(RealtimeInterval))
+}
 
-	r, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+func (api *API) RealtimeFeed(ctx context.Context, feedType FeedType, t time.Time) (io.ReadCloser, error) {
+	url := realtimeFeedUrl(api.BaseURL, api.Version, string(feedType), t)
+	if api.cache == nil {
+		return api.download(ctx, url, "", false)
 	}
 
-	if r.StatusCode != http.StatusOK {
-		var feedError FeedError
-		err = json.NewDecoder(r.Body).Decode(&feedError)
-		if err != nil {
-			return nil, err
+	return api.download(ctx, url, api.cache.realtimePath(feedType, t), false)
+}
+
+// download - start downloading a file, from the cache when cachePath is already cached. Otherwise the download is
+// written to cachePath as it is read, or first in full when staged, an empty cachePath skips the cache.
+func (api *API) download(ctx context.Context, url string, cachePath string, staged bool) (io.ReadCloser, error) {
+	if cachePath != "" {
+		if f := api.cache.open(cachePath); f != nil {
+			return f, nil
 		}
 
-		return nil, &feedError
+		if api.opts.Offline {
+			return nil, fmt.Errorf("%s: %w", cachePath, ErrorNotCached)
+		}
 	}
 
-	return r.Body, nil
-}
-
-func (api *API) RealtimeFeed(ctx context.Context, feedType FeedType, t time.Time) (io.ReadCloser, error) {
-	url := realtimeFeedUrl(api.BaseURL, api.Version, string(feedType), t)
-	slog.Info("getting realtime feed", slog.String("url", url))
-	req, err := api.constructSpurHttpRequest(ctx, url)
-	if err != nil {
-		return nil, err
+	slog.Info("downloading", slog.String("url", url))
+	if staged {
+		return api.stage(ctx, url, cachePath)
 	}
 
-	r, err := http.DefaultClient.Do(req)
+	r, err := api.get(ctx, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if r.StatusCode != http.StatusOK {
-		var feedError FeedError
-		err = json.NewDecoder(r.Body).Decode(&feedError)
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, &feedError
+	if cachePath == "" {
+		return r.Body, nil
 	}
 
-	return r.Body, nil
+	return api.cache.tee(r.Body, cachePath), nil
 }
 
 func (api *API) constructSpurHttpRequest(ctx context.Context, url string) (*http.Request, error) {
@@ -198,8 +181,8 @@ func latestFeedUrl(baseURL, version, feed string) string {
 	return constructFeedBaseURL(baseURL, version, feed) + "/latest.json.gz"
 }
 
-func latestRealtimeFeedUrl(baseURL, version, feed string) string {
-	return constructFeedBaseURL(baseURL, version, feed) + "/realtime" + "/latest.json.gz"
+func feedLocationUrl(baseURL, version, feed, location string) string {
+	return constructFeedBaseURL(baseURL, version, feed) + "/" + location
 }
 
 func latestRealtimeFeedInfoUrl(baseURL, version, feed string) string {
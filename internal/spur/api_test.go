@@ -181,7 +181,12 @@ func TestAPI_LatestFeed(t *testing.T) {
 				Token:   token,
 			}
 
-			body, err := api.LatestFeed(tt.args.ctx, tt.args.feedType)
+			info, err := api.LatestFeedInfo(tt.args.ctx, tt.args.feedType)
+			if err != nil {
+				t.Fatalf("LatestFeedInfo() error = %v", err)
+			}
+
+			body, err := api.LatestFeed(tt.args.ctx, tt.args.feedType, info)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("LatestFeed() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -213,8 +218,13 @@ func TestLatestRealtimeFeed(t *testing.T) {
 		Token:   token,
 	}
 
+	info, err := api.LatestRealtimeFeedInfo(context.Background(), AnonymousResidential)
+	if err != nil {
+		t.Fatalf("LatestRealtimeFeedInfo returned an error: %v", err)
+	}
+
 	// Call the function being tested
-	body, err := api.LatestRealtimeFeed(context.Background(), AnonymousResidential)
+	body, err := api.LatestRealtimeFeed(context.Background(), AnonymousResidential, info)
 	if err != nil {
 		t.Fatalf("LatestFeed returned an error: %v", err)
 	}
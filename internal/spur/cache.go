@@ -0,0 +1,279 @@
+package spur
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorNotCached - returned in offline mode for a file that isn't in the cache
+var ErrorNotCached = errors.New("not in the feed cache")
+
+// Files in the cache directory are laid out as <feed type>/<date>/feed.json.gz for full feeds, with the feed info
+// alongside in info.json, and <feed type>/<date>/realtime/<hhmm>.json.gz for realtime files.
+const (
+	cachedFeedName     = "feed.json.gz"
+	cachedFeedInfoName = "info.json"
+	cachedRealtimeDir  = "realtime"
+	cachedTmpSuffix    = ".tmp"
+)
+
+// feedCache - a directory of downloaded feed files that are reused instead of downloading them again
+type feedCache struct {
+	dir     string
+	maxAge  time.Duration
+	maxSize int64
+
+	pruneMu sync.Mutex
+}
+
+// newFeedCache - create the cache, nil if no directory is configured
+func newFeedCache(opts ClientOptions) *feedCache {
+	if opts.CacheDir == "" {
+		return nil
+	}
+
+	return &feedCache{dir: opts.CacheDir, maxAge: opts.CacheMaxAge, maxSize: opts.CacheMaxSize}
+}
+
+// feedPath - where the full feed for a date is cached
+func (c *feedCache) feedPath(feedType FeedType, date string) string {
+	return filepath.Join(c.dir, string(feedType), date, cachedFeedName)
+}
+
+// realtimePath - where the realtime file for a slot is cached
+func (c *feedCache) realtimePath(feedType FeedType, t time.Time) string {
+	t = t.UTC()
+	return filepath.Join(c.dir, string(feedType), t.Format("20060102"), cachedRealtimeDir, t.Format("1504")+".json.gz")
+}
+
+// open - open a cached file, nil if it isn't cached
+func (c *feedCache) open(path string) io.ReadCloser {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+
+	slog.Info("using cached file", slog.String("path", path))
+	return f
+}
+
+// putFeedInfo - keep the feed info next to the feed so it can be served offline
+func (c *feedCache) putFeedInfo(feedType FeedType, fi *FeedInfo) {
+	data, err := json.Marshal(fi)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(c.dir, string(feedType), fi.JSON.Date)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Warn("error creating cache directory", "error", err.Error())
+		return
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, cachedFeedInfoName), data, 0644); err != nil {
+		slog.Warn("error caching feed info", "error", err.Error())
+	}
+}
+
+// dates - the cached dates for a feed type, newest first
+func (c *feedCache) dates(feedType FeedType) []string {
+	entries, err := os.ReadDir(filepath.Join(c.dir, string(feedType)))
+	if err != nil {
+		return nil
+	}
+
+	var dates []string
+	for _, entry := range entries {
+		if _, err := time.Parse("20060102", entry.Name()); err == nil && entry.IsDir() {
+			dates = append(dates, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+
+	return dates
+}
+
+// latestFeedInfo - the info for the newest cached full feed
+func (c *feedCache) latestFeedInfo(feedType FeedType) (*FeedInfo, error) {
+	for _, date := range c.dates(feedType) {
+		if _, err := os.Stat(c.feedPath(feedType, date)); err != nil {
+			continue
+		}
+
+		var fi FeedInfo
+		data, err := os.ReadFile(filepath.Join(c.dir, string(feedType), date, cachedFeedInfoName))
+		if err != nil || json.Unmarshal(data, &fi) != nil {
+			fi = FeedInfo{}
+		}
+		fi.JSON.Date = date
+
+		return &fi, nil
+	}
+
+	return nil, fmt.Errorf("%s feed info: %w", feedType, ErrorNotCached)
+}
+
+// latestRealtimeFeedInfo - the info for the newest cached realtime file
+func (c *feedCache) latestRealtimeFeedInfo(feedType FeedType) (*RealtimeFeedInfo, error) {
+	for _, date := range c.dates(feedType) {
+		matches, _ := filepath.Glob(filepath.Join(c.dir, string(feedType), date, cachedRealtimeDir, "*.json.gz"))
+		if len(matches) == 0 {
+			continue
+		}
+		sort.Strings(matches)
+
+		latest := matches[len(matches)-1]
+		t, err := time.Parse("200601021504", date+strings.TrimSuffix(filepath.Base(latest), ".json.gz"))
+		if err != nil {
+			continue
+		}
+
+		var fi RealtimeFeedInfo
+		fi.JSON.Date = t
+		fi.JSON.Location = latest
+		return &fi, nil
+	}
+
+	return nil, fmt.Errorf("%s realtime feed info: %w", feedType, ErrorNotCached)
+}
+
+// tee - pass a download through while writing it to the cache. The file only appears in the cache once the download
+// has been read to the end, a download that is abandoned part way is discarded.
+func (c *feedCache) tee(body io.ReadCloser, path string) io.ReadCloser {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.Warn("error creating cache directory", "error", err.Error())
+		return body
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"*"+cachedTmpSuffix)
+	if err != nil {
+		slog.Warn("error creating cache file", "error", err.Error())
+		return body
+	}
+
+	return &cachingReader{body: body, tmp: tmp, path: path, cache: c}
+}
+
+// cachingReader - a download being written to the cache as it is read
+type cachingReader struct {
+	body  io.ReadCloser
+	tmp   *os.File
+	path  string
+	cache *feedCache
+	eof   bool
+	err   error
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.err == nil {
+		_, r.err = r.tmp.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close - move the file into the cache if the whole download was read, otherwise discard it
+func (r *cachingReader) Close() error {
+	// Readers like gzip stop at the end of their data and may not have asked for the EOF yet
+	if !r.eof && r.err == nil {
+		_, err := r.Read(make([]byte, 1))
+		r.eof = err == io.EOF
+	}
+
+	err := r.body.Close()
+	closeErr := r.tmp.Close()
+
+	if !r.eof || r.err != nil || closeErr != nil {
+		os.Remove(r.tmp.Name())
+		return err
+	}
+
+	if renameErr := os.Rename(r.tmp.Name(), r.path); renameErr != nil {
+		slog.Warn("error moving file into the cache", "error", renameErr.Error())
+		os.Remove(r.tmp.Name())
+		return err
+	}
+
+	slog.Info("cached file", slog.String("path", r.path))
+	r.cache.prune(time.Now())
+	return err
+}
+
+// prune - delete cached files older than the max age, then the oldest files until the cache fits in the max size
+func (c *feedCache) prune(now time.Time) {
+	if c.maxAge <= 0 && c.maxSize <= 0 {
+		return
+	}
+
+	c.pruneMu.Lock()
+	defer c.pruneMu.Unlock()
+
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []cachedFile
+	var total int64
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, cachedTmpSuffix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if c.maxAge > 0 && now.Sub(info.ModTime()) > c.maxAge {
+			c.remove(path)
+			return nil
+		}
+
+		files = append(files, cachedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	if c.maxSize <= 0 {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= c.maxSize {
+			break
+		}
+		c.remove(f.path)
+		total -= f.size
+	}
+}
+
+// remove - delete a cached file and any directories it leaves empty
+func (c *feedCache) remove(path string) {
+	if err := os.Remove(path); err != nil {
+		slog.Warn("error pruning cached file", "path", path, "error", err.Error())
+		return
+	}
+	slog.Info("pruned cached file", slog.String("path", path))
+
+	for dir := filepath.Dir(path); dir != c.dir && strings.HasPrefix(dir, c.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
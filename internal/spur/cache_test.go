@@ -0,0 +1,151 @@
+package spur
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCachingTestAPI - an API with a cache in a temp dir pointed at a server that serves a feed for 20240102
+func newCachingTestAPI(t *testing.T, opts ClientOptions) (*API, *int32) {
+	var downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/realtime/latest"):
+			w.Write([]byte(`{"json":{"date":"2024-01-02T10:05:00Z","location":"realtime/20240102/1005.json.gz"}}`))
+		case strings.HasSuffix(r.URL.Path, "/latest"):
+			w.Write([]byte(`{"json":{"date":"20240102","location":"20240102/feed.json.gz"}}`))
+		default:
+			atomic.AddInt32(&downloads, 1)
+			w.Write([]byte("data for " + r.URL.Path))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	if opts.CacheDir == "" {
+		opts.CacheDir = t.TempDir()
+	}
+	return NewAPIWithOptions(srv.URL, "v2", "token", opts), &downloads
+}
+
+func readAll(t *testing.T, rc io.ReadCloser, err error) string {
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	return string(data)
+}
+
+func TestCacheReusesDownloads(t *testing.T) {
+	api, downloads := newCachingTestAPI(t, ClientOptions{})
+	ctx := context.Background()
+
+	info, err := api.LatestFeedInfo(ctx, AnonymousFeed)
+	require.NoError(t, err)
+
+	// The dated file the info describes is downloaded, not whatever latest.json.gz holds by then
+	rc, err := api.LatestFeed(ctx, AnonymousFeed, info)
+	assert.Equal(t, "data for /v2/anonymous/20240102/feed.json.gz", readAll(t, rc, err))
+	rc, err = api.LatestFeed(ctx, AnonymousFeed, info)
+	assert.Equal(t, "data for /v2/anonymous/20240102/feed.json.gz", readAll(t, rc, err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(downloads))
+	assert.FileExists(t, filepath.Join(api.opts.CacheDir, "anonymous", "20240102", "feed.json.gz"))
+	assert.FileExists(t, filepath.Join(api.opts.CacheDir, "anonymous", "20240102", "info.json"))
+
+	// The latest realtime file is cached where RealtimeFeed looks for it
+	rtInfo, err := api.LatestRealtimeFeedInfo(ctx, AnonymousResidential)
+	require.NoError(t, err)
+	rc, err = api.LatestRealtimeFeed(ctx, AnonymousResidential, rtInfo)
+	assert.Equal(t, "data for /v2/anonymous-residential/realtime/20240102/1005.json.gz", readAll(t, rc, err))
+	slot := time.Date(2024, 1, 2, 10, 5, 0, 0, time.UTC)
+	rc, err = api.RealtimeFeed(ctx, AnonymousResidential, slot)
+	assert.Equal(t, "data for /v2/anonymous-residential/realtime/20240102/1005.json.gz", readAll(t, rc, err))
+	assert.Equal(t, int32(2), atomic.LoadInt32(downloads))
+}
+
+func TestCacheDiscardsPartialDownloads(t *testing.T) {
+	api, downloads := newCachingTestAPI(t, ClientOptions{})
+	ctx := context.Background()
+	slot := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	rc, err := api.RealtimeFeed(ctx, AnonymousResidential, slot)
+	require.NoError(t, err)
+	_, err = rc.Read(make([]byte, 2))
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.NoFileExists(t, api.cache.realtimePath(AnonymousResidential, slot))
+
+	rc, err = api.RealtimeFeed(ctx, AnonymousResidential, slot)
+	readAll(t, rc, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(downloads))
+	assert.FileExists(t, api.cache.realtimePath(AnonymousResidential, slot))
+}
+
+func TestCacheOffline(t *testing.T) {
+	online, _ := newCachingTestAPI(t, ClientOptions{})
+	ctx := context.Background()
+	slot := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	info, err := online.LatestFeedInfo(ctx, AnonymousResidential)
+	require.NoError(t, err)
+	rc, err := online.LatestFeed(ctx, AnonymousResidential, info)
+	readAll(t, rc, err)
+	rc, err = online.RealtimeFeed(ctx, AnonymousResidential, slot)
+	readAll(t, rc, err)
+
+	// Nothing listens on the offline API's base URL, so everything has to come from the cache
+	offline := NewAPIWithOptions("http://127.0.0.1:0", "v2", "", ClientOptions{CacheDir: online.opts.CacheDir, Offline: true})
+
+	fi, err := offline.LatestFeedInfo(ctx, AnonymousResidential)
+	require.NoError(t, err)
+	assert.Equal(t, "20240102", fi.JSON.Date)
+
+	rc, err = offline.LatestFeed(ctx, AnonymousResidential, fi)
+	assert.Equal(t, "data for /v2/anonymous-residential/20240102/feed.json.gz", readAll(t, rc, err))
+
+	rtfi, err := offline.LatestRealtimeFeedInfo(ctx, AnonymousResidential)
+	require.NoError(t, err)
+	assert.True(t, slot.Equal(rtfi.JSON.Date))
+
+	_, err = offline.RealtimeFeed(ctx, AnonymousResidential, slot.Add(RealtimeInterval))
+	assert.True(t, errors.Is(err, ErrorNotCached))
+
+	_, err = offline.LatestFeedInfo(ctx, IPSummaryFeed)
+	assert.True(t, errors.Is(err, ErrorNotCached))
+}
+
+func TestCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	c := &feedCache{dir: dir, maxAge: 24 * time.Hour, maxSize: 10}
+	now := time.Now()
+
+	write := func(name string, size int, age time.Duration) string {
+		path := filepath.Join(dir, "anonymous", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+		require.NoError(t, os.Chtimes(path, now.Add(-age), now.Add(-age)))
+		return path
+	}
+
+	expired := write("20240101/feed.json.gz", 1, 48*time.Hour)
+	oldest := write("20240102/feed.json.gz", 6, 2*time.Hour)
+	newest := write("20240103/feed.json.gz", 6, time.Hour)
+
+	c.prune(now)
+
+	assert.NoFileExists(t, expired)
+	assert.NoDirExists(t, filepath.Dir(expired))
+	assert.NoFileExists(t, oldest)
+	assert.FileExists(t, newest)
+}
@@ -0,0 +1,279 @@
+package spur
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorCircuitOpen - returned without making a request while the circuit breaker is open
+var ErrorCircuitOpen = errors.New("spur api circuit breaker is open, requests are paused")
+
+// DefaultMaxRetries - how many times NewAPI retries a failed request
+const DefaultMaxRetries = 3
+
+// ClientOptions - how the API talks to the feeds server, zero values use the defaults apart from MaxRetries
+type ClientOptions struct {
+	// Timeout bounds connecting and waiting for the response headers of every request, and the whole of the small
+	// metadata requests. Feed downloads can take much longer than this once they start streaming.
+	Timeout time.Duration
+
+	// Requests that fail with a network error, a 5xx or a 429 are retried up to MaxRetries times, waiting a random
+	// delay of up to RetryBaseDelay doubled for every attempt and capped at RetryMaxDelay, or the Retry-After header.
+	// Zero turns retries off.
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// After BreakerThreshold requests in a row have failed every retry, requests fail fast with ErrorCircuitOpen for
+	// BreakerCooldown. A single request is then let through, and the breaker closes again if it succeeds.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Downloads are kept in CacheDir when it is set and reused when the same file is requested again. Files older than
+	// CacheMaxAge are pruned, then the oldest files until the cache is under CacheMaxSize bytes, zero disables either.
+	// Offline serves everything from CacheDir without making any requests.
+	CacheDir     string
+	CacheMaxAge  time.Duration
+	CacheMaxSize int64
+	Offline      bool
+
+	// Full feed downloads are staged in StagingDir, or CacheDir when that is set, so an interrupted download can be
+	// resumed and checked before it is read. Defaults to the system temp directory.
+	StagingDir string
+}
+
+// withDefaults - fill in the zero values
+func (o ClientOptions) withDefaults() ClientOptions {
+	if o.Timeout == 0 {
+		o.Timeout = 30 * time.Second
+	}
+	if o.RetryBaseDelay == 0 {
+		o.RetryBaseDelay = 1 * time.Second
+	}
+	if o.RetryMaxDelay == 0 {
+		o.RetryMaxDelay = 30 * time.Second
+	}
+	if o.BreakerThreshold == 0 {
+		o.BreakerThreshold = 5
+	}
+	if o.BreakerCooldown == 0 {
+		o.BreakerCooldown = 5 * time.Minute
+	}
+	if o.StagingDir == "" {
+		o.StagingDir = os.TempDir()
+	}
+	return o
+}
+
+// StatusError - the API responded with something other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("spur api responded %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Retryable - whether the request may succeed if it is tried again
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// newStatusError - build the error for a non 200 response and close its body. The body is usually a JSON FeedError but
+// proxies in between can return anything, so it falls back to the start of the raw body.
+func newStatusError(r *http.Response) *StatusError {
+	defer r.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 4096))
+	message := strings.TrimSpace(string(body))
+
+	var feedError FeedError
+	if err := json.Unmarshal(body, &feedError); err == nil && feedError.Err != "" {
+		message = feedError.Err
+	} else if len(message) > 256 {
+		message = message[:256]
+	}
+
+	return &StatusError{
+		StatusCode: r.StatusCode,
+		Message:    message,
+		RetryAfter: parseRetryAfter(r.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter - parse a Retry-After header given in seconds or as an HTTP date, 0 if missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// newHTTPClient - an HTTP client that gives up on slow connects and responses without limiting how long a body takes
+// to stream
+func newHTTPClient(opts ClientOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: opts.Timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = opts.Timeout
+	transport.ResponseHeaderTimeout = opts.Timeout
+
+	return &http.Client{Transport: transport}
+}
+
+// circuitBreaker - stops requests for a cooldown after too many consecutive failures
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow - whether a request may be made now. Once the cooldown is over a single probe request is let through.
+func (b *circuitBreaker) allow(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+
+	if now.Before(b.openUntil) || b.probing {
+		return ErrorCircuitOpen
+	}
+
+	b.probing = true
+	return nil
+}
+
+// success - record a request that reached the server, closing the breaker
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures >= b.threshold {
+		slog.Info("spur api circuit breaker closed")
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+// release - give up the probe without an outcome, e.g. when the request was canceled
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// failure - record a request that failed every retry, opening the breaker once the threshold is reached
+func (b *circuitBreaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+		slog.Warn("spur api circuit breaker opened", "failures", b.failures, "until", b.openUntil.Format(time.RFC3339))
+	}
+}
+
+// get - make a GET request with any extra headers, retrying failures that may be temporary. The response is only
+// returned for a 200 OK, or a 206 Partial Content for a Range request, anything else is returned as a StatusError.
+func (api *API) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	if err := api.breaker.allow(time.Now()); err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= api.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := api.retryDelay(attempt, lastErr)
+			slog.Warn("retrying spur api request", "url", url, "attempt", attempt, "delay", delay.String(), "error", lastErr.Error())
+			select {
+			case <-ctx.Done():
+				api.breaker.release()
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		req, err := api.constructSpurHttpRequest(ctx, url)
+		if err != nil {
+			api.breaker.release()
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		r, err := api.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				api.breaker.release()
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+
+		if r.StatusCode == http.StatusOK || (r.StatusCode == http.StatusPartialContent && header.Get("Range") != "") {
+			api.breaker.success()
+			return r, nil
+		}
+
+		statusErr := newStatusError(r)
+		if !statusErr.Retryable() {
+			// The server is up and answering, the request itself is wrong
+			api.breaker.success()
+			return nil, statusErr
+		}
+		lastErr = statusErr
+	}
+
+	api.breaker.failure(time.Now())
+	return nil, lastErr
+}
+
+// retryDelay - how long to wait before the given retry, the server's Retry-After if it sent one otherwise exponential
+// backoff with full jitter
+func (api *API) retryDelay(attempt int, lastErr error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(lastErr, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter
+	}
+
+	ceiling := api.opts.RetryBaseDelay << (attempt - 1)
+	if ceiling <= 0 || ceiling > api.opts.RetryMaxDelay {
+		ceiling = api.opts.RetryMaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
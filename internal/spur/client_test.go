@@ -0,0 +1,120 @@
+package spur
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAPI - an API pointed at a test server that answers with the given statuses in order, then 200 OK
+func newTestAPI(t *testing.T, opts ClientOptions, statuses ...int) (*API, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(atomic.AddInt32(&calls, 1))
+		if call <= len(statuses) {
+			status := statuses[call-1]
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("<html>bad gateway</html>"))
+			return
+		}
+		w.Write([]byte(`{"json":{"date":"20240102"}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	if opts.RetryBaseDelay == 0 {
+		opts.RetryBaseDelay = time.Millisecond
+	}
+	return NewAPIWithOptions(srv.URL, "v2", "token", opts), &calls
+}
+
+func TestAPIRetriesServerErrors(t *testing.T) {
+	api, calls := newTestAPI(t, ClientOptions{MaxRetries: DefaultMaxRetries}, http.StatusBadGateway, http.StatusServiceUnavailable)
+
+	fi, err := api.LatestFeedInfo(context.Background(), AnonymousFeed)
+	require.NoError(t, err)
+	assert.Equal(t, "20240102", fi.JSON.Date)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+}
+
+func TestAPIRetriesDisabled(t *testing.T) {
+	api, calls := newTestAPI(t, ClientOptions{MaxRetries: 0}, http.StatusBadGateway)
+
+	_, err := api.LatestFeedInfo(context.Background(), AnonymousFeed)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestAPIReturnsStatusError(t *testing.T) {
+	api, calls := newTestAPI(t, ClientOptions{MaxRetries: 2}, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+
+	_, err := api.LatestFeedInfo(context.Background(), AnonymousFeed)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+	assert.Equal(t, "<html>bad gateway</html>", statusErr.Message)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+}
+
+func TestAPIDoesNotRetryClientErrors(t *testing.T) {
+	api, calls := newTestAPI(t, ClientOptions{}, http.StatusNotFound)
+
+	_, err := api.RealtimeFeed(context.Background(), AnonymousResidential, time.Now())
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestAPIHonorsRetryAfter(t *testing.T) {
+	api, calls := newTestAPI(t, ClientOptions{MaxRetries: DefaultMaxRetries}, http.StatusTooManyRequests)
+
+	start := time.Now()
+	_, err := api.LatestFeedInfo(context.Background(), AnonymousFeed)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+}
+
+func TestAPICircuitBreaker(t *testing.T) {
+	opts := ClientOptions{MaxRetries: 1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}
+	api, calls := newTestAPI(t, opts, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	ctx := context.Background()
+
+	// Two requests failing every retry open the breaker
+	for i := 0; i < 2; i++ {
+		_, err := api.LatestFeedInfo(ctx, AnonymousFeed)
+		require.Error(t, err)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(calls))
+
+	_, err := api.LatestFeedInfo(ctx, AnonymousFeed)
+	assert.True(t, errors.Is(err, ErrorCircuitOpen))
+	assert.Equal(t, int32(4), atomic.LoadInt32(calls), "no request is made while the breaker is open")
+
+	// After the cooldown a probe is let through and closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	_, err = api.LatestFeedInfo(ctx, AnonymousFeed)
+	require.NoError(t, err)
+	_, err = api.LatestFeedInfo(ctx, AnonymousFeed)
+	require.NoError(t, err)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+
+	d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, float64(time.Minute), float64(d), float64(2*time.Second))
+}
@@ -0,0 +1,294 @@
+package spur
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxDownloadResumes - how many times an interrupted download is resumed before giving up
+	maxDownloadResumes = 10
+
+	// downloadProgressInterval - how often download progress is logged
+	downloadProgressInterval = 10 * time.Second
+)
+
+// ErrorDownloadCorrupt - a staged download didn't match the length or checksum the server gave for it
+var ErrorDownloadCorrupt = errors.New("downloaded file failed integrity check")
+
+var (
+	contentRangePattern = regexp.MustCompile(`^bytes (\d+)-\d+/(\d+|\*)$`)
+	md5ETagPattern      = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// downloadMeta - what the server said about the file when the download started
+type downloadMeta struct {
+	total int64
+	etag  string
+	md5   []byte
+}
+
+// parseDownloadMeta - read the length, ETag and MD5 of the file from a 200 response. The MD5 comes from Content-MD5,
+// the md5 in the X-Goog-Hash header of Google Cloud Storage, or an ETag that is a plain MD5 as S3 and GCS use for files
+// uploaded in one part.
+func parseDownloadMeta(r *http.Response) downloadMeta {
+	meta := downloadMeta{total: r.ContentLength, etag: r.Header.Get("ETag")}
+
+	if sum, err := base64.StdEncoding.DecodeString(r.Header.Get("Content-MD5")); err == nil && len(sum) == md5.Size {
+		meta.md5 = sum
+		return meta
+	}
+
+	for _, value := range r.Header.Values("X-Goog-Hash") {
+		for _, part := range strings.Split(value, ",") {
+			encoded, ok := strings.CutPrefix(strings.TrimSpace(part), "md5=")
+			if !ok {
+				continue
+			}
+			if sum, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(sum) == md5.Size {
+				meta.md5 = sum
+				return meta
+			}
+		}
+	}
+
+	if etag := strings.Trim(meta.etag, `"`); md5ETagPattern.MatchString(etag) {
+		meta.md5, _ = hex.DecodeString(etag)
+	}
+
+	return meta
+}
+
+// downloadProgress - logs how far a download has got, its rate and how long it has left
+type downloadProgress struct {
+	url        string
+	total      int64
+	done       int64
+	start      time.Time
+	lastLogged time.Time
+}
+
+// add - count bytes received, logging progress every downloadProgressInterval
+func (p *downloadProgress) add(n int64, now time.Time) {
+	p.done += n
+	if now.Sub(p.lastLogged) >= downloadProgressInterval {
+		p.log(now, "download progress")
+	}
+}
+
+// log - log the current progress
+func (p *downloadProgress) log(now time.Time, msg string) {
+	p.lastLogged = now
+
+	elapsed := now.Sub(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+
+	attrs := []any{
+		slog.String("url", p.url),
+		slog.Int64("bytes", p.done),
+		slog.String("rate", fmt.Sprintf("%.1fMB/s", rate/(1<<20))),
+	}
+	if p.total > 0 {
+		attrs = append(attrs, slog.Int64("total", p.total), slog.String("percent", fmt.Sprintf("%.1f", 100*float64(p.done)/float64(p.total))))
+		if rate > 0 {
+			eta := time.Duration(float64(p.total-p.done)/rate) * time.Second
+			attrs = append(attrs, slog.String("eta", eta.Round(time.Second).String()))
+		}
+	}
+
+	slog.Info(msg, attrs...)
+}
+
+// stagedFile - a downloaded file that is deleted once it has been read
+type stagedFile struct {
+	*os.File
+}
+
+func (f *stagedFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// stage - download url to disk before it is read, so a dropped connection can be resumed rather than failing the
+// insert. The file is kept at cachePath, or in the staging directory and deleted once read if cachePath is empty.
+func (api *API) stage(ctx context.Context, url string, cachePath string) (io.ReadCloser, error) {
+	dir, pattern := api.opts.StagingDir, "spur-download-*"+cachedTmpSuffix
+	if cachePath != "" {
+		dir, pattern = filepath.Dir(cachePath), filepath.Base(cachePath)+"*"+cachedTmpSuffix
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil && dir != "" {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging file: %w", err)
+	}
+
+	err = api.downloadTo(ctx, url, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if cachePath == "" {
+		return &stagedFile{File: f}, nil
+	}
+
+	f.Close()
+	if err := os.Rename(f.Name(), cachePath); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("error moving download into the cache: %w", err)
+	}
+	slog.Info("cached file", slog.String("path", cachePath))
+	api.cache.prune(time.Now())
+
+	return os.Open(cachePath)
+}
+
+// downloadTo - download url into f, resuming with a Range request from where it stopped if the connection drops or
+// stalls for longer than the timeout, then check the length and checksum. The download starts over if the file changed
+// on the server in the meantime.
+func (api *API) downloadTo(ctx context.Context, url string, f *os.File) error {
+	var meta downloadMeta
+	var written int64
+	var sum hash.Hash
+	progress := &downloadProgress{url: url, start: time.Now()}
+
+	for resumes := 0; ; resumes++ {
+		// Ask for the file as it is stored, transparent compression would make byte offsets meaningless
+		header := http.Header{"Accept-Encoding": {"identity"}}
+		if written > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			if meta.etag != "" {
+				header.Set("If-Range", meta.etag)
+			}
+		}
+
+		copied, restarted, err := api.downloadAttempt(ctx, url, header, f, written, &meta, &sum, progress)
+		if restarted {
+			written = 0
+		}
+		written += copied
+		if err == nil {
+			break
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if resumes >= maxDownloadResumes {
+			return fmt.Errorf("download of %s interrupted %d times: %w", url, resumes+1, err)
+		}
+
+		delay := api.retryDelay(resumes+1, nil)
+		slog.Warn("download interrupted, resuming", "url", url, "bytes", written, "delay", delay.String(), "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	progress.log(time.Now(), "download complete")
+
+	if meta.total >= 0 && written != meta.total {
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrorDownloadCorrupt, written, meta.total)
+	}
+
+	if meta.md5 != nil && !bytes.Equal(sum.Sum(nil), meta.md5) {
+		return fmt.Errorf("%w: md5 %x, expected %x", ErrorDownloadCorrupt, sum.Sum(nil), meta.md5)
+	}
+
+	return f.Sync()
+}
+
+// downloadAttempt - make one request for the rest of the file and append it to f, returning how many bytes were
+// written and whether the server sent the whole file so it had to start over
+func (api *API) downloadAttempt(ctx context.Context, url string, header http.Header, f *os.File, offset int64, meta *downloadMeta, sum *hash.Hash, progress *downloadProgress) (int64, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r, err := api.get(ctx, url, header)
+	if err != nil {
+		return 0, false, err
+	}
+	defer r.Body.Close()
+
+	// Cancel the request if the body stops making progress, the transport only times out waiting for headers
+	stall := time.AfterFunc(api.opts.Timeout, cancel)
+	defer stall.Stop()
+
+	restarted := false
+	if r.StatusCode == http.StatusPartialContent {
+		m := contentRangePattern.FindStringSubmatch(r.Header.Get("Content-Range"))
+		if m == nil || m[1] != strconv.FormatInt(offset, 10) {
+			return 0, false, fmt.Errorf("unexpected Content-Range %q resuming at %d", r.Header.Get("Content-Range"), offset)
+		}
+		slog.Info("resuming download", "url", url, "bytes", offset)
+	} else {
+		// A fresh download, or the server ignored the Range because the file changed
+		if offset > 0 {
+			slog.Warn("server sent the whole file, restarting download", "url", url)
+		}
+		if err := f.Truncate(0); err != nil {
+			return 0, false, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, false, err
+		}
+
+		*meta = parseDownloadMeta(r)
+		*sum = md5.New()
+		restarted = true
+		progress.total = meta.total
+		progress.done = 0
+		progress.start = time.Now()
+	}
+
+	written := int64(0)
+	buf := make([]byte, 256<<10)
+	for {
+		n, readErr := r.Body.Read(buf)
+		if n > 0 {
+			stall.Reset(api.opts.Timeout)
+			if _, err := f.Write(buf[:n]); err != nil {
+				return written, restarted, fmt.Errorf("error writing staging file: %w", err)
+			}
+			(*sum).Write(buf[:n])
+			written += int64(n)
+			progress.add(int64(n), time.Now())
+		}
+
+		if readErr == io.EOF {
+			return written, restarted, nil
+		}
+		if readErr != nil {
+			return written, restarted, readErr
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package spur
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDownloadTestAPI - an API pointed at a server that serves body with Range support, cutting the first response off
+// halfway through
+func newDownloadTestAPI(t *testing.T, body []byte, header http.Header) (*API, *int32, *int32) {
+	var requests, ranged int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", `"v1"`)
+
+		if n == 1 {
+			w.Header().Set("Content-Length", "1000")
+			w.WriteHeader(http.StatusOK)
+			w.Write(body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "feed.json.gz", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	api := NewAPIWithOptions(srv.URL, "v2", "token", ClientOptions{
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  time.Millisecond,
+		StagingDir:     t.TempDir(),
+	})
+	return api, &requests, &ranged
+}
+
+func TestStagedDownloadResumes(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	sum := md5.Sum(body)
+	api, requests, ranged := newDownloadTestAPI(t, body, http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}})
+
+	rc, err := api.LatestFeed(context.Background(), AnonymousFeed, &FeedInfo{})
+	assert.Equal(t, string(body), readAll(t, rc, err))
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(ranged))
+
+	// The staged file is removed once it has been read
+	entries, err := os.ReadDir(api.opts.StagingDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStagedDownloadChecksumMismatch(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	sum := md5.Sum([]byte("something else"))
+	api, _, _ := newDownloadTestAPI(t, body, http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}})
+
+	_, err := api.LatestFeed(context.Background(), AnonymousFeed, &FeedInfo{})
+	assert.True(t, errors.Is(err, ErrorDownloadCorrupt), err)
+
+	entries, err := os.ReadDir(api.opts.StagingDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestParseDownloadMeta(t *testing.T) {
+	sum := md5.Sum([]byte("feed"))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   []byte
+	}{
+		{"content-md5", http.Header{"Content-Md5": {b64}}, sum[:]},
+		{"goog-hash", http.Header{"X-Goog-Hash": {"crc32c=AAAAAA==, md5=" + b64}}, sum[:]},
+		{"md5 etag", http.Header{"Etag": {`"` + strings.Repeat("ab", 16) + `"`}}, bytes.Repeat([]byte{0xab}, 16)},
+		{"multipart etag", http.Header{"Etag": {`"` + strings.Repeat("ab", 16) + `-3"`}}, nil},
+		{"none", http.Header{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := parseDownloadMeta(&http.Response{Header: tt.header, ContentLength: 4})
+			assert.Equal(t, tt.want, meta.md5)
+			assert.Equal(t, int64(4), meta.total)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package spur
 import (
 	"errors"
 	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"net/http"
 	"time"
 )
 
@@ -49,11 +50,24 @@ func (ft FeedType) V6FeedType() (FeedType, error) {
 	}
 }
 
+// RealtimeInterval - how often a realtime update file is published, each file covers one slot of this length
+const RealtimeInterval = 5 * time.Minute
+
+// HasRealtime - whether the feed type has realtime updates, only anonymous-residential does
+func (ft FeedType) HasRealtime() bool {
+	return ft == AnonymousResidential
+}
+
 // API - struct for spur api configuration
 type API struct {
 	BaseURL string
 	Version string
 	Token   string
+
+	opts    ClientOptions
+	client  *http.Client
+	breaker *circuitBreaker
+	cache   *feedCache
 }
 
 // FeedInfo - struct for latest feed info
@@ -85,6 +99,7 @@ func (e *FeedError) Error() string {
 type IPContext struct {
 	Location       Location `json:"location,omitempty"`
 	IP             string   `json:"ip,omitempty"`
+	Network        string   `json:"network,omitempty"`
 	Organization   string   `json:"organization,omitempty"`
 	Infrastructure string   `json:"infrastructure,omitempty"`
 	Tunnels        []Tunnel `json:"tunnels,omitempty"`
@@ -94,6 +109,11 @@ type IPContext struct {
 	Client         Client   `json:"client,omitempty"`
 }
 
+// IPContextFields - the JSON names of the top level fields of an IPContext
+var IPContextFields = []string{
+	"location", "ip", "network", "organization", "infrastructure", "tunnels", "services", "risks", "as", "client",
+}
+
 type IPContextV6 struct {
 	Location       Location `json:"location,omitempty" maxminddb:"location"`
 	Network        string   `json:"network,omitempty" maxminddb:"network"`
@@ -142,6 +162,21 @@ type Tunnel struct {
 	Anonymous bool     `json:"anonymous" maxminddb:"anonymous"`
 }
 
+// ToIPContext - convert to an IPContext, keeping the network the context applies to
+func (ipCtx IPContextV6) ToIPContext() *IPContext {
+	return &IPContext{
+		Location:       ipCtx.Location,
+		Network:        ipCtx.Network,
+		Organization:   ipCtx.Organization,
+		Infrastructure: ipCtx.Infrastructure,
+		Tunnels:        ipCtx.Tunnels,
+		Services:       ipCtx.Services,
+		Risks:          ipCtx.Risks,
+		AS:             ipCtx.AS,
+		Client:         ipCtx.Client,
+	}
+}
+
 func (ipCtx IPContextV6) ToMMDB() mmdbtype.Map {
 	record := mmdbtype.Map{}
 	record["location"] = mmdbtype.Map{
@@ -0,0 +1,663 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"feedexampleredis/internal/spur"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt backend mirrors the Redis layout: a meta bucket holding the feed info and the current generation, and one
+// bucket per generation holding the records keyed by IP. Records never expire, stale IPs are dropped when the
+// generation they belong to is replaced. Bucket names start with the store's namespace.
+var (
+	boltMetaBucket            = "meta"
+	boltFeedInfoKey           = []byte("feed_info")
+	boltRealtimeFeedInfoKey   = []byte("realtime_feed_info")
+	boltCurrentGenerationKey  = []byte("current_generation")
+	boltGenerationMetaKeyBase = "generation:"
+	boltRealtimeSlotsKeyBase  = "realtime_slots:"
+)
+
+type Bolt struct {
+	path        string
+	namespace   string
+	concurrency int
+	chunkSize   int
+	db          *bolt.DB
+	purgeMu     sync.Mutex
+
+	// generations currently being loaded, bolt holds an exclusive lock on the file so no other process can be loading
+	loadingMu sync.Mutex
+	loading   map[int64]bool
+
+	ingestTracker
+}
+
+// NewBolt - create a new bolt storage object backed by the file at path
+func NewBolt(path string, concurrency int, chunkSize int) *Bolt {
+	return &Bolt{
+		path:        path,
+		concurrency: concurrency,
+		chunkSize:   chunkSize,
+		loading:     make(map[int64]bool),
+	}
+}
+
+// setLoading - mark whether a generation is being loaded, so the purge leaves it alone
+func (b *Bolt) setLoading(generation int64, loading bool) {
+	b.loadingMu.Lock()
+	defer b.loadingMu.Unlock()
+	if loading {
+		b.loading[generation] = true
+	} else {
+		delete(b.loading, generation)
+	}
+}
+
+// isLoading - whether a generation is being loaded
+func (b *Bolt) isLoading(generation int64) bool {
+	b.loadingMu.Lock()
+	defer b.loadingMu.Unlock()
+	return b.loading[generation]
+}
+
+// Open - open the bolt database, creating it if needed, and drop any generation left behind by an interrupted load
+func (b *Bolt) Open() error {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{
+		Timeout:        5 * time.Second,
+		NoFreelistSync: true,
+		FreelistType:   bolt.FreelistMapType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open bolt database %s: %w", b.path, err)
+	}
+	b.db = db
+
+	return b.init()
+}
+
+// init - create the meta bucket and drop any generation left behind by an interrupted load
+func (b *Bolt) init() error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.metaBucket())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create meta bucket: %w", err)
+	}
+
+	return b.purgeStaleGenerations()
+}
+
+// WithNamespace - a store sharing this store's open database with its buckets under an additional namespace, so several
+// feeds can be kept in the same file. Only the parent store should be closed.
+func (b *Bolt) WithNamespace(namespace string) (*Bolt, error) {
+	child := NewBolt(b.path, b.concurrency, b.chunkSize)
+	child.namespace = b.namespace + namespace
+	child.db = b.db
+
+	err := child.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return child, nil
+}
+
+// Close - close the bolt database
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// metaBucket - the bucket holding the feed info and generation metadata
+func (b *Bolt) metaBucket() []byte {
+	return []byte(b.namespace + boltMetaBucket)
+}
+
+// generationBucket - the bucket holding the records for a generation
+func (b *Bolt) generationBucket(generation int64) []byte {
+	return []byte(b.namespace + "g" + strconv.FormatInt(generation, 10))
+}
+
+// boltGenerationMetaKey - the meta bucket key holding the GenerationInfo for a generation
+func boltGenerationMetaKey(generation int64) []byte {
+	return []byte(boltGenerationMetaKeyBase + strconv.FormatInt(generation, 10))
+}
+
+// currentGeneration - get the generation currently being served, 0 if no generation has been activated yet
+func (b *Bolt) currentGeneration(tx *bolt.Tx) int64 {
+	val := tx.Bucket(b.metaBucket()).Get(boltCurrentGenerationKey)
+	if val == nil {
+		return 0
+	}
+
+	gen, _ := strconv.ParseInt(string(val), 10, 64)
+	return gen
+}
+
+// generationInfo - get the metadata for a generation
+func (b *Bolt) generationInfo(tx *bolt.Tx, generation int64) (*GenerationInfo, error) {
+	info := &GenerationInfo{Generation: generation}
+	val := tx.Bucket(b.metaBucket()).Get(boltGenerationMetaKey(generation))
+	if val == nil {
+		return info, nil
+	}
+
+	err := json.Unmarshal(val, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// putGenerationInfo - store the metadata for a generation
+func (b *Bolt) putGenerationInfo(tx *bolt.Tx, info *GenerationInfo) error {
+	val, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(b.metaBucket()).Put(boltGenerationMetaKey(info.Generation), val)
+}
+
+// GetByIP - get an IP context from the current generation
+func (b *Bolt) GetByIP(ctx context.Context, ip string) (*spur.IPContext, error) {
+	var ipctx spur.IPContext
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.generationBucket(b.currentGeneration(tx)))
+		if bucket == nil {
+			return ErrorIPNotFound
+		}
+
+		val := bucket.Get([]byte(ip))
+		if val == nil {
+			return ErrorIPNotFound
+		}
+
+		return json.Unmarshal(val, &ipctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipctx, nil
+}
+
+// GetCurrentGenerationInfo - get the metadata for the generation currently being served
+func (b *Bolt) GetCurrentGenerationInfo(ctx context.Context) (*GenerationInfo, error) {
+	var info *GenerationInfo
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = b.generationInfo(tx, b.currentGeneration(tx))
+		return err
+	})
+
+	return info, err
+}
+
+// getMeta - unmarshal a JSON value from the meta bucket
+func (b *Bolt) getMeta(key []byte, v any) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(b.metaBucket()).Get(key)
+		if val == nil {
+			return fmt.Errorf("%s not found", key)
+		}
+
+		return json.Unmarshal(val, v)
+	})
+}
+
+// putMeta - marshal a value as JSON into the meta bucket
+func (b *Bolt) putMeta(key []byte, v any) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.metaBucket()).Put(key, val)
+	})
+}
+
+// GetLatestFeedInfo - get the latest feed info
+func (b *Bolt) GetLatestFeedInfo(ctx context.Context) (*spur.FeedInfo, error) {
+	var fi spur.FeedInfo
+	err := b.getMeta(boltFeedInfoKey, &fi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fi, nil
+}
+
+// PutLatestFeedInfo - put the latest feed info
+func (b *Bolt) PutLatestFeedInfo(ctx context.Context, fi *spur.FeedInfo) error {
+	return b.putMeta(boltFeedInfoKey, fi)
+}
+
+// GetLatestRealtimeFeedInfo - get the latest realtime feed info
+func (b *Bolt) GetLatestRealtimeFeedInfo(ctx context.Context) (*spur.RealtimeFeedInfo, error) {
+	var fi spur.RealtimeFeedInfo
+	err := b.getMeta(boltRealtimeFeedInfoKey, &fi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fi, nil
+}
+
+// PutLatestRealtimeFeedInfo - put the latest realtime feed info
+func (b *Bolt) PutLatestRealtimeFeedInfo(ctx context.Context, fi *spur.RealtimeFeedInfo) error {
+	return b.putMeta(boltRealtimeFeedInfoKey, fi)
+}
+
+// PutRealtimeCheckpoint - record that the realtime slot has been merged on top of the feed for the date. Records never
+// expire in bolt, so the checkpoints for any other date are dropped at the same time.
+func (b *Bolt) PutRealtimeCheckpoint(ctx context.Context, feedDate string, slot time.Time) error {
+	key := []byte(boltRealtimeSlotsKeyBase + feedDate)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(b.metaBucket())
+
+		var stale [][]byte
+		prefix := []byte(boltRealtimeSlotsKeyBase)
+		c := meta.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if !bytes.Equal(k, key) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range stale {
+			if err := meta.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		var slots []int64
+		if val := meta.Get(key); val != nil {
+			if err := json.Unmarshal(val, &slots); err != nil {
+				return err
+			}
+		}
+
+		for _, existing := range slots {
+			if existing == slot.Unix() {
+				return nil
+			}
+		}
+
+		val, err := json.Marshal(append(slots, slot.Unix()))
+		if err != nil {
+			return err
+		}
+
+		return meta.Put(key, val)
+	})
+}
+
+// GetRealtimeCheckpoints - get the realtime slots merged on top of the feed for the date, oldest first
+func (b *Bolt) GetRealtimeCheckpoints(ctx context.Context, feedDate string) ([]time.Time, error) {
+	var unix []int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(b.metaBucket()).Get([]byte(boltRealtimeSlotsKeyBase + feedDate))
+		if val == nil {
+			return nil
+		}
+
+		return json.Unmarshal(val, &unix)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get realtime checkpoints: %w", err)
+	}
+
+	slots := make([]time.Time, 0, len(unix))
+	for _, u := range unix {
+		slots = append(slots, time.Unix(u, 0).UTC())
+	}
+	sortSlots(slots)
+
+	return slots, nil
+}
+
+// StreamingFeedInsert - insert a streaming feed file download into a new generation. Once the whole feed is loaded the
+// new generation atomically replaces the current one, and the previous generation is deleted in the background.
+func (b *Bolt) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
+	defer rc.Close()
+
+	// Feed donwloads are gzipped, so we need to decompress them
+	gzr, err := gzip.NewReader(rc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzr.Close()
+
+	var previous, gen int64
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(b.metaBucket())
+		previous = b.currentGeneration(tx)
+		seq, err := meta.NextSequence()
+		if err != nil {
+			return err
+		}
+		gen = int64(seq)
+		b.setLoading(gen, true)
+
+		_, err = tx.CreateBucket(b.generationBucket(gen))
+		if err != nil {
+			return err
+		}
+
+		return b.putGenerationInfo(tx, &GenerationInfo{Generation: gen, CreatedAt: time.Now().UTC()})
+	})
+	if err != nil {
+		b.setLoading(gen, false)
+		return 0, fmt.Errorf("failed to allocate generation: %w", err)
+	}
+	slog.Info("loading feed into new generation", "generation", gen, "previous_generation", previous)
+
+	progress := b.start(IngestKindFeed, b.namespace)
+	defer progress.finish()
+
+	count, retained, err := ingest(ctx, gzr, b.concurrency, b.chunkSize, progress, func(ctx context.Context, workerID int, lines <-chan []byte) (int64, int64, error) {
+		return b.processFeedLines(ctx, workerID, gen, previous, lines, progress)
+	})
+	defer b.purgeInBackground()
+	defer b.setLoading(gen, false)
+
+	// The generation was never made current, so the purge removes whatever was loaded
+	if err != nil {
+		return count, fmt.Errorf("failed to load generation %d: %w", gen, err)
+	}
+
+	if count == 0 {
+		return 0, fmt.Errorf("failed to verify generation: generation %d is empty", gen)
+	}
+
+	if err := progress.checkRejects(); err != nil {
+		return count, fmt.Errorf("failed to verify generation: %w", err)
+	}
+
+	// Flip the current generation, bolt transactions are serializable so readers see either the old or new generation
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		info, err := b.generationInfo(tx, gen)
+		if err != nil {
+			return err
+		}
+		info.Count = count
+		info.ActivatedAt = time.Now().UTC()
+
+		if previous != 0 {
+			previousInfo, err := b.generationInfo(tx, previous)
+			if err != nil {
+				return err
+			}
+			// The previous count can be missing or out of date, so never report a negative number removed
+			info.Removed = previousInfo.Count - retained
+			if info.Removed < 0 {
+				info.Removed = 0
+			}
+		}
+
+		err = b.putGenerationInfo(tx, info)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(b.metaBucket()).Put(boltCurrentGenerationKey, []byte(strconv.FormatInt(gen, 10)))
+	})
+	if err != nil {
+		return count, fmt.Errorf("failed to activate generation %d: %w", gen, err)
+	}
+
+	slog.Info("activated generation", "generation", gen, "previous_generation", previous)
+	return count, nil
+}
+
+// processFeedLines - write feed lines into the given generation a chunk per transaction, returning the number of records
+// written and how many of them were also present in the previous generation
+func (b *Bolt) processFeedLines(ctx context.Context, workerID int, generation, previous int64, lines <-chan []byte, progress *ingestProgress) (int64, int64, error) {
+	count := int64(0)
+	retained := int64(0)
+	chunk := make([]*spur.IPContext, 0, b.chunkSize)
+	raw := make([][]byte, 0, b.chunkSize)
+
+	flush := func() error {
+		start := time.Now()
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(b.generationBucket(generation))
+			previousBucket := tx.Bucket(b.generationBucket(previous))
+			for i, record := range chunk {
+				err := bucket.Put([]byte(record.IP), raw[i])
+				if err != nil {
+					return err
+				}
+
+				if previousBucket != nil && previousBucket.Get([]byte(record.IP)) != nil {
+					retained++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error writing chunk: %w", err)
+		}
+
+		progress.wrote(len(chunk), time.Since(start))
+		count += int64(len(chunk))
+		chunk = chunk[:0]
+		raw = raw[:0]
+		return nil
+	}
+
+	for line := range lines {
+		if ctx.Err() != nil {
+			return count, retained, ctx.Err()
+		}
+
+		var record spur.IPContext
+		if err := json.Unmarshal(line, &record); err != nil {
+			progress.reject(workerID, fmt.Sprintf("invalid json: %v", err), line)
+			continue
+		}
+		progress.parsed()
+
+		chunk = append(chunk, &record)
+		raw = append(raw, line)
+		if len(chunk) >= b.chunkSize {
+			if err := flush(); err != nil {
+				return count, retained, err
+			}
+		}
+	}
+	if len(chunk) > 0 {
+		if err := flush(); err != nil {
+			return count, retained, err
+		}
+	}
+
+	return count, retained, nil
+}
+
+// StreamingMergeInsert - insert a streaming realtime update file download into the current generation. This will merge
+// data with existing keys.
+func (b *Bolt) StreamingMergeInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
+	defer rc.Close()
+
+	// Feed donwloads are gzipped, so we need to decompress them
+	gzr, err := gzip.NewReader(rc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzr.Close()
+
+	progress := b.start(IngestKindMerge, b.namespace)
+	defer progress.finish()
+
+	count, _, err := ingest(ctx, gzr, b.concurrency, b.chunkSize, progress, func(ctx context.Context, workerID int, lines <-chan []byte) (int64, int64, error) {
+		processed, err := b.processMergeLines(ctx, workerID, lines, progress)
+		return processed, 0, err
+	})
+	if err != nil {
+		return count, fmt.Errorf("failed to merge: %w", err)
+	}
+
+	return count, nil
+}
+
+// processMergeLines - merge realtime lines into the current generation a chunk per transaction, each transaction reads
+// and writes its records atomically so concurrent merges can't lose updates
+func (b *Bolt) processMergeLines(ctx context.Context, workerID int, lines <-chan []byte, progress *ingestProgress) (int64, error) {
+	count := int64(0)
+	chunk := make([]*spur.IPContext, 0, b.chunkSize)
+
+	flush := func() error {
+		start := time.Now()
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			gen := b.currentGeneration(tx)
+			bucket, err := tx.CreateBucketIfNotExists(b.generationBucket(gen))
+			if err != nil {
+				return err
+			}
+
+			added := int64(0)
+			for _, partial := range chunk {
+				record := partial
+				if val := bucket.Get([]byte(partial.IP)); val != nil {
+					var existing spur.IPContext
+					if err := json.Unmarshal(val, &existing); err != nil {
+						slog.Error("failed to unmarshal json", "worker_id", workerID, "error", err.Error())
+					} else {
+						existing.Merge(partial)
+						record = &existing
+					}
+				} else {
+					added++
+				}
+
+				data, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+
+				err = bucket.Put([]byte(record.IP), data)
+				if err != nil {
+					return err
+				}
+			}
+
+			if gen == 0 || added == 0 {
+				return nil
+			}
+
+			info, err := b.generationInfo(tx, gen)
+			if err != nil {
+				return err
+			}
+			info.Count += added
+			return b.putGenerationInfo(tx, info)
+		})
+		if err != nil {
+			return fmt.Errorf("error merging chunk: %w", err)
+		}
+
+		progress.wrote(len(chunk), time.Since(start))
+		count += int64(len(chunk))
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for line := range lines {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+
+		var record spur.IPContext
+		if err := json.Unmarshal(line, &record); err != nil {
+			progress.reject(workerID, fmt.Sprintf("invalid json: %v", err), line)
+			continue
+		}
+		progress.parsed()
+
+		chunk = append(chunk, &record)
+		if len(chunk) >= b.chunkSize {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if len(chunk) > 0 {
+		if err := flush(); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// purgeInBackground - delete stale generations without blocking the caller
+func (b *Bolt) purgeInBackground() {
+	go func() {
+		err := b.purgeStaleGenerations()
+		if err != nil {
+			slog.Error("failed to purge stale generations", "error", err.Error())
+		}
+	}()
+}
+
+// purgeStaleGenerations - delete every generation bucket other than the current one and any being loaded
+func (b *Bolt) purgeStaleGenerations() error {
+	b.purgeMu.Lock()
+	defer b.purgeMu.Unlock()
+
+	var stale []int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		current := b.currentGeneration(tx)
+		prefix := b.namespace + "g"
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !strings.HasPrefix(string(name), prefix) {
+				return nil
+			}
+
+			gen, err := strconv.ParseInt(string(name[len(prefix):]), 10, 64)
+			if err != nil || gen == current || b.isLoading(gen) {
+				return nil
+			}
+
+			stale = append(stale, gen)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, gen := range stale {
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			err := tx.DeleteBucket(b.generationBucket(gen))
+			if err != nil {
+				return err
+			}
+
+			return tx.Bucket(b.metaBucket()).Delete(boltGenerationMetaKey(gen))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete generation %d: %w", gen, err)
+		}
+
+		slog.Info("purged stale generation", "generation", gen)
+	}
+
+	return nil
+}
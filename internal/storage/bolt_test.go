@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"feedexampleredis/internal/spur"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBolt(t *testing.T) *Bolt {
+	b := NewBolt(filepath.Join(t.TempDir(), "test.db"), 2, 2)
+	require.NoError(t, b.Open())
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestBoltGenerationSwap(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	_, err := b.GetByIP(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+
+	count, err := b.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"first"}`,
+		`{"ip":"2.2.2.2","organization":"first"}`,
+		`{"ip":"3.3.3.3","organization":"first"}`,
+	))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+
+	ipCtx, err := b.GetByIP(ctx, "3.3.3.3")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+
+	// 3.3.3.3 is dropped from the second feed
+	count, err = b.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"second"}`,
+		`{"ip":"2.2.2.2","organization":"second"}`,
+	))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	ipCtx, err = b.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "second", ipCtx.Organization)
+
+	_, err = b.GetByIP(ctx, "3.3.3.3")
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+
+	info, err := b.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Count)
+	assert.Equal(t, int64(1), info.Removed)
+
+	// An empty feed must not replace the current generation
+	_, err = b.StreamingFeedInsert(ctx, gzipLines(`not json`))
+	assert.Error(t, err)
+
+	ipCtx, err = b.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "second", ipCtx.Organization)
+}
+
+func TestBoltRemovedNeverNegative(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	_, err := b.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"first"}`,
+		`{"ip":"2.2.2.2","organization":"first"}`,
+	))
+	require.NoError(t, err)
+
+	// The previous generation's count is lower than the records the next feed keeps from it
+	require.NoError(t, b.db.Update(func(tx *bolt.Tx) error {
+		info, err := b.generationInfo(tx, b.currentGeneration(tx))
+		if err != nil {
+			return err
+		}
+		info.Count = 0
+		return b.putGenerationInfo(tx, info)
+	}))
+
+	_, err = b.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"second"}`,
+		`{"ip":"2.2.2.2","organization":"second"}`,
+	))
+	require.NoError(t, err)
+
+	info, err := b.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Count)
+	assert.Equal(t, int64(0), info.Removed)
+}
+
+func TestBoltMerge(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	_, err := b.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"first","risks":["TUNNEL"]}`))
+	require.NoError(t, err)
+
+	_, err = b.StreamingMergeInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","risks":["CALLBACK_PROXY"]}`,
+		`{"ip":"2.2.2.2","risks":["TUNNEL"]}`,
+	))
+	require.NoError(t, err)
+
+	ipCtx, err := b.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+	assert.Equal(t, []string{"TUNNEL", "CALLBACK_PROXY"}, ipCtx.Risks)
+
+	info, err := b.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Count)
+}
+
+func TestBoltFeedInfo(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	_, err := b.GetLatestFeedInfo(ctx)
+	assert.Error(t, err)
+
+	fi := &spur.FeedInfo{}
+	fi.JSON.Date = "20240102"
+	require.NoError(t, b.PutLatestFeedInfo(ctx, fi))
+
+	got, err := b.GetLatestFeedInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "20240102", got.JSON.Date)
+}
+
+func TestBoltWithNamespace(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	anonymous, err := b.WithNamespace("anonymous:")
+	require.NoError(t, err)
+	ipsummary, err := b.WithNamespace("ipsummary:")
+	require.NoError(t, err)
+
+	_, err = anonymous.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"anonymous"}`))
+	require.NoError(t, err)
+	_, err = ipsummary.StreamingFeedInsert(ctx, gzipLines(`{"ip":"2.2.2.2","organization":"ipsummary"}`))
+	require.NoError(t, err)
+
+	// Loading a second generation into one namespace must not purge the other
+	_, err = anonymous.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"anonymous2"}`))
+	require.NoError(t, err)
+	require.NoError(t, anonymous.purgeStaleGenerations())
+
+	ipCtx, err := anonymous.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous2", ipCtx.Organization)
+
+	ipCtx, err = ipsummary.GetByIP(ctx, "2.2.2.2")
+	require.NoError(t, err)
+	assert.Equal(t, "ipsummary", ipCtx.Organization)
+
+	_, err = ipsummary.GetByIP(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+}
+
+func TestBoltRealtimeCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, b.PutRealtimeCheckpoint(ctx, "20240101", start.Add(-time.Hour)))
+	require.NoError(t, b.PutRealtimeCheckpoint(ctx, "20240102", start.Add(5*time.Minute)))
+	require.NoError(t, b.PutRealtimeCheckpoint(ctx, "20240102", start))
+
+	merged, err := b.GetRealtimeCheckpoints(ctx, "20240102")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{start, start.Add(5 * time.Minute)}, merged)
+
+	// Checkpoints for earlier feeds are dropped
+	merged, err = b.GetRealtimeCheckpoints(ctx, "20240101")
+	require.NoError(t, err)
+	assert.Empty(t, merged)
+}
+
+func TestBoltFeedInsertCancelled(t *testing.T) {
+	b := newTestBolt(t)
+
+	_, err := b.StreamingFeedInsert(context.Background(), gzipLines(`{"ip":"1.1.1.1","organization":"first"}`))
+	require.NoError(t, err)
+
+	// A cancelled load returns the error and leaves the current generation in place
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = b.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"second"}`,
+		`{"ip":"2.2.2.2","organization":"second"}`,
+	))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	ipCtx, err := b.GetByIP(context.Background(), "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrorTooManyRejects - a load rejected more of its lines than the reject policy allows
+var ErrorTooManyRejects = errors.New("too many feed lines rejected")
+
+// DeadLetter - a feed line that couldn't be loaded and why
+type DeadLetter struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	WorkerID int       `json:"worker_id"`
+	Reason   string    `json:"reason"`
+	Line     string    `json:"line"`
+}
+
+// RejectPolicy - what a store does with the lines it can't load. Rejected lines are written to DeadLetters, tagged with
+// Source so they can be reprocessed into the right store, and only logged if it is nil. A full feed load fails without
+// replacing the current data if more than MaxRatio of its lines are rejected, zero disables the check.
+type RejectPolicy struct {
+	DeadLetters *DeadLetterFile
+	Source      string
+	MaxRatio    float64
+}
+
+// DeadLetterFile - appends dead letters to a file as JSON lines. Once the file reaches maxSize it is rotated to path.1,
+// path.1 to path.2 and so on, keeping up to maxFiles rotated files. Another process can claim the files while they are
+// being written to, so the current file is reopened whenever it has been moved.
+type DeadLetterFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// claimedSizes holds how much of each claimed file had been read when it was claimed
+	claimedSizes []int64
+}
+
+// OpenDeadLetterFile - open the dead letter file at path for appending, creating it if it doesn't exist
+func OpenDeadLetterFile(path string, maxSize int64, maxFiles int) (*DeadLetterFile, error) {
+	d := &DeadLetterFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// open - open the current file for appending
+func (d *DeadLetterFile) open() error {
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+
+	d.f = f
+	d.size = info.Size()
+	return nil
+}
+
+// reopen - open the current file again if it has been moved or removed since it was opened
+func (d *DeadLetterFile) reopen() error {
+	current, err := os.Stat(d.path)
+	if err == nil {
+		opened, err := d.f.Stat()
+		if err == nil && os.SameFile(current, opened) {
+			return nil
+		}
+	}
+
+	d.f.Close()
+	return d.open()
+}
+
+// rotatedPath - the path of the nth rotated file
+func (d *DeadLetterFile) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", d.path, n)
+}
+
+// rotate - shift the rotated files along, dropping the oldest, and start a new current file
+func (d *DeadLetterFile) rotate() error {
+	d.f.Close()
+
+	os.Remove(d.rotatedPath(d.maxFiles))
+	for n := d.maxFiles - 1; n >= 1; n-- {
+		os.Rename(d.rotatedPath(n), d.rotatedPath(n+1))
+	}
+
+	if d.maxFiles > 0 {
+		if err := os.Rename(d.path, d.rotatedPath(1)); err != nil {
+			return fmt.Errorf("failed to rotate dead letter file: %w", err)
+		}
+	} else if err := os.Remove(d.path); err != nil {
+		return fmt.Errorf("failed to rotate dead letter file: %w", err)
+	}
+
+	return d.open()
+}
+
+// Write - append a dead letter, rotating the file first if it is full
+func (d *DeadLetterFile) Write(dl DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.write(data)
+}
+
+// write - append lines to the current file, rotating it first if it is full
+func (d *DeadLetterFile) write(data []byte) error {
+	if err := d.reopen(); err != nil {
+		return err
+	}
+
+	if d.maxSize > 0 && d.size > 0 && d.size+int64(len(data)) > d.maxSize {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := d.f.Write(data)
+	d.size += int64(n)
+	return err
+}
+
+// paths - the current and rotated files, oldest first
+func (d *DeadLetterFile) paths() []string {
+	paths := []string{d.path}
+	for n := 1; n <= d.maxFiles; n++ {
+		paths = append([]string{d.rotatedPath(n)}, paths...)
+	}
+	return paths
+}
+
+// claimedPath - the path of the nth file claimed for reprocessing
+func (d *DeadLetterFile) claimedPath(n int) string {
+	return fmt.Sprintf("%s.claimed.%d", d.path, n)
+}
+
+// claimed - the number of claimed files, they are numbered from 1 without gaps
+func (d *DeadLetterFile) claimed() int {
+	n := 0
+	for {
+		if _, err := os.Stat(d.claimedPath(n + 1)); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// Read - read every dead letter from the current and rotated files, oldest first, leaving them in place. Lines in the
+// files that can't be parsed are skipped.
+func (d *DeadLetterFile) Read() ([]DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var letters []DeadLetter
+	for _, path := range d.paths() {
+		read, _, err := readDeadLetters(path, 0)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, read...)
+	}
+	return letters, nil
+}
+
+// Claim - move the current and rotated files aside and start an empty current file, returning every claimed dead
+// letter oldest first. Files claimed by an earlier run that never released them are claimed again ahead of the rest.
+// Dead letters written from then on go to the new current file, and the claimed files stay on disk until Release, so
+// nothing is lost if the process stops before they have been reprocessed. A writer in another process can still append
+// to a claimed file until it notices the move, Release keeps those lines.
+func (d *DeadLetterFile) Claim() ([]DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := d.claimed()
+	d.f.Close()
+	for _, path := range d.paths() {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, d.claimedPath(n+1)); err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to claim dead letter file: %w", err), d.open())
+		}
+		n++
+	}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+
+	var letters []DeadLetter
+	d.claimedSizes = make([]int64, n)
+	for i := 1; i <= n; i++ {
+		read, size, err := readDeadLetters(d.claimedPath(i), 0)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, read...)
+		d.claimedSizes[i-1] = size
+	}
+	return letters, nil
+}
+
+// Release - remove the claimed files once their dead letters have been reprocessed or written back. Lines appended to
+// a claimed file since it was claimed are moved to the current file first.
+func (d *DeadLetterFile) Release() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Newest first, so files left by a failed release are still numbered from 1
+	for n := d.claimed(); n >= 1; n-- {
+		if n <= len(d.claimedSizes) {
+			if err := d.keepAppended(d.claimedPath(n), d.claimedSizes[n-1]); err != nil {
+				return fmt.Errorf("failed to release dead letter file: %w", err)
+			}
+		}
+		if err := os.Remove(d.claimedPath(n)); err != nil {
+			return fmt.Errorf("failed to release dead letter file: %w", err)
+		}
+	}
+	d.claimedSizes = nil
+	return nil
+}
+
+// keepAppended - copy the whole lines after offset in a claimed file to the current file
+func (d *DeadLetterFile) keepAppended(path string, offset int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	// A partial last line is still being written, it can't be parsed either way
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	if len(data) == 0 {
+		return nil
+	}
+	return d.write(data)
+}
+
+// readDeadLetters - read the dead letters in a single file from offset, along with the offset just past the last whole
+// line read. A missing file has none.
+func readDeadLetters(path string, offset int64) ([]DeadLetter, int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, offset, nil
+	}
+	if err != nil {
+		return nil, offset, fmt.Errorf("failed to read dead letter file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, fmt.Errorf("failed to read dead letter file: %w", err)
+	}
+
+	var letters []DeadLetter
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line is still being written
+			return letters, offset, nil
+		}
+		if err != nil {
+			return nil, offset, fmt.Errorf("failed to read dead letter file: %w", err)
+		}
+		offset += int64(len(line))
+
+		var dl DeadLetter
+		if err := json.Unmarshal(line, &dl); err != nil {
+			slog.Warn("skipping unreadable dead letter", "path", path, "error", err.Error())
+			continue
+		}
+		letters = append(letters, dl)
+	}
+}
+
+// Close - close the current file
+func (d *DeadLetterFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Close()
+}
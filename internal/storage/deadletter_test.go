@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rejects.jsonl")
+	d, err := OpenDeadLetterFile(path, 200, 2)
+	require.NoError(t, err)
+	defer d.Close()
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, d.Write(DeadLetter{Source: "anonymous", Reason: "invalid json", Line: strings.Repeat("x", 50)}))
+	}
+	assert.FileExists(t, path+".1")
+	assert.FileExists(t, path+".2")
+	assert.NoFileExists(t, path+".3")
+
+	// Claiming returns everything still kept and moves the files aside until they are released
+	letters, err := d.Claim()
+	require.NoError(t, err)
+	assert.NotEmpty(t, letters)
+	assert.LessOrEqual(t, len(letters), 6)
+	assert.NoFileExists(t, path+".1")
+	assert.FileExists(t, path+".claimed.1")
+
+	require.NoError(t, d.Release())
+	assert.NoFileExists(t, path+".claimed.1")
+
+	letters, err = d.Claim()
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestDeadLetterFileClaim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rejects.jsonl")
+	d, err := OpenDeadLetterFile(path, 0, 0)
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.NoError(t, d.Write(DeadLetter{Source: "anonymous", Line: "first"}))
+	letters, err := d.Claim()
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+
+	// Dead letters written after the claim aren't part of it
+	require.NoError(t, d.Write(DeadLetter{Source: "anonymous", Line: "second"}))
+	letters, err = d.Read()
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, "second", letters[0].Line)
+
+	// Claims that were never released are claimed again, oldest first
+	reopened, err := OpenDeadLetterFile(path, 0, 0)
+	require.NoError(t, err)
+	defer reopened.Close()
+	letters, err = reopened.Claim()
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	assert.Equal(t, "first", letters[0].Line)
+	assert.Equal(t, "second", letters[1].Line)
+
+	require.NoError(t, reopened.Release())
+	letters, err = reopened.Claim()
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestDeadLetterFileClaimWhileWriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rejects.jsonl")
+	writer, err := OpenDeadLetterFile(path, 0, 0)
+	require.NoError(t, err)
+	defer writer.Close()
+	claimer, err := OpenDeadLetterFile(path, 0, 0)
+	require.NoError(t, err)
+	defer claimer.Close()
+
+	require.NoError(t, writer.Write(DeadLetter{Source: "anonymous", Line: "claimed"}))
+	// A write that started before the claim lands in the claimed file
+	stale, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	defer stale.Close()
+
+	letters, err := claimer.Claim()
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+
+	// The writer in the other process moves on to the new current file
+	require.NoError(t, writer.Write(DeadLetter{Source: "anonymous", Line: "reopened"}))
+	data, err := json.Marshal(DeadLetter{Source: "anonymous", Line: "late"})
+	require.NoError(t, err)
+	_, err = stale.Write(append(data, '\n'))
+	require.NoError(t, err)
+
+	require.NoError(t, claimer.Release())
+	letters, err = claimer.Read()
+	require.NoError(t, err)
+	lines := make([]string, 0, len(letters))
+	for _, dl := range letters {
+		lines = append(lines, dl.Line)
+	}
+	assert.ElementsMatch(t, []string{"reopened", "late"}, lines)
+	assert.Zero(t, claimer.claimed())
+}
+
+func TestRedisRejectPolicy(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+	d, err := OpenDeadLetterFile(filepath.Join(t.TempDir(), "rejects.jsonl"), 0, 0)
+	require.NoError(t, err)
+	defer d.Close()
+	r.SetRejectPolicy(RejectPolicy{DeadLetters: d, Source: "anonymous", MaxRatio: 0.3})
+
+	_, err = r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"first"}`,
+		`{"ip":"2.2.2.2","organization":"first"}`,
+		`{"ip":"3.3.3.3","organization":"first"}`,
+		`not json`,
+	))
+	require.NoError(t, err)
+
+	// Half the lines are rejected, so the first feed stays current
+	_, err = r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"second"}`,
+		`{"ip":"2.2.2.2"`,
+		`{"ip":"3.3.3.3","organization":"second"}`,
+		`also not json`,
+	))
+	assert.ErrorIs(t, err, ErrorTooManyRejects)
+
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+
+	letters, err := d.Read()
+	require.NoError(t, err)
+	require.Len(t, letters, 3)
+	assert.Equal(t, "anonymous", letters[0].Source)
+	assert.Equal(t, "not json", letters[0].Line)
+	assert.Contains(t, letters[0].Reason, "invalid json")
+}
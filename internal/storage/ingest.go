@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// lineWorker - process lines from the channel until it is closed, returning the number of records written and how many
+// of them were also in the previous generation. It must stop once ctx is cancelled, and return what it had written
+// along with any error.
+type lineWorker func(ctx context.Context, workerID int, lines <-chan []byte) (int64, int64, error)
+
+// ingest - read the lines of a feed and hand them to concurrency workers. The first error from the reader or any worker
+// cancels the others, and is returned along with the totals of what had been written by then.
+func ingest(ctx context.Context, r io.Reader, concurrency int, chunkSize int, progress *ingestProgress, work lineWorker) (int64, int64, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	lines := make(chan []byte, concurrency*chunkSize)
+
+	g.Go(func() error {
+		defer close(lines)
+		return readLines(ctx, r, lines, progress)
+	})
+
+	var count, retained int64
+	for i := 0; i < concurrency; i++ {
+		workerID := i
+		g.Go(func() error {
+			processed, seen, err := work(ctx, workerID, lines)
+			atomic.AddInt64(&count, processed)
+			atomic.AddInt64(&retained, seen)
+			if err != nil {
+				return fmt.Errorf("worker %d: %w", workerID, err)
+			}
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	return count, retained, err
+}
+
+// readLines - read the lines of a feed onto a channel for the workers, counting them in progress. A read error, such as
+// a truncated download, is returned rather than treated as the end of the feed.
+func readLines(ctx context.Context, r io.Reader, lines chan<- []byte, progress *ingestProgress) error {
+	scanner := bufio.NewScanner(r)
+	buf := make([]byte, 64*1024)   // 64KB buffer
+	scanner.Buffer(buf, 1024*1024) // 1MB maximum token size
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		b := make([]byte, len(line))
+		copy(b, line)
+		progress.linesRead.Add(1)
+
+		select {
+		case lines <- b:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading feed: %w", err)
+	}
+	return nil
+}
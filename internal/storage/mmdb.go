@@ -11,16 +11,17 @@ import (
 	"github.com/maxmind/mmdbwriter"
 	maxminddb "github.com/oschwald/maxminddb-golang"
 	"io"
-	"log/slog"
 	"net"
+	"net/netip"
 	"sync/atomic"
+	"time"
 )
 
-var ErrorIPNotFound = fmt.Errorf("IP not found")
-
 type MMDB struct {
 	mmdb         *atomic.Pointer[maxminddb.Reader]
+	count        atomic.Int64
 	lastFeedInfo *spur.FeedInfo
+	ingestTracker
 }
 
 type ipv6record struct {
@@ -34,6 +35,11 @@ func NewMMDB() *MMDB {
 	}
 }
 
+// Count returns the number of networks in the MMDB being served
+func (m *MMDB) Count() int64 {
+	return m.count.Load()
+}
+
 // GetLastFeedInfo returns the last feed info
 func (m *MMDB) GetLastFeedInfo() *spur.FeedInfo {
 	return m.lastFeedInfo
@@ -44,6 +50,36 @@ func (m *MMDB) SetLastFeedInfo(fi *spur.FeedInfo) {
 	m.lastFeedInfo = fi
 }
 
+// GetLatestFeedInfo returns the info for the feed currently loaded in the MMDB
+func (m *MMDB) GetLatestFeedInfo(ctx context.Context) (*spur.FeedInfo, error) {
+	if m.lastFeedInfo == nil {
+		return nil, fmt.Errorf("no feed loaded")
+	}
+	return m.lastFeedInfo, nil
+}
+
+// PutLatestFeedInfo records the info for the feed currently loaded in the MMDB
+func (m *MMDB) PutLatestFeedInfo(ctx context.Context, fi *spur.FeedInfo) error {
+	m.SetLastFeedInfo(fi)
+	return nil
+}
+
+// GetLatestRealtimeFeedInfo is not supported, there are no realtime IPv6 feeds
+func (m *MMDB) GetLatestRealtimeFeedInfo(ctx context.Context) (*spur.RealtimeFeedInfo, error) {
+	return nil, ErrorNotSupported
+}
+
+// PutLatestRealtimeFeedInfo is not supported, there are no realtime IPv6 feeds
+func (m *MMDB) PutLatestRealtimeFeedInfo(ctx context.Context, fi *spur.RealtimeFeedInfo) error {
+	return ErrorNotSupported
+}
+
+// StreamingMergeInsert is not supported, the MMDB can only be rebuilt from a full feed
+func (m *MMDB) StreamingMergeInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
+	rc.Close()
+	return 0, ErrorNotSupported
+}
+
 // StreamingFeedInsert inserts a feed into the MMDB
 func (m *MMDB) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
 	defer rc.Close()
@@ -67,6 +103,9 @@ func (m *MMDB) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64
 	}
 	defer gzr.Close()
 
+	progress := m.start(IngestKindFeed, "ipv6")
+	defer progress.finish()
+
 	// Read the feed input line by line, each line is a JSON object which can be parsed into a *spur.IPContextV6
 	scanner := bufio.NewScanner(gzr)
 	scanBuf := make([]byte, 64*1024)   // 64KB buffer
@@ -75,27 +114,31 @@ func (m *MMDB) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64
 	for scanner.Scan() {
 		var ipCtx spur.IPContextV6
 		raw := scanner.Bytes()
+		progress.linesRead.Add(1)
 		err := json.Unmarshal(raw, &ipCtx)
 		if err != nil {
-			slog.Warn("error unmarshalling IP context", "error", err.Error())
+			progress.reject(0, fmt.Sprintf("invalid json: %v", err), raw)
 			continue
 		}
 
 		_, network, err := net.ParseCIDR(ipCtx.Network)
 		if err != nil {
-			slog.Warn("error parsing network", "error", err.Error())
+			progress.reject(0, fmt.Sprintf("invalid network: %v", err), raw)
 			continue
 		}
+		progress.parsed()
 
 		// Create a record from the IPContextV6
 		record := ipCtx.ToMMDB()
 
 		// Write the record to the mmdb
+		start := time.Now()
 		err = writer.Insert(network, record)
 		if err != nil {
-			slog.Warn("error inserting record into mmdb", "error", err.Error())
+			progress.reject(0, fmt.Sprintf("mmdb insert failed: %v", err), raw)
 			continue
 		}
+		progress.wrote(1, time.Since(start))
 
 		count++
 	}
@@ -104,6 +147,11 @@ func (m *MMDB) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64
 		return count, err
 	}
 
+	// Keep serving the previous feed if too much of this one was rejected
+	if err := progress.checkRejects(); err != nil {
+		return count, err
+	}
+
 	// Write the mmdb to a byte slice
 	buf := bytes.NewBuffer(nil)
 	_, err = writer.WriteTo(buf)
@@ -119,10 +167,139 @@ func (m *MMDB) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64
 
 	// Swap the reader into the atomic pointer
 	m.mmdb.Store(reader)
+	m.count.Store(count)
 
 	return count, nil
 }
 
+// GetByIP looks up an IP in the MMDB, the network it was found in is set on the returned context
+func (m *MMDB) GetByIP(ctx context.Context, ip string) (*spur.IPContext, error) {
+	record, err := m.Get(ip)
+	if err != nil {
+		return nil, err
+	}
+	return record.ToIPContext(), nil
+}
+
+// GetByIPs looks up many IPs in the MMDB, the result at each index is nil if that IP isn't in it
+func (m *MMDB) GetByIPs(ctx context.Context, ips []string) ([]*spur.IPContext, error) {
+	records := make([]*spur.IPContext, len(ips))
+	for i, ip := range ips {
+		record, err := m.Get(ip)
+		if err == ErrorIPNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records[i] = record.ToIPContext()
+	}
+	return records, nil
+}
+
+// FindNetwork pages through the networks in the MMDB that are within network, or the one network containing it. The
+// cursor is the last network already returned, start with an empty cursor and carry on with the returned one until it
+// is empty. Each page picks the search up after the cursor instead of walking past the networks before it.
+func (m *MMDB) FindNetwork(ctx context.Context, network *net.IPNet, cursor string, count int64) ([]*spur.IPContext, string, error) {
+	requested, err := ipNetPrefix(network, len(network.IP)*8)
+	if err != nil {
+		return nil, "", err
+	}
+	start, end := requested.Addr(), lastAddress(requested)
+
+	if cursor != "" {
+		after, err := netip.ParsePrefix(cursor)
+		if err != nil || after.Addr().BitLen() != start.BitLen() || !requested.Contains(after.Addr()) {
+			return nil, "", fmt.Errorf("%w %q", ErrorInvalidCursor, cursor)
+		}
+		last := lastAddress(after)
+		if last.Compare(end) >= 0 {
+			return nil, "", nil
+		}
+		start = last.Next()
+	}
+
+	db := m.mmdb.Load()
+	if db == nil {
+		return nil, "", nil
+	}
+
+	var records []*spur.IPContext
+	var last netip.Prefix
+	for _, within := range rangePrefixes(start, end) {
+		networks := db.NetworksWithin(&net.IPNet{IP: within.Addr().AsSlice(), Mask: net.CIDRMask(within.Bits(), within.Addr().BitLen())}, maxminddb.SkipAliasedNetworks)
+		for networks.Next() {
+			if int64(len(records)) == count {
+				return records, last.String(), nil
+			}
+
+			var record spur.IPContextV6
+			found, err := networks.Network(&record)
+			if err != nil {
+				return nil, "", fmt.Errorf("unable to read network: %w", err)
+			}
+			if last, err = ipNetPrefix(found, start.BitLen()); err != nil {
+				return nil, "", err
+			}
+			records = append(records, record.ToIPContext())
+		}
+		if err := networks.Err(); err != nil {
+			return nil, "", fmt.Errorf("unable to find networks: %w", err)
+		}
+	}
+
+	return records, "", nil
+}
+
+// ipNetPrefix converts a network to a prefix of the given address length, IPv4 networks found in the IPv4 subtree of an
+// IPv6 MMDB are moved back under ::/96
+func ipNetPrefix(network *net.IPNet, bits int) (netip.Prefix, error) {
+	ip := network.IP
+	ones, _ := network.Mask.Size()
+	if len(ip) == net.IPv4len && bits == 8*net.IPv6len {
+		ip = append(make(net.IP, net.IPv6len-net.IPv4len), ip...)
+		ones += 96
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || addr.BitLen() != bits {
+		return netip.Prefix{}, fmt.Errorf("invalid network: %s", network)
+	}
+	return netip.PrefixFrom(addr, ones).Masked(), nil
+}
+
+// lastAddress is the last address in a prefix
+func lastAddress(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(addr)*8; bit++ {
+		addr[bit/8] |= 1 << (7 - bit%8)
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
+
+// rangePrefixes is the fewest prefixes covering every address from start to end, in order
+func rangePrefixes(start, end netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		prefix := netip.PrefixFrom(start, start.BitLen())
+		for bits := start.BitLen() - 1; bits >= 0; bits-- {
+			wider := netip.PrefixFrom(start, bits)
+			if wider.Masked().Addr() != start || lastAddress(wider).Compare(end) > 0 {
+				break
+			}
+			prefix = wider
+		}
+		prefixes = append(prefixes, prefix)
+
+		last := lastAddress(prefix)
+		if last.Compare(end) >= 0 {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
 // Get looks up an IP in the MMDB
 func (m *MMDB) Get(ip string) (*spur.IPContextV6, error) {
 	netIP := net.ParseIP(ip)
@@ -136,6 +313,9 @@ func (m *MMDB) Get(ip string) (*spur.IPContextV6, error) {
 func (m *MMDB) GetIP(ip net.IP) (*spur.IPContextV6, error) {
 	var record spur.IPContextV6
 	db := m.mmdb.Load()
+	if db == nil {
+		return nil, ErrorIPNotFound
+	}
 	err := db.Lookup(ip, &record)
 	if err != nil {
 		return nil, fmt.Errorf("unable to lookup IP: %w", err)
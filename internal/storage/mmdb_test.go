@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net"
+	"net/netip"
 	"testing"
 )
 
@@ -262,3 +263,65 @@ func TestNetworks(t *testing.T) {
 	t.Log(innerIPs)
 	assert.Equal(t, expected, innerIPs)
 }
+
+func TestMMDBFindNetwork(t *testing.T) {
+	ctx := context.Background()
+	mmdb := NewMMDB()
+
+	_, err := mmdb.StreamingFeedInsert(ctx, createReadCloser())
+	assert.Nil(t, err)
+
+	_, all, _ := net.ParseCIDR("::/0")
+	first, cursor, err := mmdb.FindNetwork(ctx, all, "", 1)
+	assert.Nil(t, err)
+	assert.Len(t, first, 1)
+	assert.Equal(t, "2001:1890:1aec:3000::/56", first[0].Network)
+	assert.Equal(t, "2001:1890:1aec:3000::/56", cursor)
+
+	second, cursor, err := mmdb.FindNetwork(ctx, all, cursor, 1)
+	assert.Nil(t, err)
+	assert.Len(t, second, 1)
+	assert.Equal(t, "2a02:26f7:d198:e068::/64", second[0].Network)
+	assert.Equal(t, "ICLOUD_RELAY_PROXY", second[0].Tunnels[0].Operator)
+	assert.Equal(t, "", cursor)
+
+	// A network within a record finds the record containing it
+	_, inner, _ := net.ParseCIDR("2001:1890:1aec:3000::/120")
+	records, cursor, err := mmdb.FindNetwork(ctx, inner, "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "2001:1890:1aec:3000::/56", records[0].Network)
+	assert.Equal(t, "", cursor)
+
+	// A cursor carries on after its network within the network searched
+	_, upper, _ := net.ParseCIDR("2000::/3")
+	records, cursor, err = mmdb.FindNetwork(ctx, upper, "2001:1890:1aec:3000::/56", 10)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "2a02:26f7:d198:e068::/64", records[0].Network)
+	assert.Equal(t, "", cursor)
+
+	records, cursor, err = mmdb.FindNetwork(ctx, upper, "2a02:26f7:d198:e068::/64", 10)
+	assert.Nil(t, err)
+	assert.Len(t, records, 0)
+	assert.Equal(t, "", cursor)
+
+	_, _, err = mmdb.FindNetwork(ctx, all, "bogus", 10)
+	assert.ErrorIs(t, err, ErrorInvalidCursor)
+	_, _, err = mmdb.FindNetwork(ctx, upper, "4000::/64", 10)
+	assert.ErrorIs(t, err, ErrorInvalidCursor)
+	_, _, err = mmdb.FindNetwork(ctx, upper, "10.0.0.0/8", 10)
+	assert.ErrorIs(t, err, ErrorInvalidCursor)
+}
+
+func TestRangePrefixes(t *testing.T) {
+	prefixes := rangePrefixes(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.255"))
+	var got []string
+	for _, prefix := range prefixes {
+		got = append(got, prefix.String())
+	}
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/29", "10.0.0.16/28", "10.0.0.32/27", "10.0.0.64/26", "10.0.0.128/25"}, got)
+
+	prefixes = rangePrefixes(netip.MustParseAddr("::"), netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("::/0")}, prefixes)
+}
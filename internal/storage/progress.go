@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// ingestProgressInterval - how often a running load logs its progress
+const ingestProgressInterval = 30 * time.Second
+
+// Kinds of load reported in IngestStatus
+const (
+	IngestKindFeed  = "feed"
+	IngestKindMerge = "merge"
+)
+
+// IngestStatus - a snapshot of the progress of a load, either the one running or the last one to finish
+type IngestStatus struct {
+	Kind       string     `json:"kind"`
+	Running    bool       `json:"running"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	LinesRead      int64 `json:"lines_read"`
+	LinesParsed    int64 `json:"lines_parsed"`
+	ParseFailures  int64 `json:"parse_failures"`
+	RecordsWritten int64 `json:"records_written"`
+
+	// Batches is the number of pipelines or transactions written, with their average and slowest latency
+	Batches           int64   `json:"batches"`
+	AvgBatchLatencyMS float64 `json:"avg_batch_latency_ms"`
+	MaxBatchLatencyMS float64 `json:"max_batch_latency_ms"`
+	RecordsPerSecond  float64 `json:"records_per_second"`
+	ElapsedSeconds    float64 `json:"elapsed_seconds"`
+}
+
+// ingestProgress - counters updated by the workers of a single load
+type ingestProgress struct {
+	kind       string
+	name       string
+	startedAt  time.Time
+	finishedAt atomic.Pointer[time.Time]
+
+	linesRead      atomic.Int64
+	linesParsed    atomic.Int64
+	parseFailures  atomic.Int64
+	recordsWritten atomic.Int64
+	batches        atomic.Int64
+	batchNanos     atomic.Int64
+	maxBatchNanos  atomic.Int64
+
+	rejects RejectPolicy
+	done    chan struct{}
+}
+
+// parsed - count a line that was parsed
+func (p *ingestProgress) parsed() {
+	p.linesParsed.Add(1)
+}
+
+// reject - count a line that couldn't be loaded and dead-letter it
+func (p *ingestProgress) reject(workerID int, reason string, line []byte) {
+	p.parseFailures.Add(1)
+	slog.Error("rejected feed line", "worker_id", workerID, "source", p.rejects.Source, "reason", reason)
+	if p.rejects.DeadLetters == nil {
+		return
+	}
+
+	err := p.rejects.DeadLetters.Write(DeadLetter{
+		Time:     time.Now().UTC(),
+		Source:   p.rejects.Source,
+		WorkerID: workerID,
+		Reason:   reason,
+		Line:     string(line),
+	})
+	if err != nil {
+		slog.Error("failed to write dead letter", "error", err.Error())
+	}
+}
+
+// checkRejects - fail the load if it rejected more of its lines than the reject policy allows
+func (p *ingestProgress) checkRejects() error {
+	read, rejected := p.linesRead.Load(), p.parseFailures.Load()
+	if p.rejects.MaxRatio <= 0 || read == 0 {
+		return nil
+	}
+
+	if ratio := float64(rejected) / float64(read); ratio > p.rejects.MaxRatio {
+		return fmt.Errorf("%w: %d of %d lines (%.4f, maximum %.4f)", ErrorTooManyRejects, rejected, read, ratio, p.rejects.MaxRatio)
+	}
+	return nil
+}
+
+// wrote - count a batch of records written and how long the write took
+func (p *ingestProgress) wrote(records int, took time.Duration) {
+	p.recordsWritten.Add(int64(records))
+	p.batches.Add(1)
+	p.batchNanos.Add(int64(took))
+	for {
+		max := p.maxBatchNanos.Load()
+		if int64(took) <= max || p.maxBatchNanos.CompareAndSwap(max, int64(took)) {
+			return
+		}
+	}
+}
+
+// status - a snapshot of the counters
+func (p *ingestProgress) status(now time.Time) IngestStatus {
+	s := IngestStatus{
+		Kind:           p.kind,
+		Running:        true,
+		StartedAt:      p.startedAt,
+		LinesRead:      p.linesRead.Load(),
+		LinesParsed:    p.linesParsed.Load(),
+		ParseFailures:  p.parseFailures.Load(),
+		RecordsWritten: p.recordsWritten.Load(),
+		Batches:        p.batches.Load(),
+	}
+
+	if finishedAt := p.finishedAt.Load(); finishedAt != nil {
+		s.Running = false
+		s.FinishedAt = finishedAt
+		now = *finishedAt
+	}
+
+	elapsed := now.Sub(p.startedAt)
+	s.ElapsedSeconds = elapsed.Seconds()
+	if elapsed > 0 {
+		s.RecordsPerSecond = float64(s.RecordsWritten) / elapsed.Seconds()
+	}
+	if s.Batches > 0 {
+		s.AvgBatchLatencyMS = float64(p.batchNanos.Load()) / float64(s.Batches) / float64(time.Millisecond)
+	}
+	s.MaxBatchLatencyMS = float64(p.maxBatchNanos.Load()) / float64(time.Millisecond)
+
+	return s
+}
+
+// log - log a snapshot of the counters
+func (p *ingestProgress) log(msg string) {
+	s := p.status(time.Now())
+	slog.Info(
+		msg,
+		slog.String("kind", s.Kind),
+		slog.String("store", p.name),
+		slog.Int64("lines_read", s.LinesRead),
+		slog.Int64("lines_parsed", s.LinesParsed),
+		slog.Int64("parse_failures", s.ParseFailures),
+		slog.Int64("records_written", s.RecordsWritten),
+		slog.Int64("batches", s.Batches),
+		slog.String("avg_batch_latency", time.Duration(s.AvgBatchLatencyMS*float64(time.Millisecond)).String()),
+		slog.String("max_batch_latency", time.Duration(s.MaxBatchLatencyMS*float64(time.Millisecond)).String()),
+		slog.Int64("records_per_second", int64(s.RecordsPerSecond)),
+		slog.String("elapsed", time.Duration(s.ElapsedSeconds*float64(time.Second)).Round(time.Second).String()),
+	)
+}
+
+// finish - mark the load done, stop the log reporter and log the totals
+func (p *ingestProgress) finish() {
+	now := time.Now().UTC()
+	p.finishedAt.Store(&now)
+	close(p.done)
+	p.log("ingest finished")
+}
+
+// report - log progress every ingestProgressInterval until the load finishes
+func (p *ingestProgress) report() {
+	ticker := time.NewTicker(ingestProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.log("ingest progress")
+		}
+	}
+}
+
+// ingestTracker - the load running in a store, or the last one to finish, and what to do with the lines it rejects.
+// Embedded in the stores that report progress.
+type ingestTracker struct {
+	current atomic.Pointer[ingestProgress]
+	rejects RejectPolicy
+}
+
+// SetRejectPolicy - set what happens to the lines later loads reject
+func (t *ingestTracker) SetRejectPolicy(policy RejectPolicy) {
+	t.rejects = policy
+}
+
+// start - begin tracking a new load and start logging its progress. The caller must call finish on the returned
+// progress once the load is done.
+func (t *ingestTracker) start(kind string, name string) *ingestProgress {
+	p := &ingestProgress{kind: kind, name: name, startedAt: time.Now().UTC(), rejects: t.rejects, done: make(chan struct{})}
+	t.current.Store(p)
+	go p.report()
+	return p
+}
+
+// IngestStatus - the load currently running, or the last one to finish
+func (t *ingestTracker) IngestStatus() (IngestStatus, bool) {
+	p := t.current.Load()
+	if p == nil {
+		return IngestStatus{}, false
+	}
+	return p.status(time.Now()), true
+}
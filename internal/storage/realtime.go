@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"feedexampleredis/internal/spur"
+)
+
+// realtimeCheckpointTTL - how long the merged realtime slots for a feed date are kept, a feed is replaced daily
+const realtimeCheckpointTTL = 48 * time.Hour
+
+// RealtimeSlot - the start of the realtime slot a time falls in
+func RealtimeSlot(t time.Time) time.Time {
+	return t.UTC().Truncate(spur.RealtimeInterval)
+}
+
+// RealtimeSlots - the start of every realtime slot from 00:00 UTC on the feed date that is due by now, oldest first. A
+// slot is due once its window has closed and another interval has passed for its file to be published.
+func RealtimeSlots(feedDate string, now time.Time) ([]time.Time, error) {
+	start, err := time.Parse("20060102", feedDate)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing feed date: %w", err)
+	}
+
+	var slots []time.Time
+	last := RealtimeSlot(now.Add(-2 * spur.RealtimeInterval))
+	for slot := RealtimeSlot(start); !slot.After(last); slot = slot.Add(spur.RealtimeInterval) {
+		slots = append(slots, slot)
+	}
+
+	return slots, nil
+}
+
+// RealtimeGaps - the realtime slots for the feed date that are due by now but haven't been merged, oldest first. Every
+// due slot is a gap for stores that don't keep checkpoints.
+func RealtimeGaps(ctx context.Context, store Store, feedDate string, now time.Time) ([]time.Time, error) {
+	slots, err := RealtimeSlots(feedDate, now)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpointer, ok := store.(RealtimeCheckpointer)
+	if !ok {
+		return slots, nil
+	}
+
+	merged, err := checkpointer.GetRealtimeCheckpoints(ctx, feedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(map[int64]bool, len(merged))
+	for _, slot := range merged {
+		done[slot.Unix()] = true
+	}
+
+	gaps := make([]time.Time, 0)
+	for _, slot := range slots {
+		if !done[slot.Unix()] {
+			gaps = append(gaps, slot)
+		}
+	}
+
+	return gaps, nil
+}
+
+// sortSlots - sort realtime slots oldest first
+func sortSlots(slots []time.Time) {
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Before(slots[j]) })
+}
@@ -1,14 +1,15 @@
 package storage
 
 import (
-	"bufio"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,58 +17,251 @@ import (
 	"feedexampleredis/internal/spur"
 
 	"github.com/go-redis/redis/v8"
-	jsoniter "github.com/json-iterator/go"
 )
 
+// RedisOptions - how to connect to Redis and how to load data into it. Set ClusterAddrs to connect to a Redis Cluster,
+// or SentinelMasterName and SentinelAddrs to connect to a Sentinel-managed master, otherwise Addr is used.
+type RedisOptions struct {
+	Addr               string
+	Username           string
+	Password           string
+	DB                 int
+	SentinelMasterName string
+	SentinelAddrs      []string
+	SentinelPassword   string
+	ClusterAddrs       []string
+
+	// TLS is used when TLSEnabled is set, TLSCAFile adds a private CA to verify the server with and TLSCertFile and
+	// TLSKeyFile provide a client certificate
+	TLSEnabled    bool
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+
+	// Connection pool settings, zero values use the go-redis defaults
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// KeyPrefix is prepended to every key written
+	KeyPrefix string
+
+	// AtomicMerge makes realtime merges safe against other processes updating the same records at the same time, at
+	// the cost of a script call per record
+	AtomicMerge bool
+
+	// Layout is how records are stored in new generations, LayoutString by default or LayoutHash. Encoding is how
+	// LayoutString records are encoded, EncodingJSON by default.
+	Layout   string
+	Encoding string
+
+	// Indexes keeps secondary indexes of the records in new generations, so IPs can be found by their attributes
+	Indexes bool
+	// NetworkIndex keeps a sorted set of the IPv4 addresses in new generations, so records can be found by network
+	NetworkIndex bool
+
+	TTL         time.Duration
+	Concurrency int
+	ChunkSize   int
+}
+
+// tlsConfig - build the TLS config for the connection, nil if TLS is disabled
+func (o RedisOptions) tlsConfig() (*tls.Config, error) {
+	if !o.TLSEnabled {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: o.TLSServerName,
+	}
+
+	if o.TLSCAFile != "" {
+		pem, err := os.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.TLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.TLSCertFile != "" || o.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
 type Redis struct {
-	addr        string
-	password    string
-	db          int
+	opts        RedisOptions
 	ttl         time.Duration
 	concurrency int
 	chunkSize   int
-	client      *redis.Client
+	keys        keyspace
+	legacyKeys  keyspace
+	client      redis.UniversalClient
+	purgeMu     sync.Mutex
+	formats     sync.Map
+	strings     sync.Map
+	ingestTracker
 }
 
 // NewRedis - create a new Redis storage object
-func NewRedis(addr, password string, db int, ttl time.Duration, concurrency int, chunkSize int) *Redis {
+func NewRedis(opts RedisOptions) *Redis {
 	return &Redis{
-		addr:        addr,
-		password:    password,
-		db:          db,
-		ttl:         ttl,
-		concurrency: concurrency,
-		chunkSize:   chunkSize,
+		opts:        opts,
+		keys:        keyspace{prefix: opts.KeyPrefix},
+		ttl:         opts.TTL,
+		concurrency: opts.Concurrency,
+		chunkSize:   opts.ChunkSize,
 	}
 }
 
-// Connect - connect to the Redis server
+// Connect - connect to the Redis server, sentinel master or cluster and check that it is reachable
 func (r *Redis) Connect() error {
-	r.client = redis.NewClient(&redis.Options{
-		Addr:     r.addr,
-		Password: r.password,
-		DB:       r.db,
-	})
+	tlsConfig, err := r.opts.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(r.opts.ClusterAddrs) > 0:
+		r.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        r.opts.ClusterAddrs,
+			Username:     r.opts.Username,
+			Password:     r.opts.Password,
+			TLSConfig:    tlsConfig,
+			PoolSize:     r.opts.PoolSize,
+			DialTimeout:  r.opts.DialTimeout,
+			ReadTimeout:  r.opts.ReadTimeout,
+			WriteTimeout: r.opts.WriteTimeout,
+		})
+	case r.opts.SentinelMasterName != "":
+		r.client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       r.opts.SentinelMasterName,
+			SentinelAddrs:    r.opts.SentinelAddrs,
+			SentinelPassword: r.opts.SentinelPassword,
+			Username:         r.opts.Username,
+			Password:         r.opts.Password,
+			DB:               r.opts.DB,
+			TLSConfig:        tlsConfig,
+			PoolSize:         r.opts.PoolSize,
+			DialTimeout:      r.opts.DialTimeout,
+			ReadTimeout:      r.opts.ReadTimeout,
+			WriteTimeout:     r.opts.WriteTimeout,
+		})
+	default:
+		r.client = redis.NewClient(&redis.Options{
+			Addr:         r.opts.Addr,
+			Username:     r.opts.Username,
+			Password:     r.opts.Password,
+			DB:           r.opts.DB,
+			TLSConfig:    tlsConfig,
+			PoolSize:     r.opts.PoolSize,
+			DialTimeout:  r.opts.DialTimeout,
+			ReadTimeout:  r.opts.ReadTimeout,
+			WriteTimeout: r.opts.WriteTimeout,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = r.client.Ping(ctx).Err()
+	if err != nil {
+		r.client.Close()
+		return fmt.Errorf("failed to ping redis: %w", err)
+	}
+
 	return nil
 }
 
+// WithNamespace - a store sharing this store's connection with its keys under an additional namespace, so several feeds
+// can be kept in the same database. Records written through it expire after ttl. Only the parent store should be closed.
+// Its MigrateUnprefixedKeys moves the keys kept directly under this store's prefix into the namespace.
+func (r *Redis) WithNamespace(namespace string, ttl time.Duration) *Redis {
+	keys := keyspace{prefix: r.keys.prefix + namespace}
+	return &Redis{
+		opts:        r.opts,
+		keys:        keys,
+		legacyKeys:  r.keys,
+		ttl:         ttl,
+		concurrency: r.concurrency,
+		chunkSize:   r.chunkSize,
+		client:      r.client,
+	}
+}
+
+// AddHook - add a hook to the client, e.g. to instrument its commands. Namespaced copies share the client and its
+// hooks, call it once after Connect.
+func (r *Redis) AddHook(hook redis.Hook) {
+	r.client.AddHook(hook)
+}
+
+// Ping - check that the Redis server can be reached
+func (r *Redis) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return r.client.Ping(ctx).Err()
+}
+
 // Close - close the connection to the Redis server
 func (r *Redis) Close() error {
 	return r.client.Close()
 }
 
-// GetByIP - get an IP context from Redis where the IP is the key
+// GetByIP - get an IP context from the current generation in Redis where the IP is the key
 func (r *Redis) GetByIP(ctx context.Context, ip string) (*spur.IPContext, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	val, err := r.client.Get(ctx, ip).Result()
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := r.generationFormat(ctx, gen)
+	if err != nil {
+		return nil, err
+	}
+
+	if format.layout == LayoutHash {
+		fields, err := r.client.HGetAll(ctx, r.keys.record(gen, ip)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, ErrorIPNotFound
+		}
+		return recordFromFields(fields)
+	}
+
+	val, err := r.client.Get(ctx, r.keys.record(gen, ip)).Result()
+	if err == redis.Nil {
+		return nil, ErrorIPNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := r.codec(format).decode(ctx, []byte(val))
 	if err != nil {
 		return nil, err
 	}
 
 	var ipctx spur.IPContext
-	err = json.Unmarshal([]byte(val), &ipctx)
+	err = json.Unmarshal(data, &ipctx)
 	if err != nil {
 		return nil, err
 	}
@@ -75,12 +269,94 @@ func (r *Redis) GetByIP(ctx context.Context, ip string) (*spur.IPContext, error)
 	return &ipctx, nil
 }
 
+// GetByIPs - get the IP contexts for many IPs from the current generation with a single MGET, or a single pipeline of
+// HGETALLs for the hash layout. The result at each index is nil if that IP isn't in Redis.
+func (r *Redis) GetByIPs(ctx context.Context, ips []string) ([]*spur.IPContext, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if len(ips) == 0 {
+		return []*spur.IPContext{}, nil
+	}
+
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := r.generationFormat(ctx, gen)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.getRecords(ctx, gen, format, ips)
+}
+
+// getRecords - read the records for many IPs from a generation in the given format, the result at each index is nil if
+// that IP isn't in it
+func (r *Redis) getRecords(ctx context.Context, generation int64, format recordFormat, ips []string) ([]*spur.IPContext, error) {
+	records := make([]*spur.IPContext, len(ips))
+	keys := make([]string, len(ips))
+	for i, ip := range ips {
+		keys[i] = r.keys.record(generation, ip)
+	}
+
+	if format.layout == LayoutHash {
+		pipe := r.client.Pipeline()
+		reads := make([]*redis.StringStringMapCmd, len(keys))
+		for i, key := range keys {
+			reads[i] = pipe.HGetAll(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+
+		for i, read := range reads {
+			if len(read.Val()) == 0 {
+				continue
+			}
+			record, err := recordFromFields(read.Val())
+			if err != nil {
+				return nil, err
+			}
+			records[i] = record
+		}
+		return records, nil
+	}
+
+	values, err := mget(ctx, r.client, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := r.codec(format)
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		data, err := codec.decode(ctx, []byte(s))
+		if err != nil {
+			return nil, err
+		}
+
+		var ipctx spur.IPContext
+		if err := json.Unmarshal(data, &ipctx); err != nil {
+			return nil, err
+		}
+		records[i] = &ipctx
+	}
+
+	return records, nil
+}
+
 // LatestFeedInfo - get the latest feed info from Redis
 func (r *Redis) GetLatestFeedInfo(ctx context.Context) (*spur.FeedInfo, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	val, err := r.client.Get(ctx, "feed_info").Result()
+	val, err := r.client.Get(ctx, r.keys.feedInfo()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +380,7 @@ func (r *Redis) PutLatestFeedInfo(ctx context.Context, fi *spur.FeedInfo) error
 		return err
 	}
 
-	err = r.client.Set(ctx, "feed_info", val, 0).Err()
+	err = r.client.Set(ctx, r.keys.feedInfo(), val, 0).Err()
 	if err != nil {
 		return err
 	}
@@ -117,7 +393,7 @@ func (r *Redis) GetLatestRealtimeFeedInfo(ctx context.Context) (*spur.RealtimeFe
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	val, err := r.client.Get(ctx, "realtime_feed_info").Result()
+	val, err := r.client.Get(ctx, r.keys.realtimeFeedInfo()).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +417,7 @@ func (r *Redis) PutLatestRealtimeFeedInfo(ctx context.Context, fi *spur.Realtime
 		return err
 	}
 
-	err = r.client.Set(ctx, "realtime_feed_info", val, 0).Err()
+	err = r.client.Set(ctx, r.keys.realtimeFeedInfo(), val, 0).Err()
 	if err != nil {
 		return err
 	}
@@ -149,7 +425,9 @@ func (r *Redis) PutLatestRealtimeFeedInfo(ctx context.Context, fi *spur.Realtime
 	return nil
 }
 
-// StreamingFeedInsert - insert a streaming feed file download into Redis using a pipeline. This will overwrite any existing keys with the new data.
+// StreamingFeedInsert - insert a streaming feed file download into a new generation in Redis using a pipeline. Once the
+// whole feed is loaded and verified the new generation atomically replaces the current one, and the previous generation
+// is deleted in the background.
 func (r *Redis) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
 	defer rc.Close()
 
@@ -160,28 +438,61 @@ func (r *Redis) StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int6
 	}
 	defer gzr.Close()
 
-	var wg sync.WaitGroup
-	lines := readLines(ctx, gzr, r.concurrency, r.chunkSize)
-	var count int64
-	for i := 0; i < r.concurrency; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			ctx := context.Background()
-			processed, err := processFeedLines(ctx, r.chunkSize, r.ttl, workerID, lines, r.client)
-			if err != nil {
-				slog.Error("failed to process feed lines", "error", err.Error())
-				return
-			}
-			atomic.AddInt64(&count, processed)
-		}(i)
+	previous, err := r.currentGeneration(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	gen, format, err := r.newGeneration(ctx)
+	if err != nil {
+		return 0, err
 	}
+	slog.Info("loading feed into new generation", "generation", gen, "previous_generation", previous)
+
+	progress := r.start(IngestKindFeed, r.keys.prefix)
+	defer progress.finish()
 
-	wg.Wait()
+	codec := r.codec(format)
+	var sample atomic.Value
+	count, retained, err := ingest(ctx, gzr, r.concurrency, r.chunkSize, progress, func(ctx context.Context, workerID int, lines <-chan []byte) (int64, int64, error) {
+		return processFeedLines(ctx, r.chunkSize, r.ttl, codec, workerID, r.keys, gen, previous, &sample, lines, r.client, progress)
+	})
+	if err != nil {
+		// The load may have been cancelled, the half-loaded generation still has to be cleaned up
+		r.retireGeneration(context.WithoutCancel(ctx), gen)
+		r.purgeRetiredGenerationsInBackground()
+		return count, fmt.Errorf("failed to load generation %d: %w", gen, err)
+	}
+
+	sampleIP, _ := sample.Load().(string)
+	err = progress.checkRejects()
+	if err == nil {
+		err = r.verifyGeneration(ctx, gen, count, sampleIP)
+	}
+	if err != nil {
+		r.retireGeneration(ctx, gen)
+		r.purgeRetiredGenerationsInBackground()
+		return count, fmt.Errorf("failed to verify generation: %w", err)
+	}
+
+	err = r.recordRemoved(ctx, previous, gen, retained)
+	if err != nil {
+		slog.Warn("failed to record removed count", "generation", gen, "error", err.Error())
+	}
+
+	err = r.activateGeneration(ctx, previous, gen)
+	if err != nil {
+		r.retireGeneration(ctx, gen)
+		r.purgeRetiredGenerationsInBackground()
+		return count, err
+	}
+
+	r.purgeRetiredGenerationsInBackground()
 	return count, nil
 }
 
-// StreamingMergeInsert - insert a streaming realtime update file download into Redis using a pipeline. This will merge data with existing keys.
+// StreamingMergeInsert - insert a streaming realtime update file download into the current generation in Redis using a
+// pipeline. This will merge data with existing keys.
 func (r *Redis) StreamingMergeInsert(ctx context.Context, rc io.ReadCloser) (int64, error) {
 	defer rc.Close()
 
@@ -192,177 +503,136 @@ func (r *Redis) StreamingMergeInsert(ctx context.Context, rc io.ReadCloser) (int
 	}
 	defer gzr.Close()
 
-	var wg sync.WaitGroup
-	lines := readLines(ctx, gzr, r.concurrency, r.chunkSize)
-	var count int64
-	for i := 0; i < r.concurrency; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			ctx := context.Background()
-			processed, err := processMergeLines(ctx, r.chunkSize, r.ttl, workerID, lines, r.client)
-			if err != nil {
-				slog.Error("failed to process feed lines", "error", err.Error())
-				return
-			}
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-			atomic.AddInt64(&count, processed)
-		}(i)
+	format, err := r.generationFormat(ctx, gen)
+	if err != nil {
+		return 0, err
 	}
 
-	wg.Wait()
-	return count, nil
-}
+	target := mergeTarget{rdb: r.client, ks: r.keys, generation: gen, ttl: r.ttl, atomic: r.opts.AtomicMerge, codec: r.codec(format)}
+	if target.atomic {
+		err = target.script().Load(ctx, r.client).Err()
+		if err != nil {
+			return 0, fmt.Errorf("failed to load merge script: %w", err)
+		}
+	}
 
-func readLines(ctx context.Context, r io.Reader, concurrency int, chunkSize int) <-chan []byte {
-	lines := make(chan []byte, concurrency*chunkSize)
-	go func() {
-		defer close(lines)
-		scanner := bufio.NewScanner(r)
-		buf := make([]byte, 64*1024)   // 64KB buffer
-		scanner.Buffer(buf, 1024*1024) // 1MB maximum token size
-		for scanner.Scan() {
-			if ctx.Err() != nil {
-				return
-			}
+	progress := r.start(IngestKindMerge, r.keys.prefix)
+	defer progress.finish()
 
-			line := scanner.Bytes()
-			b := make([]byte, len(line))
-			copy(b, line)
-			lines <- b
-		}
+	count, _, err := ingest(ctx, gzr, r.concurrency, r.chunkSize, progress, func(ctx context.Context, workerID int, lines <-chan []byte) (int64, int64, error) {
+		processed, err := target.processMergeLines(ctx, r.chunkSize, workerID, lines, progress)
+		return processed, 0, err
+	})
+	if err != nil {
+		return count, fmt.Errorf("failed to merge into generation %d: %w", gen, err)
+	}
 
-		if err := scanner.Err(); err != nil {
-			slog.Error("error reading from scanner", "error", err.Error())
-		}
-	}()
-	return lines
+	return count, nil
 }
 
-func processFeedLines(ctx context.Context, chunkSize int, ttl time.Duration, workerID int, lines <-chan []byte, rdb *redis.Client) (int64, error) {
+// processFeedLines - write feed lines into the given generation, returning the number of records written and how many of
+// them were also present in the previous generation
+func processFeedLines(ctx context.Context, chunkSize int, ttl time.Duration, codec recordCodec, workerID int, ks keyspace, generation, previous int64, sample *atomic.Value, lines <-chan []byte, rdb redis.UniversalClient, progress *ingestProgress) (int64, int64, error) {
 	pipe := rdb.Pipeline()
 	buffer := 0
 	count := int64(0)
+	retained := int64(0)
+	metaKey := ks.generationMeta(generation)
+	indexes := newIndexWriter(ks, generation, ttl, codec.recordFormat)
+	lastIP := ""
+	var seen []*redis.IntCmd
 
 	for line := range lines {
+		if ctx.Err() != nil {
+			return count, retained, ctx.Err()
+		}
+
 		var record spur.IPContext
 		if err := json.Unmarshal(line, &record); err != nil {
-			slog.Error("error unmarshalling line", "worker_id", workerID, "error", err.Error())
+			progress.reject(workerID, fmt.Sprintf("invalid json: %v", err), line)
 			continue
 		}
 
-		buffer++
-		key := record.IP
-		pipe.Set(ctx, key, string(line), ttl)
-		if buffer >= chunkSize {
-			result, err := pipe.Exec(ctx)
-			if err != nil {
-				return 0, fmt.Errorf("worker %d: error executing pipeline: %w", workerID, err)
+		var fields map[string]interface{}
+		value := line
+		if codec.layout == LayoutHash {
+			var err error
+			if fields, err = recordFields(line); err != nil || len(fields) == 0 {
+				progress.reject(workerID, "not a json object", line)
+				continue
 			}
-
-			for _, res := range result {
-				if res.Err() != nil {
-					return 0, fmt.Errorf("worker %d: error executing pipeline: %w", workerID, err)
-				}
+		} else {
+			var err error
+			if value, err = codec.encode(ctx, line); err != nil {
+				return count, retained, fmt.Errorf("error encoding %s: %w", record.IP, err)
 			}
-
-			count += int64(buffer)
-			buffer = 0
-		}
-	}
-	if buffer > 0 {
-		// fmt.Printf("Worker %d: Flushing (%d)\n", workerID, count)
-		_, err := pipe.Exec(ctx)
-		if err != nil {
-			return 0, fmt.Errorf("worker %d: error executing pipeline: %w", workerID, err)
-		}
-
-		count += int64(buffer)
-	}
-
-	return count, nil
-}
-
-func processMergeLines(ctx context.Context, chunkSize int, ttl time.Duration, workerID int, lines <-chan []byte, rdb *redis.Client) (int64, error) {
-	pipe := rdb.Pipeline()
-	buffer := 0
-	count := int64(0)
-
-	partials := make(map[string]*spur.IPContext)
-	existing := make(map[string]*spur.IPContext)
-
-	// Load all of our new lines into partials
-	for line := range lines {
-		var record spur.IPContext
-		if err := jsoniter.Unmarshal(line, &record); err != nil {
-			fmt.Printf("Worker %d: Skipping failed JSON: %s\n", workerID, line)
-			continue
 		}
-		partials[record.IP] = &record
-	}
-
-	// Fetch all of the IPs we have updates for from Redis
-	keys := make([]string, count)
-	for k := range partials {
-		keys = append(keys, k)
-	}
-
-	state, err := rdb.MGet(ctx, keys...).Result()
-	if err != nil {
-		return 0, fmt.Errorf("worker %d: error fetching keys: %w", workerID, err)
-	}
+		progress.parsed()
 
-	for _, val := range state {
-		var existingRecord spur.IPContext
-		if val == nil {
-			continue
-		}
-		data, ok := val.(string)
-		if !ok {
-			slog.Error("failed to cast to string", "worker_id", workerID, "value", val)
-			continue
-		}
-		if err := json.Unmarshal([]byte(data), &existingRecord); err != nil {
-			slog.Error("failed to unmarshal json", "worker_id", workerID, "error", err.Error())
-			continue
+		key := ks.record(generation, record.IP)
+		if codec.layout == LayoutHash {
+			pipe.HSet(ctx, key, fields)
+			if ttl > 0 {
+				pipe.Expire(ctx, key, ttl)
+			}
+		} else {
+			pipe.Set(ctx, key, value, ttl)
 		}
-		existing[existingRecord.IP] = &existingRecord
-	}
-
-	// Merge all of our Redis IPs with the partial IPs
-	for ip, partial := range partials {
-		if existing[ip] != nil {
-			eip := existing[ip]
-			eip.Merge(partial)
-			partial = existing[ip]
+		indexes.address(ctx, pipe, record.IP)
+		if codec.indexed {
+			indexes.add(ctx, pipe, record.IP, indexEntries(&record))
 		}
 		buffer++
-		key := partial.IP
-		data, err := json.Marshal(partial)
-		if err != nil {
-			log.Fatalf("Worker %d: Failed to serialize json: %v\n", workerID, err)
-			continue
+		if previous != 0 {
+			seen = append(seen, pipe.Exists(ctx, ks.record(previous, record.IP)))
 		}
-		pipe.Set(ctx, key, string(data), ttl)
+		lastIP = record.IP
 		if buffer >= chunkSize {
-			// fmt.Printf("\r\nWorker %d: Flushing (%d)", workerID, count)
-			_, err = pipe.Exec(ctx)
+			indexes.expire(ctx, pipe)
+			pipe.HIncrBy(ctx, metaKey, generationCountField, int64(buffer))
+			start := time.Now()
+			_, err := pipe.Exec(ctx)
 			if err != nil {
-				log.Fatalf("Worker %d: Error executing pipeline: %v\n", workerID, err)
+				return count, retained, fmt.Errorf("error executing pipeline: %w", err)
 			}
+
+			progress.wrote(buffer, time.Since(start))
 			count += int64(buffer)
+			retained += sumIntCmds(seen)
 			buffer = 0
+			seen = seen[:0]
+			sample.Store(lastIP)
 		}
 	}
 	if buffer > 0 {
 		// fmt.Printf("Worker %d: Flushing (%d)\n", workerID, count)
-		_, err = pipe.Exec(ctx)
+		indexes.expire(ctx, pipe)
+		pipe.HIncrBy(ctx, metaKey, generationCountField, int64(buffer))
+		start := time.Now()
+		_, err := pipe.Exec(ctx)
 		if err != nil {
-			log.Fatalf("Worker %d: Error executing pipeline: %v\n", workerID, err)
+			return count, retained, fmt.Errorf("error executing pipeline: %w", err)
 		}
 
+		progress.wrote(buffer, time.Since(start))
 		count += int64(buffer)
+		retained += sumIntCmds(seen)
+		sample.Store(lastIP)
 	}
 
-	return count, nil
+	return count, retained, nil
+}
+
+// sumIntCmds - sum the results of a batch of executed integer commands
+func sumIntCmds(cmds []*redis.IntCmd) int64 {
+	var sum int64
+	for _, cmd := range cmds {
+		sum += cmd.Val()
+	}
+	return sum
 }
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// clusterSlots - the number of hash slots in a Redis Cluster
+const clusterSlots = 16384
+
+// hashSlot - the Redis Cluster hash slot for a key, honoring {hash tags}
+func hashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 - CRC16-CCITT (XModem) as used by Redis Cluster
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// mget - MGET that works against a cluster. Keys are grouped by hash slot and fetched with one pipelined MGET per slot,
+// the values are returned in the same order as the keys.
+func mget(ctx context.Context, rdb redis.UniversalClient, keys []string) ([]interface{}, error) {
+	if _, ok := rdb.(*redis.ClusterClient); !ok {
+		return rdb.MGet(ctx, keys...).Result()
+	}
+
+	bySlot := make(map[int][]int)
+	for i, key := range keys {
+		slot := hashSlot(key)
+		bySlot[slot] = append(bySlot[slot], i)
+	}
+
+	pipe := rdb.Pipeline()
+	cmds := make(map[int]*redis.SliceCmd, len(bySlot))
+	for slot, indexes := range bySlot {
+		slotKeys := make([]string, len(indexes))
+		for i, idx := range indexes {
+			slotKeys[i] = keys[idx]
+		}
+		cmds[slot] = pipe.MGet(ctx, slotKeys...)
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(keys))
+	for slot, indexes := range bySlot {
+		for i, val := range cmds[slot].Val() {
+			values[indexes[i]] = val
+		}
+	}
+
+	return values, nil
+}
+
+// forEachScanNode - run fn against every node that holds a share of the keyspace, all masters for a cluster or the single
+// server otherwise. SCAN only walks the node it is sent to.
+func forEachScanNode(ctx context.Context, rdb redis.UniversalClient, fn func(ctx context.Context, node redis.UniversalClient) error) error {
+	if cluster, ok := rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return fn(ctx, node)
+		})
+	}
+
+	return fn(ctx, rdb)
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{key: "123456789", want: 12739},
+		{key: "foo", want: 12182},
+		{key: "{user1000}.following", want: hashSlot("user1000")},
+		{key: "{user1000}.followers", want: hashSlot("user1000")},
+		{key: "foo{}{bar}", want: hashSlot("foo{}{bar}")},
+		{key: "foo{{bar}}zap", want: hashSlot("{bar")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.want, hashSlot(tt.key))
+		})
+	}
+}
+
+func TestMGetOrder(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{})
+
+	require.NoError(t, mr.Set("a", "1"))
+	require.NoError(t, mr.Set("c", "3"))
+
+	values, err := mget(ctx, r.client, []string{"a", "b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"1", nil, "3"}, values)
+}
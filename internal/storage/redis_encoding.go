@@ -0,0 +1,472 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Encodings records can be stored in with LayoutString. EncodingJSON keeps the JSON line from the feed. EncodingMsgpack
+// stores the same record as msgpack, with map keys and repeated values such as operators, services and AS organizations
+// replaced by ids from a dictionary shared by every record in the generation. EncodingMsgpackFlate also compresses it.
+// The encoding is recorded with each generation, so changing it takes effect from the next full feed.
+const (
+	EncodingJSON         = "json"
+	EncodingMsgpack      = "msgpack"
+	EncodingMsgpackFlate = "msgpack-flate"
+)
+
+// Encodings - every encoding, in the order they are reported
+var Encodings = []string{EncodingJSON, EncodingMsgpack, EncodingMsgpackFlate}
+
+// generationEncodingField - the generation metadata field holding the encoding of its records, missing for EncodingJSON
+const generationEncodingField = "encoding"
+
+// generationDictionaryField - the generation metadata field set when the generation has a dictionary of its own. Older
+// generations share the dictionary in the strings hash.
+const generationDictionaryField = "dictionary"
+
+// internedStringExt - the msgpack extension type holding the dictionary id of an interned string
+const internedStringExt int8 = 1
+
+// uninternedFields - fields whose values are mostly unique to a record, interning them would only grow the dictionary
+var uninternedFields = map[string]bool{"ip": true, "network": true, "entries": true, "exits": true, "geohash": true}
+
+// internScript - look up the ids of the strings in ARGV in the dictionary hash KEYS[1], assigning the next id to any
+// that aren't in it yet. Each string is stored as s:<string> -> id and i:<id> -> string.
+var internScript = redis.NewScript(`
+local ids = {}
+for i, s in ipairs(ARGV) do
+	local id = redis.call('HGET', KEYS[1], 's:' .. s)
+	if not id then
+		id = redis.call('HINCRBY', KEYS[1], 'seq', 1)
+		redis.call('HSET', KEYS[1], 's:' .. s, id, 'i:' .. id, s)
+	end
+	ids[i] = tonumber(id)
+end
+return ids
+`)
+
+// recordFormat - how the records of a generation are stored
+type recordFormat struct {
+	layout   string
+	encoding string
+	indexed  bool
+	// addressed is set when the generation keeps its IPv4 addresses in the addresses index
+	addressed bool
+	// dictionary is the hash holding the interned strings of the msgpack encodings
+	dictionary string
+}
+
+// recordCodec - reads and writes records in a generation's format
+type recordCodec struct {
+	recordFormat
+	strings *stringTable
+	rdb     redis.UniversalClient
+}
+
+// encode - encode a JSON record for storage
+func (c recordCodec) encode(ctx context.Context, data []byte) ([]byte, error) {
+	if c.encoding == "" || c.encoding == EncodingJSON {
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+
+	var interned []string
+	collectInterned(tree, "", &interned)
+	if err := c.strings.intern(ctx, c.rdb, interned); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := c.strings.writeValue(msgpack.NewEncoder(&buf), tree, ""); err != nil {
+		return nil, err
+	}
+
+	if c.encoding != EncodingMsgpackFlate {
+		return buf.Bytes(), nil
+	}
+	return deflate(buf.Bytes())
+}
+
+// decode - decode a stored record back to JSON
+func (c recordCodec) decode(ctx context.Context, value []byte) ([]byte, error) {
+	if c.encoding == "" || c.encoding == EncodingJSON {
+		return value, nil
+	}
+
+	if c.encoding == EncodingMsgpackFlate {
+		var err error
+		if value, err = inflate(value); err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []uint32
+	tree, err := readValue(msgpack.NewDecoder(bytes.NewReader(value)), &ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.strings.lookup(ctx, c.rdb, ids); err != nil {
+		return nil, err
+	}
+
+	tree, err = c.strings.resolve(tree)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// internedString - a dictionary id read from a stored record, before it is resolved to its string
+type internedString uint32
+
+// collectInterned - collect the map keys and string values of a decoded JSON record that are stored as dictionary ids
+func collectInterned(value interface{}, field string, interned *[]string) {
+	switch v := value.(type) {
+	case string:
+		if !uninternedFields[field] {
+			*interned = append(*interned, v)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectInterned(item, field, interned)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			*interned = append(*interned, key)
+			collectInterned(item, key, interned)
+		}
+	}
+}
+
+// readValue - read a msgpack value written by writeValue, leaving dictionary ids as internedStrings and adding them to
+// ids
+func readValue(dec *msgpack.Decoder, ids *[]uint32) (interface{}, error) {
+	code, err := dec.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32:
+		n, err := dec.DecodeMapLen()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := 0; i < n; i++ {
+			key, err := readValue(dec, ids)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readValue(dec, ids)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+
+	case msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32:
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		s := make([]interface{}, n)
+		for i := range s {
+			if s[i], err = readValue(dec, ids); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+
+	case msgpcode.IsExt(code):
+		extID, extLen, err := dec.DecodeExtHeader()
+		if err != nil {
+			return nil, err
+		}
+		if extID != internedStringExt || extLen > 4 {
+			return nil, fmt.Errorf("unexpected msgpack extension %d of %d bytes", extID, extLen)
+		}
+		buf := make([]byte, 4)
+		if err := dec.ReadFull(buf[4-extLen:]); err != nil {
+			return nil, err
+		}
+		id := binary.BigEndian.Uint32(buf)
+		*ids = append(*ids, id)
+		return internedString(id), nil
+	}
+
+	return dec.DecodeInterfaceLoose()
+}
+
+// deflate - compress an encoded record
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// inflate - decompress an encoded record
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// flateWriters - flate writers are expensive to create, so they are reused across records
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// stringTable - the dictionary of interned strings shared by every record in a generation. Ids never change once they
+// are assigned, so they are cached until the generation is purged. A table used without a client assigns ids locally.
+type stringTable struct {
+	key string
+
+	mu     sync.RWMutex
+	ids    map[string]uint32
+	values map[uint32]string
+}
+
+// newStringTable - the dictionary stored in the given hash
+func newStringTable(key string) *stringTable {
+	return &stringTable{key: key, ids: make(map[string]uint32), values: make(map[uint32]string)}
+}
+
+// intern - make sure every string has an id, assigning new ones in Redis for those that have never been seen
+func (t *stringTable) intern(ctx context.Context, rdb redis.UniversalClient, strings []string) error {
+	t.mu.RLock()
+	var missing []interface{}
+	seen := make(map[string]bool)
+	for _, s := range strings {
+		if _, ok := t.ids[s]; !ok && !seen[s] {
+			missing = append(missing, s)
+			seen[s] = true
+		}
+	}
+	t.mu.RUnlock()
+	if len(missing) == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rdb == nil {
+		for _, s := range missing {
+			if _, ok := t.ids[s.(string)]; !ok {
+				t.add(s.(string), uint32(len(t.ids)+1))
+			}
+		}
+		return nil
+	}
+
+	ids, err := internScript.Run(ctx, rdb, []string{t.key}, missing...).Int64Slice()
+	if err != nil {
+		return fmt.Errorf("failed to intern strings: %w", err)
+	}
+	for i, id := range ids {
+		t.add(missing[i].(string), uint32(id))
+	}
+	return nil
+}
+
+// lookup - make sure the string for every id is known, reading those that aren't from Redis
+func (t *stringTable) lookup(ctx context.Context, rdb redis.UniversalClient, ids []uint32) error {
+	t.mu.RLock()
+	var missing []string
+	var missingIDs []uint32
+	for _, id := range ids {
+		if _, ok := t.values[id]; !ok {
+			missing = append(missing, "i:"+strconv.FormatUint(uint64(id), 10))
+			missingIDs = append(missingIDs, id)
+		}
+	}
+	t.mu.RUnlock()
+	if len(missing) == 0 {
+		return nil
+	}
+	if rdb == nil {
+		return fmt.Errorf("unknown interned string %d", missingIDs[0])
+	}
+
+	values, err := rdb.HMGet(ctx, t.key, missing...).Result()
+	if err != nil {
+		return fmt.Errorf("failed to look up interned strings: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("unknown interned string %d", missingIDs[i])
+		}
+		t.add(s, missingIDs[i])
+	}
+	return nil
+}
+
+// add - cache a string and its id, the caller must hold the write lock
+func (t *stringTable) add(s string, id uint32) {
+	t.ids[s] = id
+	t.values[id] = s
+}
+
+// size - the number of strings in the table and their total length
+func (t *stringTable) size() (int, int64) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var bytes int64
+	for s := range t.ids {
+		bytes += int64(len(s))
+	}
+	return len(t.ids), bytes
+}
+
+// writeValue - write a decoded JSON value as msgpack, with the strings collectInterned collected written as their ids
+func (t *stringTable) writeValue(enc *msgpack.Encoder, value interface{}, field string) error {
+	switch v := value.(type) {
+	case nil:
+		return enc.EncodeNil()
+	case bool:
+		return enc.EncodeBool(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return enc.EncodeInt(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return enc.EncodeFloat64(f)
+	case string:
+		if uninternedFields[field] {
+			return enc.EncodeString(v)
+		}
+		return t.writeInterned(enc, v)
+	case []interface{}:
+		if err := enc.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := t.writeValue(enc, item, field); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		if err := enc.EncodeMapLen(len(v)); err != nil {
+			return err
+		}
+		for key, item := range v {
+			if err := t.writeInterned(enc, key); err != nil {
+				return err
+			}
+			if err := t.writeValue(enc, item, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unexpected %T in record", value)
+}
+
+// writeInterned - write the id of an interned string, in as few bytes as it fits in
+func (t *stringTable) writeInterned(enc *msgpack.Encoder, s string) error {
+	t.mu.RLock()
+	id, ok := t.ids[s]
+	t.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("string %q was not interned", s)
+	}
+
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], id)
+	size := 4
+	switch {
+	case id <= 0xff:
+		size = 1
+	case id <= 0xffff:
+		size = 2
+	}
+
+	if err := enc.EncodeExtHeader(internedStringExt, size); err != nil {
+		return err
+	}
+	_, err := enc.Writer().Write(buf[4-size:])
+	return err
+}
+
+// resolve - replace the dictionary ids read by readValue with their strings, giving a value that can be marshalled to
+// JSON
+func (t *stringTable) resolve(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case internedString:
+		t.mu.RLock()
+		s, ok := t.values[uint32(v)]
+		t.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown interned string %d", v)
+		}
+		return s, nil
+	case []interface{}:
+		for i, item := range v {
+			resolved, err := t.resolve(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			resolvedKey, err := t.resolve(key)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := resolvedKey.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected %T map key in record", resolvedKey)
+			}
+			if m[name], err = t.resolve(item); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	return value, nil
+}
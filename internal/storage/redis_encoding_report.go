@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// errSampleFull - stops the scan once enough records have been sampled
+var errSampleFull = errors.New("sample full")
+
+// EncodingSize - the size records take in one encoding
+type EncodingSize struct {
+	Encoding string `json:"encoding"`
+
+	// AvgBytes is the average encoded size of the sampled records and EstimatedBytes that size for every record in the
+	// generation, neither includes the per-key overhead Redis adds to every record
+	AvgBytes       float64 `json:"avg_bytes"`
+	EstimatedBytes int64   `json:"estimated_bytes"`
+
+	// Ratio is the size relative to EncodingJSON
+	Ratio float64 `json:"ratio"`
+}
+
+// EncodingReport - how much memory the current generation's records would take in each encoding
+type EncodingReport struct {
+	Generation int64          `json:"generation"`
+	Layout     string         `json:"layout"`
+	Encoding   string         `json:"encoding"`
+	Records    int64          `json:"records"`
+	Sampled    int            `json:"sampled"`
+	Sizes      []EncodingSize `json:"sizes"`
+
+	// The msgpack encodings also store a single dictionary of the strings they intern, this is its size for the sample
+	DictionaryStrings int   `json:"dictionary_strings"`
+	DictionaryBytes   int64 `json:"dictionary_bytes"`
+}
+
+// EncodingReport - encode a sample of up to sample records from the current generation in every encoding and compare
+// their sizes. Nothing is written, the dictionary for the sample is built in memory.
+func (r *Redis) EncodingReport(ctx context.Context, sample int) (*EncodingReport, error) {
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if gen == 0 {
+		return nil, fmt.Errorf("no generation has been loaded")
+	}
+
+	format, err := r.generationFormat(ctx, gen)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := r.GetCurrentGenerationInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := r.sampleKeys(ctx, gen, sample)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := r.readJSONRecords(ctx, format, keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("generation %d has no records to sample", gen)
+	}
+
+	report := &EncodingReport{Generation: gen, Layout: format.layout, Encoding: format.encoding, Records: info.Count, Sampled: len(records)}
+	dictionary := newStringTable("")
+	for _, encoding := range Encodings {
+		codec := recordCodec{recordFormat: recordFormat{layout: LayoutString, encoding: encoding}, strings: dictionary}
+
+		var total int64
+		for _, record := range records {
+			encoded, err := codec.encode(ctx, record)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode sample as %s: %w", encoding, err)
+			}
+			total += int64(len(encoded))
+		}
+
+		avg := float64(total) / float64(len(records))
+		size := EncodingSize{Encoding: encoding, AvgBytes: avg, EstimatedBytes: int64(avg * float64(info.Count)), Ratio: 1}
+		if len(report.Sizes) > 0 && report.Sizes[0].AvgBytes > 0 {
+			size.Ratio = avg / report.Sizes[0].AvgBytes
+		}
+		report.Sizes = append(report.Sizes, size)
+	}
+	report.DictionaryStrings, report.DictionaryBytes = dictionary.size()
+
+	return report, nil
+}
+
+// sampleKeys - up to sample record keys from the given generation
+func (r *Redis) sampleKeys(ctx context.Context, generation int64, sample int) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+	match := escapeGlob(r.keys.generationPrefix(generation)) + "*"
+	err := forEachScanNode(ctx, r.client, func(ctx context.Context, node redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			found, next, err := node.Scan(ctx, cursor, match, int64(r.chunkSize)).Result()
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			keys = append(keys, found...)
+			full := len(keys) >= sample
+			mu.Unlock()
+			if full {
+				return errSampleFull
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil && !errors.Is(err, errSampleFull) {
+		return nil, fmt.Errorf("failed to sample generation %d: %w", generation, err)
+	}
+
+	if len(keys) > sample {
+		keys = keys[:sample]
+	}
+	return keys, nil
+}
+
+// readJSONRecords - read records in the given format as JSON, skipping any that expired since they were sampled
+func (r *Redis) readJSONRecords(ctx context.Context, format recordFormat, keys []string) ([][]byte, error) {
+	var records [][]byte
+	for start := 0; start < len(keys); start += r.chunkSize {
+		chunk := keys[start:min(start+r.chunkSize, len(keys))]
+
+		if format.layout == LayoutHash {
+			pipe := r.client.Pipeline()
+			reads := make([]*redis.StringStringMapCmd, len(chunk))
+			for i, key := range chunk {
+				reads[i] = pipe.HGetAll(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return nil, fmt.Errorf("failed to read sample: %w", err)
+			}
+
+			for _, read := range reads {
+				if len(read.Val()) == 0 {
+					continue
+				}
+				raw := make(map[string]json.RawMessage, len(read.Val()))
+				for field, value := range read.Val() {
+					raw[field] = json.RawMessage(value)
+				}
+				data, err := json.Marshal(raw)
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, data)
+			}
+			continue
+		}
+
+		values, err := mget(ctx, r.client, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sample: %w", err)
+		}
+		codec := r.codec(format)
+		for _, value := range values {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			data, err := codec.decode(ctx, []byte(s))
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, data)
+		}
+	}
+
+	return records, nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const encodingTestRecord = `{"ip":"1.1.1.1","organization":"Example ISP","infrastructure":"MOBILE","risks":["TUNNEL","SPAM"],` +
+	`"tunnels":[{"operator":"NORD_VPN","type":"VPN","anonymous":true,"entries":["9.9.9.9"]}],"as":{"number":64500,"organization":"Example ISP"},` +
+	`"client":{"behaviors":["FILE_SHARING"],"concentration":{"geohash":"u4pru","density":0.25,"skew":3},"count":12},"location":{"country":"US"}}`
+
+func TestRecordCodecRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+
+	for _, encoding := range Encodings {
+		t.Run(encoding, func(t *testing.T) {
+			codec := r.codec(recordFormat{layout: LayoutString, encoding: encoding, dictionary: r.keys.dictionary(1)})
+
+			encoded, err := codec.encode(ctx, []byte(encodingTestRecord))
+			require.NoError(t, err)
+			if encoding != EncodingJSON {
+				assert.Less(t, len(encoded), len(encodingTestRecord))
+			}
+
+			// A fresh table has to read the dictionary back from Redis
+			codec.strings = newStringTable(r.keys.dictionary(1))
+			decoded, err := codec.decode(ctx, encoded)
+			require.NoError(t, err)
+			assert.JSONEq(t, encodingTestRecord, string(decoded))
+		})
+	}
+}
+
+func TestRedisMsgpackEncoding(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, Encoding: EncodingMsgpackFlate})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(encodingTestRecord, `{"ip":"2.2.2.2","organization":"Example ISP"}`))
+	require.NoError(t, err)
+
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "Example ISP", ipCtx.Organization)
+	assert.Equal(t, 64500, ipCtx.AS.Number)
+	assert.Equal(t, 0.25, ipCtx.Client.Concentration.Density)
+	assert.Equal(t, []string{"9.9.9.9"}, ipCtx.Tunnels[0].Entries)
+
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(`{"ip":"2.2.2.2","risks":["CALLBACK_PROXY"]}`))
+	require.NoError(t, err)
+
+	ipCtx, err = r.GetByIP(ctx, "2.2.2.2")
+	require.NoError(t, err)
+	assert.Equal(t, "Example ISP", ipCtx.Organization)
+	assert.Equal(t, []string{"CALLBACK_PROXY"}, ipCtx.Risks)
+
+	// Another process reading the same data loads the dictionary from Redis
+	other := connectTestRedis(t, RedisOptions{Addr: r.opts.Addr})
+	ipCtx, err = other.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TUNNEL", "SPAM"}, ipCtx.Risks)
+
+	report, err := r.EncodingReport(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, EncodingMsgpackFlate, report.Encoding)
+	assert.Equal(t, int64(2), report.Records)
+	assert.Equal(t, 2, report.Sampled)
+	require.Len(t, report.Sizes, len(Encodings))
+	assert.Equal(t, EncodingJSON, report.Sizes[0].Encoding)
+	assert.Less(t, report.Sizes[1].AvgBytes, report.Sizes[0].AvgBytes)
+	assert.NotZero(t, report.DictionaryStrings)
+}
+
+func TestRedisDictionaryPurgedWithGeneration(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, Encoding: EncodingMsgpack})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(encodingTestRecord))
+	require.NoError(t, err)
+	first, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+
+	ttl, err := r.client.TTL(ctx, r.keys.dictionary(first)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, ttl)
+
+	// The next feed gets a dictionary of its own and the previous one goes with its generation
+	require.NoError(t, r.client.HSet(ctx, r.keys.strings(), "another", "application").Err())
+	_, err = r.StreamingFeedInsert(ctx, gzipLines(encodingTestRecord))
+	require.NoError(t, err)
+	require.NoError(t, r.purgeRetiredGenerations(ctx))
+
+	exists, err := r.client.Exists(ctx, r.keys.dictionary(first)).Result()
+	require.NoError(t, err)
+	assert.Zero(t, exists)
+	// A hash under the shared dictionary's name that no generation used is left alone
+	exists, err = r.client.Exists(ctx, r.keys.strings()).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), exists)
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TUNNEL", "SPAM"}, ipCtx.Risks)
+}
+
+func TestRedisSharedDictionary(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, Encoding: EncodingMsgpack})
+
+	// Generations from before each had a dictionary read theirs from the shared hash
+	codec := r.codec(recordFormat{layout: LayoutString, encoding: EncodingMsgpack, dictionary: r.keys.strings()})
+	encoded, err := codec.encode(ctx, []byte(encodingTestRecord))
+	require.NoError(t, err)
+	require.NoError(t, r.client.Set(ctx, r.keys.record(1, "1.1.1.1"), encoded, 0).Err())
+	require.NoError(t, r.client.HSet(ctx, r.keys.generationMeta(1), generationEncodingField, EncodingMsgpack).Err())
+	require.NoError(t, r.client.Set(ctx, r.keys.generationSeq(), 1, 0).Err())
+	require.NoError(t, r.client.Set(ctx, r.keys.currentGeneration(), 1, 0).Err())
+
+	older := connectTestRedis(t, r.opts)
+	ipCtx, err := older.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "Example ISP", ipCtx.Organization)
+
+	// It is kept while the current generation uses it and deleted once none do
+	require.NoError(t, older.purgeRetiredGenerations(ctx))
+	exists, err := older.client.Exists(ctx, older.keys.strings()).Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), exists)
+
+	_, err = older.StreamingFeedInsert(ctx, gzipLines(encodingTestRecord))
+	require.NoError(t, err)
+	require.NoError(t, older.purgeRetiredGenerations(ctx))
+	exists, err = older.client.Exists(ctx, older.keys.strings()).Result()
+	require.NoError(t, err)
+	assert.Zero(t, exists)
+}
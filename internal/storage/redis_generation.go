@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Records are loaded into a generation-tagged namespace, <prefix>g<generation>:<ip>, and only become visible once the
+// current_generation pointer is flipped to that generation. Generation 0 is the bare, untagged keyspace written by
+// older versions of this program.
+const (
+	generationCountField   = "count"
+	generationRemovedField = "removed"
+	generationCreatedField = "created_at"
+	generationActiveField  = "activated_at"
+)
+
+// currentGeneration - get the generation currently being served, 0 if no generation has been activated yet
+func (r *Redis) currentGeneration(ctx context.Context) (int64, error) {
+	gen, err := r.client.Get(ctx, r.keys.currentGeneration()).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get current generation: %w", err)
+	}
+
+	return gen, nil
+}
+
+// GetCurrentGenerationInfo - get the metadata for the generation currently being served
+func (r *Redis) GetCurrentGenerationInfo(ctx context.Context) (*GenerationInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &GenerationInfo{Generation: gen}
+	if gen == 0 {
+		return info, nil
+	}
+
+	meta, err := r.client.HGetAll(ctx, r.keys.generationMeta(gen)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get generation %d metadata: %w", gen, err)
+	}
+
+	info.Count, _ = strconv.ParseInt(meta[generationCountField], 10, 64)
+	info.Removed, _ = strconv.ParseInt(meta[generationRemovedField], 10, 64)
+	info.CreatedAt, _ = time.Parse(time.RFC3339, meta[generationCreatedField])
+	info.ActivatedAt, _ = time.Parse(time.RFC3339, meta[generationActiveField])
+
+	return info, nil
+}
+
+// newGeneration - allocate a new generation to load a feed into, along with the format its records are stored in
+func (r *Redis) newGeneration(ctx context.Context) (int64, recordFormat, error) {
+	gen, err := r.client.Incr(ctx, r.keys.generationSeq()).Result()
+	if err != nil {
+		return 0, recordFormat{}, fmt.Errorf("failed to allocate generation: %w", err)
+	}
+
+	format := r.newFormat()
+	meta := []interface{}{generationCreatedField, time.Now().UTC().Format(time.RFC3339)}
+	if format.layout != LayoutString {
+		meta = append(meta, generationLayoutField, format.layout)
+	}
+	if format.encoding != EncodingJSON {
+		format.dictionary = r.keys.dictionary(gen)
+		meta = append(meta, generationEncodingField, format.encoding, generationDictionaryField, 1)
+	}
+	if format.indexed {
+		meta = append(meta, generationIndexedField, 1)
+	}
+	if format.addressed {
+		meta = append(meta, generationAddressedField, 1)
+	} else {
+		meta = append(meta, generationAddressedField, 0)
+	}
+
+	err = r.client.HSet(ctx, r.keys.generationMeta(gen), meta...).Err()
+	if err != nil {
+		return 0, recordFormat{}, fmt.Errorf("failed to store generation metadata: %w", err)
+	}
+	r.formats.Store(gen, format)
+
+	return gen, format, nil
+}
+
+// newFormat - the format new generations are stored in, encodings other than JSON only apply to LayoutString
+func (r *Redis) newFormat() recordFormat {
+	format := recordFormat{layout: r.opts.Layout, encoding: r.opts.Encoding, indexed: r.opts.Indexes, addressed: r.opts.NetworkIndex}
+	if format.layout == "" {
+		format.layout = LayoutString
+	}
+	if format.encoding == "" || format.layout != LayoutString {
+		format.encoding = EncodingJSON
+	}
+	return format
+}
+
+// generationFormat - the format the records of a generation are stored in. It never changes once the generation is
+// created, so it is only looked up once.
+func (r *Redis) generationFormat(ctx context.Context, generation int64) (recordFormat, error) {
+	if generation == 0 {
+		return recordFormat{layout: LayoutString, encoding: EncodingJSON}, nil
+	}
+	if format, ok := r.formats.Load(generation); ok {
+		return format.(recordFormat), nil
+	}
+
+	meta, err := r.client.HMGet(ctx, r.keys.generationMeta(generation), generationLayoutField, generationEncodingField, generationIndexedField,
+		generationAddressedField, generationDictionaryField).Result()
+	if err != nil {
+		return recordFormat{}, fmt.Errorf("failed to get generation %d format: %w", generation, err)
+	}
+
+	format := recordFormat{layout: LayoutString, encoding: EncodingJSON}
+	if layout, ok := meta[0].(string); ok && layout != "" {
+		format.layout = layout
+	}
+	if encoding, ok := meta[1].(string); ok && encoding != "" {
+		format.encoding = encoding
+	}
+	format.indexed = meta[2] != nil
+	// Indexed generations from before the addresses had a setting of their own always kept them
+	format.addressed = format.indexed
+	if addressed, ok := meta[3].(string); ok {
+		format.addressed = addressed == "1"
+	}
+	if format.encoding != EncodingJSON {
+		format.dictionary = r.keys.strings()
+		if meta[4] != nil {
+			format.dictionary = r.keys.dictionary(generation)
+		}
+	}
+
+	r.formats.Store(generation, format)
+	return format, nil
+}
+
+// codec - reads and writes records in the given format
+func (r *Redis) codec(format recordFormat) recordCodec {
+	codec := recordCodec{recordFormat: format, rdb: r.client}
+	if format.dictionary != "" {
+		table, _ := r.strings.LoadOrStore(format.dictionary, newStringTable(format.dictionary))
+		codec.strings = table.(*stringTable)
+	}
+	return codec
+}
+
+// verifyGeneration - check that a freshly loaded generation is fit to be served
+func (r *Redis) verifyGeneration(ctx context.Context, generation int64, count int64, sampleIP string) error {
+	if count == 0 || sampleIP == "" {
+		return fmt.Errorf("generation %d is empty", generation)
+	}
+
+	stored, err := r.client.HGet(ctx, r.keys.generationMeta(generation), generationCountField).Int64()
+	if err != nil {
+		return fmt.Errorf("failed to get generation %d record count: %w", generation, err)
+	}
+	if stored != count {
+		return fmt.Errorf("generation %d has %d records stored, expected %d", generation, stored, count)
+	}
+
+	exists, err := r.client.Exists(ctx, r.keys.record(generation, sampleIP)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check generation %d sample record: %w", generation, err)
+	}
+	if exists == 0 {
+		return fmt.Errorf("generation %d sample record %s is missing", generation, sampleIP)
+	}
+
+	return nil
+}
+
+// recordRemoved - store how many records in the previous generation have no counterpart in the new one. These are
+// the IPs that stopped being reported, and they go away with the previous generation once it is purged. Records that
+// expired from the previous generation before the new one was loaded can make this an overestimate.
+func (r *Redis) recordRemoved(ctx context.Context, previous, generation, retained int64) error {
+	if previous == 0 {
+		return nil
+	}
+
+	previousCount, err := r.client.HGet(ctx, r.keys.generationMeta(previous), generationCountField).Int64()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get generation %d record count: %w", previous, err)
+	}
+
+	removed := previousCount - retained
+	if removed < 0 {
+		removed = 0
+	}
+
+	return r.client.HSet(ctx, r.keys.generationMeta(generation), generationRemovedField, removed).Err()
+}
+
+// activateGeneration - atomically point readers at the new generation and retire the previous one
+func (r *Redis) activateGeneration(ctx context.Context, previous, generation int64) error {
+	// The pointer flip is a single SET, so readers see either the old or the new generation and never a mix
+	err := r.client.Set(ctx, r.keys.currentGeneration(), generation, 0).Err()
+	if err != nil {
+		return fmt.Errorf("failed to activate generation %d: %w", generation, err)
+	}
+
+	err = r.client.HSet(ctx, r.keys.generationMeta(generation), generationActiveField, time.Now().UTC().Format(time.RFC3339)).Err()
+	if err != nil {
+		slog.Warn("failed to store generation activation time", "generation", generation, "error", err.Error())
+	}
+
+	// Legacy untagged keys can't be told apart from anything else in the database, so they are left to expire
+	if previous != 0 {
+		r.retireGeneration(ctx, previous)
+	}
+
+	slog.Info("activated generation", "generation", generation, "previous_generation", previous)
+	return nil
+}
+
+// retireGeneration - mark a generation for deletion, any records left behind will still expire with their TTL
+func (r *Redis) retireGeneration(ctx context.Context, generation int64) {
+	err := r.client.SAdd(ctx, r.keys.retiredGenerations(), generation).Err()
+	if err != nil {
+		slog.Warn("failed to retire generation", "generation", generation, "error", err.Error())
+	}
+}
+
+// purgeRetiredGenerationsInBackground - delete the retired generations without blocking the caller
+func (r *Redis) purgeRetiredGenerationsInBackground() {
+	go func() {
+		ctx := context.Background()
+		err := r.purgeRetiredGenerations(ctx)
+		if err != nil {
+			slog.Error("failed to purge retired generations", "error", err.Error())
+		}
+	}()
+}
+
+// purgeRetiredGenerations - delete every record belonging to a retired generation
+func (r *Redis) purgeRetiredGenerations(ctx context.Context) error {
+	r.purgeMu.Lock()
+	defer r.purgeMu.Unlock()
+
+	retired, err := r.client.SMembers(ctx, r.keys.retiredGenerations()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get retired generations: %w", err)
+	}
+
+	current, err := r.currentGeneration(ctx)
+	if err != nil {
+		return err
+	}
+
+	shared := false
+	for _, member := range retired {
+		gen, err := strconv.ParseInt(member, 10, 64)
+		if err != nil || gen == 0 || gen == current {
+			r.client.SRem(ctx, r.keys.retiredGenerations(), member)
+			continue
+		}
+
+		format, err := r.generationFormat(ctx, gen)
+		if err != nil {
+			return err
+		}
+		shared = shared || format.dictionary == r.keys.strings()
+
+		deleted, err := r.deleteGeneration(ctx, gen)
+		if err != nil {
+			return fmt.Errorf("failed to delete generation %d: %w", gen, err)
+		}
+
+		err = r.client.SRem(ctx, r.keys.retiredGenerations(), member).Err()
+		if err != nil {
+			return fmt.Errorf("failed to remove generation %d from retired set: %w", gen, err)
+		}
+
+		slog.Info("purged retired generation", "generation", gen, slog.Int64("deleted", deleted))
+	}
+
+	// Without a prefix the shared dictionary's name is too generic to delete unless one of the generations used it
+	if !shared {
+		return nil
+	}
+	return r.purgeSharedDictionary(ctx, current)
+}
+
+// purgeSharedDictionary - delete the dictionary older generations shared once none of them are left. Only the current
+// generation can still use it after the retired generations are purged.
+func (r *Redis) purgeSharedDictionary(ctx context.Context, current int64) error {
+	format, err := r.generationFormat(ctx, current)
+	if err != nil {
+		return err
+	}
+	if format.dictionary == r.keys.strings() {
+		return nil
+	}
+
+	err = r.client.Del(ctx, r.keys.strings()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete the shared dictionary: %w", err)
+	}
+	r.strings.Delete(r.keys.strings())
+
+	return nil
+}
+
+// deleteGeneration - delete all records, indexes, metadata and the dictionary for a generation
+func (r *Redis) deleteGeneration(ctx context.Context, generation int64) (int64, error) {
+	var deleted int64
+	for _, prefix := range []string{r.keys.generationPrefix(generation), r.keys.indexPrefix(generation)} {
+		n, err := r.deleteMatching(ctx, escapeGlob(prefix)+"*")
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	err := r.client.Del(ctx, r.keys.dictionary(generation)).Err()
+	if err != nil {
+		return deleted, err
+	}
+	r.strings.Delete(r.keys.dictionary(generation))
+
+	err = r.client.Del(ctx, r.keys.generationMeta(generation)).Err()
+	if err != nil {
+		return deleted, err
+	}
+
+	return deleted, nil
+}
+
+// deleteMatching - delete every key matching a SCAN pattern
+func (r *Redis) deleteMatching(ctx context.Context, match string) (int64, error) {
+	var deleted int64
+
+	// Keep scanning until a full pass finds nothing, which also catches records written while the purge was running
+	for {
+		var passDeleted int64
+		err := forEachScanNode(ctx, r.client, func(ctx context.Context, node redis.UniversalClient) error {
+			var cursor uint64
+			for {
+				keys, next, err := node.Scan(ctx, cursor, match, int64(r.chunkSize)).Result()
+				if err != nil {
+					return err
+				}
+
+				if len(keys) > 0 {
+					n, err := unlinkKeys(ctx, r.client, keys)
+					if err != nil {
+						return err
+					}
+					atomic.AddInt64(&passDeleted, n)
+				}
+
+				cursor = next
+				if cursor == 0 {
+					return nil
+				}
+			}
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted += passDeleted
+		if passDeleted == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// unlinkKeys - unlink keys one command per key in a pipeline, so keys in different cluster slots can be mixed
+func unlinkKeys(ctx context.Context, rdb redis.UniversalClient, keys []string) (int64, error) {
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Unlink(ctx, key)
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return sumIntCmds(cmds), nil
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"feedexampleredis/internal/spur"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Layouts records can be stored in. LayoutString keeps each record as the JSON line from the feed. LayoutHash keeps
+// each record as a hash with a field per top level JSON field, holding that field's JSON, so single fields can be read
+// and merges only rewrite the fields that changed. The layout is recorded with each generation, so changing it takes
+// effect from the next full feed.
+const (
+	LayoutString = "string"
+	LayoutHash   = "hash"
+)
+
+// generationLayoutField - the generation metadata field holding the layout its records are stored in, missing for
+// LayoutString
+const generationLayoutField = "layout"
+
+// hashCompareAndSetScript - the LayoutHash version of compareAndSetScript. ARGV[1] is the TTL in milliseconds, zero for
+// none, and ARGV[2] is 1 if the record existed when it was read and 0 if it didn't. It is followed by field, expected
+// and new value triples, an empty expected value meaning the field must not exist. Returns 1 if the fields were set and
+// 0 if any of them had changed.
+var hashCompareAndSetScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) ~= tonumber(ARGV[2]) then
+	return 0
+end
+for i = 3, #ARGV, 3 do
+	local current = redis.call('HGET', KEYS[1], ARGV[i])
+	if current == false then
+		current = ''
+	end
+	if current ~= ARGV[i + 1] then
+		return 0
+	end
+end
+for i = 3, #ARGV, 3 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 2])
+end
+local ttl = tonumber(ARGV[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// recordFields - split a JSON record into the fields of its hash
+func recordFields(data []byte) (map[string]interface{}, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{}, len(raw))
+	for field, value := range raw {
+		fields[field] = string(value)
+	}
+	return fields, nil
+}
+
+// recordFromFields - rebuild a record from the fields of its hash
+func recordFromFields(fields map[string]string) (*spur.IPContext, error) {
+	raw := make(map[string]json.RawMessage, len(fields))
+	for field, value := range fields {
+		raw[field] = json.RawMessage(value)
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var record spur.IPContext
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// isEmptyJSON - whether a field value is empty, structs are marshalled even when omitempty is set so an object with only
+// empty values counts as empty
+func isEmptyJSON(value []byte) bool {
+	var decoded interface{}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return false
+	}
+	return isEmptyValue(decoded)
+}
+
+// isEmptyValue - whether a decoded JSON value is null, an empty string or array, or an object of empty values
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		for _, field := range v {
+			if !isEmptyValue(field) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// changedFields - the fields of merged that differ from the existing fields of a record, leaving out empty fields the
+// record doesn't have
+func changedFields(existing map[string]string, merged *spur.IPContext) (map[string]string, error) {
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]string)
+	for field, value := range raw {
+		current, ok := existing[field]
+		if !ok && isEmptyJSON(value) {
+			continue
+		}
+		if ok && current == string(value) {
+			continue
+		}
+		changed[field] = string(value)
+	}
+	return changed, nil
+}
+
+// mergeRoundHash - the LayoutHash version of mergeRound. The existing records are read with a pipeline of HGETALLs, and
+// only the fields the merge changed are written back.
+func (t mergeTarget) mergeRoundHash(ctx context.Context, ips []string, partials map[string]*spur.IPContext, progress *ingestProgress) ([]string, error) {
+	keys := make([]string, len(ips))
+	reads := make([]*redis.StringStringMapCmd, len(ips))
+	pipe := t.rdb.Pipeline()
+	for i, ip := range ips {
+		keys[i] = t.ks.record(t.generation, ip)
+		reads[i] = pipe.HGetAll(ctx, keys[i])
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return ips, fmt.Errorf("error fetching keys: %w", err)
+	}
+
+	pipe = t.rdb.Pipeline()
+	sets := make([]*redis.Cmd, len(ips))
+	changes := make([]indexChange, len(ips))
+	added := int64(0)
+	for i, ip := range ips {
+		existing := reads[i].Val()
+		record := *partials[ip]
+		var before *spur.IPContext
+		if len(existing) > 0 {
+			current, err := recordFromFields(existing)
+			if err != nil {
+				return ips, fmt.Errorf("error reading %s: %w", ip, err)
+			}
+			before = &spur.IPContext{}
+			*before = *current
+			current.Merge(&record)
+			record = *current
+		} else {
+			added++
+		}
+		changes[i] = diffIndexEntries(ip, before, &record)
+
+		changed, err := changedFields(existing, &record)
+		if err != nil {
+			return ips, fmt.Errorf("error serializing %s: %w", ip, err)
+		}
+
+		if t.atomic {
+			exists := 0
+			if len(existing) > 0 {
+				exists = 1
+			}
+			args := []interface{}{t.ttl.Milliseconds(), exists}
+			for field, value := range changed {
+				args = append(args, field, existing[field], value)
+			}
+			sets[i] = hashCompareAndSetScript.EvalSha(ctx, pipe, []string{keys[i]}, args...)
+			continue
+		}
+
+		if len(changed) > 0 {
+			pipe.HSet(ctx, keys[i], changed)
+		}
+		if t.ttl > 0 {
+			pipe.Expire(ctx, keys[i], t.ttl)
+		}
+	}
+
+	return t.finishRound(ctx, pipe, ips, sets, changes, func(i int) bool { return len(reads[i].Val()) == 0 }, added, progress)
+}
+
+// GetFieldsByIP - get only the given top level fields of an IP's record, along with its ip and network. With
+// LayoutHash only those fields are read from Redis.
+func (r *Redis) GetFieldsByIP(ctx context.Context, ip string, fields []string) (*spur.IPContext, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := r.generationFormat(ctx, gen)
+	if err != nil {
+		return nil, err
+	}
+
+	if format.layout != LayoutHash {
+		record, err := r.GetByIP(ctx, ip)
+		if err != nil {
+			return nil, err
+		}
+		return SelectFields(record, fields)
+	}
+
+	names := append([]string{"ip", "network"}, fields...)
+	values, err := r.client.HMGet(ctx, r.keys.record(gen, ip), names...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]string, len(names))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			found[names[i]] = s
+		}
+	}
+	if len(found) == 0 {
+		return nil, ErrorIPNotFound
+	}
+
+	return recordFromFields(found)
+}
+
+// SelectFields - a copy of a record with only the given top level fields, along with its ip and network
+func SelectFields(record *spur.IPContext, fields []string) (*spur.IPContext, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]string, len(fields)+2)
+	for _, field := range append([]string{"ip", "network"}, fields...) {
+		if value, ok := all[field]; ok {
+			selected[field] = string(value)
+		}
+	}
+
+	return recordFromFields(selected)
+}
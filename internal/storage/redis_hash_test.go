@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisHashLayout(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, Layout: LayoutHash})
+
+	count, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"feed","risks":["TUNNEL"],"location":{"country":"US"}}`,
+		`{"ip":"2.2.2.2","organization":"feed"}`,
+	))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	gen, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	key := r.keys.record(gen, "1.1.1.1")
+
+	fields, err := r.client.HGetAll(ctx, key).Result()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ip":           `"1.1.1.1"`,
+		"organization": `"feed"`,
+		"risks":        `["TUNNEL"]`,
+		"location":     `{"country":"US"}`,
+	}, fields)
+	ttl, err := r.client.TTL(ctx, key).Result()
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, ttl)
+
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "feed", ipCtx.Organization)
+	assert.Equal(t, "US", ipCtx.Location.Country)
+
+	_, err = r.GetByIP(ctx, "3.3.3.3")
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+
+	// Only the merged field changes, and fields the merge left empty aren't written
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","risks":["SPAM"]}`,
+		`{"ip":"3.3.3.3","organization":"realtime"}`,
+	))
+	require.NoError(t, err)
+
+	fields, err = r.client.HGetAll(ctx, key).Result()
+	require.NoError(t, err)
+	assert.Equal(t, `["TUNNEL","SPAM"]`, fields["risks"])
+	assert.Equal(t, `{"country":"US"}`, fields["location"])
+	assert.NotContains(t, fields, "client")
+
+	fields, err = r.client.HGetAll(ctx, r.keys.record(gen, "3.3.3.3")).Result()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"ip": `"3.3.3.3"`, "organization": `"realtime"`}, fields)
+
+	info, err := r.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), info.Count)
+
+	// Only the requested fields are read, along with the ip
+	ipCtx, err = r.GetFieldsByIP(ctx, "1.1.1.1", []string{"risks"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1.1.1", ipCtx.IP)
+	assert.Equal(t, []string{"TUNNEL", "SPAM"}, ipCtx.Risks)
+	assert.Empty(t, ipCtx.Organization)
+	assert.Empty(t, ipCtx.Location.Country)
+
+	_, err = r.GetFieldsByIP(ctx, "4.4.4.4", []string{"risks"})
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+}
+
+func TestRedisLayoutChangesWithNextFeed(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"string"}`))
+	require.NoError(t, err)
+
+	// The string generation is still read as strings after the layout changes
+	r.opts.Layout = LayoutHash
+	ipCtx, err := r.GetFieldsByIP(ctx, "1.1.1.1", []string{"organization"})
+	require.NoError(t, err)
+	assert.Equal(t, "string", ipCtx.Organization)
+
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(`{"ip":"1.1.1.1","risks":["SPAM"]}`))
+	require.NoError(t, err)
+	ipCtx, err = r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SPAM"}, ipCtx.Risks)
+
+	_, err = r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"hash"}`))
+	require.NoError(t, err)
+
+	gen, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	kind, err := r.client.Type(ctx, r.keys.record(gen, "1.1.1.1")).Result()
+	require.NoError(t, err)
+	assert.Equal(t, "hash", kind)
+
+	ipCtx, err = r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "hash", ipCtx.Organization)
+}
+
+func TestRedisHashAtomicMergeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, AtomicMerge: true, Layout: LayoutHash})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"feed"}`))
+	require.NoError(t, err)
+
+	const writers, merges = 4, 10
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for m := 0; m < merges; m++ {
+				_, err := r.StreamingMergeInsert(ctx, gzipLines(
+					fmt.Sprintf(`{"ip":"1.1.1.1","risks":["R%d-%d"]}`, w, m),
+					fmt.Sprintf(`{"ip":"2.2.2.2","risks":["R%d-%d"]}`, w, m),
+				))
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		ipCtx, err := r.GetByIP(ctx, ip)
+		require.NoError(t, err)
+		assert.Len(t, ipCtx.Risks, writers*merges, ip)
+	}
+
+	info, err := r.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Count)
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"feedexampleredis/internal/spur"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Attributes records are indexed by when RedisOptions.Indexes is set. Each value of an attribute has a set of the IPs
+// that have it, kept in the same generation as the records so a new feed swaps them in along with its records.
+const (
+	IndexASN            = "asn"
+	IndexOperator       = "operator"
+	IndexCountry        = "country"
+	IndexRisk           = "risk"
+	IndexService        = "service"
+	IndexInfrastructure = "infrastructure"
+	IndexClientType     = "client_type"
+)
+
+// IndexAttributes - every indexed attribute
+var IndexAttributes = []string{IndexASN, IndexOperator, IndexCountry, IndexRisk, IndexService, IndexInfrastructure, IndexClientType}
+
+// generationIndexedField - the generation metadata field set when its records are indexed
+const generationIndexedField = "indexed"
+
+// generationAddressedField - the generation metadata field set when its IPv4 addresses are kept in the addresses index,
+// which every generation does whether or not its records are indexed
+const generationAddressedField = "addressed"
+
+// addressesIndex - the name of the index of IPv4 addresses, used to find the records within a network
+const addressesIndex = "addresses"
+
+var (
+	// ErrorNotIndexed - the data being served was loaded without secondary indexes
+	ErrorNotIndexed = errors.New("the current data has no secondary indexes")
+
+	// ErrorInvalidCursor - a cursor that wasn't returned by FindIPs for the same query
+	ErrorInvalidCursor = errors.New("invalid cursor")
+
+	// ErrorStaleCursor - a cursor returned for data that has since been replaced by a newer feed
+	ErrorStaleCursor = errors.New("the data changed since the cursor was returned, start again without it")
+)
+
+// indexEntry - an attribute value a record is indexed under
+type indexEntry struct {
+	attribute string
+	value     string
+}
+
+// indexEntries - every attribute value a record is indexed under
+func indexEntries(record *spur.IPContext) []indexEntry {
+	var entries []indexEntry
+	seen := make(map[indexEntry]bool)
+	add := func(attribute, value string) {
+		entry := indexEntry{attribute: attribute, value: value}
+		if value != "" && !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+
+	if record.AS.Number != 0 {
+		add(IndexASN, strconv.Itoa(record.AS.Number))
+	}
+	for _, tunnel := range record.Tunnels {
+		add(IndexOperator, tunnel.Operator)
+	}
+	add(IndexCountry, record.Location.Country)
+	for _, risk := range record.Risks {
+		add(IndexRisk, risk)
+	}
+	for _, service := range record.Services {
+		add(IndexService, service)
+	}
+	add(IndexInfrastructure, record.Infrastructure)
+	for _, clientType := range record.Client.Types {
+		add(IndexClientType, clientType)
+	}
+
+	return entries
+}
+
+// indexChange - the index entries a merge adds to and removes from a record
+type indexChange struct {
+	ip      string
+	added   []indexEntry
+	removed []indexEntry
+}
+
+// diffIndexEntries - the change in index entries between a record before and after a merge
+func diffIndexEntries(ip string, before, after *spur.IPContext) indexChange {
+	change := indexChange{ip: ip}
+
+	old := make(map[indexEntry]bool)
+	if before != nil {
+		for _, entry := range indexEntries(before) {
+			old[entry] = true
+		}
+	}
+
+	for _, entry := range indexEntries(after) {
+		if old[entry] {
+			delete(old, entry)
+			continue
+		}
+		change.added = append(change.added, entry)
+	}
+	for entry := range old {
+		change.removed = append(change.removed, entry)
+	}
+
+	return change
+}
+
+// indexWriter - queues index updates for a generation on a pipeline, refreshing the TTL of every index set it touches
+// once per batch. Only the indexes the generation's format keeps are written.
+type indexWriter struct {
+	ks         keyspace
+	generation int64
+	ttl        time.Duration
+	format     recordFormat
+	touched    map[string]bool
+}
+
+// newIndexWriter - a writer for the indexes of the given generation
+func newIndexWriter(ks keyspace, generation int64, ttl time.Duration, format recordFormat) *indexWriter {
+	return &indexWriter{ks: ks, generation: generation, ttl: ttl, format: format, touched: make(map[string]bool)}
+}
+
+// add - index an IP under the given entries
+func (w *indexWriter) add(ctx context.Context, pipe redis.Pipeliner, ip string, entries []indexEntry) {
+	if !w.format.indexed {
+		return
+	}
+	for _, entry := range entries {
+		key := w.ks.index(w.generation, entry.attribute, entry.value)
+		pipe.SAdd(ctx, key, ip)
+		w.touched[key] = true
+	}
+}
+
+// address - add an IPv4 address to the generation's addresses, other IPs aren't kept in it
+func (w *indexWriter) address(ctx context.Context, pipe redis.Pipeliner, ip string) {
+	score, ok := ipv4Score(ip)
+	if !ok || !w.format.addressed {
+		return
+	}
+	key := w.ks.addresses(w.generation)
+	pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: ip})
+	w.touched[key] = true
+}
+
+// remove - remove an IP from the given entries
+func (w *indexWriter) remove(ctx context.Context, pipe redis.Pipeliner, ip string, entries []indexEntry) {
+	if !w.format.indexed {
+		return
+	}
+	for _, entry := range entries {
+		pipe.SRem(ctx, w.ks.index(w.generation, entry.attribute, entry.value), ip)
+	}
+}
+
+// apply - queue a merge's index changes, the IP is added to the addresses in case the merge created its record
+func (w *indexWriter) apply(ctx context.Context, pipe redis.Pipeliner, change indexChange) {
+	w.address(ctx, pipe, change.ip)
+	w.add(ctx, pipe, change.ip, change.added)
+	w.remove(ctx, pipe, change.ip, change.removed)
+}
+
+// expire - queue a TTL refresh for the sets touched since the last call and the generation's dictionary, so they expire
+// along with the records in them. The dictionary older generations share is left alone.
+func (w *indexWriter) expire(ctx context.Context, pipe redis.Pipeliner) {
+	if w.ttl > 0 {
+		for key := range w.touched {
+			pipe.Expire(ctx, key, w.ttl)
+		}
+		if w.format.dictionary == w.ks.dictionary(w.generation) {
+			pipe.Expire(ctx, w.format.dictionary, w.ttl)
+		}
+	}
+	clear(w.touched)
+}
+
+// FindIPs - page through the IPs in the current generation whose indexed attributes have every one of the given values.
+// The smallest of the matching index sets is scanned and its IPs checked against the others. Start with an empty cursor
+// and carry on with the returned one until it is empty, count is a hint for the number of IPs checked per page so a page
+// can hold fewer IPs or none at all.
+func (r *Redis) FindIPs(ctx context.Context, query map[string]string, cursor string, count int64) ([]string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if len(query) == 0 {
+		return nil, "", fmt.Errorf("no attributes to match")
+	}
+	for attribute := range query {
+		if !isIndexAttribute(attribute) {
+			return nil, "", fmt.Errorf("unknown index attribute %q", attribute)
+		}
+	}
+
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	format, err := r.generationFormat(ctx, gen)
+	if err != nil {
+		return nil, "", err
+	}
+	if !format.indexed {
+		return nil, "", ErrorNotIndexed
+	}
+
+	scanned, position, err := r.findCursor(ctx, gen, query, cursor)
+	if err != nil || scanned == "" {
+		return nil, "", err
+	}
+
+	members, next, err := r.client.SScan(ctx, r.keys.index(gen, scanned, query[scanned]), position, "", count).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to scan index: %w", err)
+	}
+
+	ips, err := r.filterIndexed(ctx, gen, query, scanned, members)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if next == 0 {
+		return ips, "", nil
+	}
+	return ips, generationCursor(gen, scanned+":"+strconv.FormatUint(next, 10)), nil
+}
+
+// generationCursor - tag a cursor with the generation it pages through
+func generationCursor(generation int64, cursor string) string {
+	return strconv.FormatInt(generation, 10) + ":" + cursor
+}
+
+// parseGenerationCursor - the cursor tagged by generationCursor, a cursor for another generation is stale
+func parseGenerationCursor(cursor string, generation int64) (string, error) {
+	tag, rest, ok := strings.Cut(cursor, ":")
+	tagged, err := strconv.ParseInt(tag, 10, 64)
+	if !ok || err != nil {
+		return "", fmt.Errorf("%w %q", ErrorInvalidCursor, cursor)
+	}
+	if tagged != generation {
+		return "", fmt.Errorf("%w %q", ErrorStaleCursor, cursor)
+	}
+	return rest, nil
+}
+
+// findCursor - the attribute whose index set is scanned and the position to scan from. A new query scans the smallest
+// set, an empty attribute means one of the sets is empty so nothing can match.
+func (r *Redis) findCursor(ctx context.Context, generation int64, query map[string]string, cursor string) (string, uint64, error) {
+	if cursor != "" {
+		rest, err := parseGenerationCursor(cursor, generation)
+		if err != nil {
+			return "", 0, err
+		}
+		attribute, position, ok := strings.Cut(rest, ":")
+		n, err := strconv.ParseUint(position, 10, 64)
+		if _, queried := query[attribute]; !ok || err != nil || !queried {
+			return "", 0, fmt.Errorf("%w %q", ErrorInvalidCursor, cursor)
+		}
+		return attribute, n, nil
+	}
+
+	pipe := r.client.Pipeline()
+	sizes := make(map[string]*redis.IntCmd, len(query))
+	for attribute, value := range query {
+		sizes[attribute] = pipe.SCard(ctx, r.keys.index(generation, attribute, value))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", 0, fmt.Errorf("failed to size indexes: %w", err)
+	}
+
+	smallest := ""
+	for _, attribute := range IndexAttributes {
+		size, ok := sizes[attribute]
+		if !ok {
+			continue
+		}
+		if size.Val() == 0 {
+			return "", 0, nil
+		}
+		if smallest == "" || size.Val() < sizes[smallest].Val() {
+			smallest = attribute
+		}
+	}
+
+	return smallest, 0, nil
+}
+
+// filterIndexed - the IPs that are also in the index sets of every other queried attribute
+func (r *Redis) filterIndexed(ctx context.Context, generation int64, query map[string]string, scanned string, ips []string) ([]string, error) {
+	if len(query) == 1 || len(ips) == 0 {
+		return ips, nil
+	}
+
+	pipe := r.client.Pipeline()
+	checks := make([][]*redis.BoolCmd, len(ips))
+	for i, ip := range ips {
+		for attribute, value := range query {
+			if attribute != scanned {
+				checks[i] = append(checks[i], pipe.SIsMember(ctx, r.keys.index(generation, attribute, value), ip))
+			}
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to check indexes: %w", err)
+	}
+
+	matched := make([]string, 0, len(ips))
+	for i, ip := range ips {
+		all := true
+		for _, check := range checks[i] {
+			all = all && check.Val()
+		}
+		if all {
+			matched = append(matched, ip)
+		}
+	}
+
+	return matched, nil
+}
+
+// isIndexAttribute - whether records are indexed by the attribute
+func isIndexAttribute(attribute string) bool {
+	for _, indexed := range IndexAttributes {
+		if attribute == indexed {
+			return true
+		}
+	}
+	return false
+}
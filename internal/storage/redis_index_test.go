@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findAllIPs - page through every IP matching the query
+func findAllIPs(t *testing.T, r *Redis, query map[string]string) []string {
+	var all []string
+	cursor := ""
+	for {
+		ips, next, err := r.FindIPs(context.Background(), query, cursor, 1)
+		require.NoError(t, err)
+		all = append(all, ips...)
+		if next == "" {
+			return all
+		}
+		cursor = next
+	}
+}
+
+func TestRedisIndexes(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, Indexes: true})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","as":{"number":64500},"risks":["CALLBACK_PROXY","TUNNEL"],"tunnels":[{"operator":"NORD_VPN"}]}`,
+		`{"ip":"2.2.2.2","as":{"number":64500},"risks":["TUNNEL"],"location":{"country":"US"}}`,
+		`{"ip":"3.3.3.3","as":{"number":64501},"risks":["CALLBACK_PROXY"],"client":{"types":["MOBILE"]}}`,
+	))
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"1.1.1.1", "2.2.2.2"}, findAllIPs(t, r, map[string]string{IndexASN: "64500"}))
+	assert.ElementsMatch(t, []string{"1.1.1.1"}, findAllIPs(t, r, map[string]string{IndexASN: "64500", IndexRisk: "CALLBACK_PROXY"}))
+	assert.ElementsMatch(t, []string{"1.1.1.1"}, findAllIPs(t, r, map[string]string{IndexOperator: "NORD_VPN"}))
+	assert.ElementsMatch(t, []string{"3.3.3.3"}, findAllIPs(t, r, map[string]string{IndexClientType: "MOBILE"}))
+	assert.Empty(t, findAllIPs(t, r, map[string]string{IndexASN: "64501", IndexRisk: "TUNNEL"}))
+	assert.Empty(t, findAllIPs(t, r, map[string]string{IndexCountry: "DE"}))
+
+	// A merge moves a record between indexes
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(
+		`{"ip":"2.2.2.2","location":{"country":"DE"}}`,
+		`{"ip":"4.4.4.4","risks":["CALLBACK_PROXY"]}`,
+	))
+	require.NoError(t, err)
+
+	assert.Empty(t, findAllIPs(t, r, map[string]string{IndexCountry: "US"}))
+	assert.ElementsMatch(t, []string{"2.2.2.2"}, findAllIPs(t, r, map[string]string{IndexCountry: "DE"}))
+	assert.ElementsMatch(t, []string{"1.1.1.1", "3.3.3.3", "4.4.4.4"}, findAllIPs(t, r, map[string]string{IndexRisk: "CALLBACK_PROXY"}))
+
+	gen, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	ttl, err := r.client.TTL(ctx, r.keys.index(gen, IndexRisk, "CALLBACK_PROXY")).Result()
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, ttl)
+
+	_, _, err = r.FindIPs(ctx, map[string]string{IndexRisk: "TUNNEL"}, "asn:12", 10)
+	assert.ErrorIs(t, err, ErrorInvalidCursor)
+
+	// The next feed replaces the indexes along with the records
+	_, err = r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"5.5.5.5","as":{"number":64500}}`))
+	require.NoError(t, err)
+	require.NoError(t, r.purgeRetiredGenerations(ctx))
+
+	assert.ElementsMatch(t, []string{"5.5.5.5"}, findAllIPs(t, r, map[string]string{IndexASN: "64500"}))
+	// A cursor from the previous feed doesn't carry on in the new one
+	_, _, err = r.FindIPs(ctx, map[string]string{IndexASN: "64500"}, generationCursor(gen, IndexASN+":1"), 10)
+	assert.ErrorIs(t, err, ErrorStaleCursor)
+	keys, err := r.client.Keys(ctx, escapeGlob(r.keys.indexPrefix(gen))+"*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestRedisIndexesAtomicMerge(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, AtomicMerge: true, Indexes: true})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","infrastructure":"DATACENTER"}`))
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = r.StreamingMergeInsert(ctx, gzipLines(fmt.Sprintf(`{"ip":"1.1.1.1","services":["S%d"]}`, i)))
+		require.NoError(t, err)
+	}
+
+	assert.ElementsMatch(t, []string{"1.1.1.1"}, findAllIPs(t, r, map[string]string{IndexInfrastructure: "DATACENTER", IndexService: "S2"}))
+	assert.ElementsMatch(t, []string{"1.1.1.1"}, findAllIPs(t, r, map[string]string{IndexService: "S0"}))
+}
+
+func TestRedisNotIndexed(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","as":{"number":64500}}`))
+	require.NoError(t, err)
+
+	_, _, err = r.FindIPs(ctx, map[string]string{IndexASN: "64500"}, "", 10)
+	assert.ErrorIs(t, err, ErrorNotIndexed)
+}
+
+// findAllNetwork - page through every record within the network
+func findAllNetwork(t *testing.T, r *Redis, cidr string) []string {
+	_, network, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+
+	var ips []string
+	cursor := ""
+	for {
+		records, next, err := r.FindNetwork(context.Background(), network, cursor, 2)
+		require.NoError(t, err)
+		for _, record := range records {
+			ips = append(ips, record.IP)
+		}
+		if next == "" {
+			return ips
+		}
+		cursor = next
+	}
+}
+
+func TestRedisFindNetwork(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{NetworkIndex: true})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"203.0.113.200","risks":["TUNNEL"]}`,
+		`{"ip":"203.0.113.7"}`,
+		`{"ip":"203.0.112.255"}`,
+		`{"ip":"203.0.113.0"}`,
+		`{"ip":"198.51.100.1"}`,
+	))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"203.0.113.0", "203.0.113.7", "203.0.113.200"}, findAllNetwork(t, r, "203.0.113.0/24"))
+	assert.Equal(t, []string{"203.0.113.7"}, findAllNetwork(t, r, "203.0.113.7/32"))
+	assert.Len(t, findAllNetwork(t, r, "0.0.0.0/0"), 5)
+	assert.Empty(t, findAllNetwork(t, r, "10.0.0.0/8"))
+	assert.Empty(t, findAllNetwork(t, r, "2001:db8::/32"))
+
+	// Merges add new records to the addresses
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(`{"ip":"203.0.113.9","risks":["CALLBACK_PROXY"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"203.0.113.0", "203.0.113.7", "203.0.113.9", "203.0.113.200"}, findAllNetwork(t, r, "203.0.113.0/24"))
+
+	_, network, _ := net.ParseCIDR("203.0.113.0/24")
+	_, _, err = r.FindNetwork(ctx, network, "1", 10)
+	assert.ErrorIs(t, err, ErrorInvalidCursor)
+	current, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	_, _, err = r.FindNetwork(ctx, network, generationCursor(current-1, "3405803776"), 10)
+	assert.ErrorIs(t, err, ErrorStaleCursor)
+
+	// The addresses are kept without the other indexes
+	_, _, err = r.FindIPs(ctx, map[string]string{IndexRisk: "TUNNEL"}, "", 10)
+	assert.ErrorIs(t, err, ErrorNotIndexed)
+
+	// Generations loaded without the setting can't be searched
+	plain, _ := newTestRedis(t, RedisOptions{})
+	_, err = plain.StreamingFeedInsert(ctx, gzipLines(`{"ip":"203.0.113.7"}`))
+	require.NoError(t, err)
+	_, _, err = plain.FindNetwork(ctx, network, "", 10)
+	assert.ErrorIs(t, err, ErrorNotIndexed)
+	gen, err := plain.currentGeneration(ctx)
+	require.NoError(t, err)
+	exists, err := plain.client.Exists(ctx, plain.keys.addresses(gen)).Result()
+	require.NoError(t, err)
+	assert.Zero(t, exists)
+}
+
+func TestRedisFindNetworkIndexedGeneration(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, Indexes: true})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"203.0.113.7"}`))
+	require.NoError(t, err)
+	gen, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	_, network, _ := net.ParseCIDR("203.0.113.0/24")
+	_, _, err = r.FindNetwork(ctx, network, "", 10)
+	assert.ErrorIs(t, err, ErrorNotIndexed)
+
+	// Indexed generations from before the addresses had a setting of their own always kept them
+	score, _ := ipv4Score("203.0.113.7")
+	require.NoError(t, r.client.ZAdd(ctx, r.keys.addresses(gen), &redis.Z{Score: score, Member: "203.0.113.7"}).Err())
+	require.NoError(t, r.client.HDel(ctx, r.keys.generationMeta(gen), generationAddressedField).Err())
+	older := connectTestRedis(t, RedisOptions{Addr: r.opts.Addr})
+	assert.Equal(t, []string{"203.0.113.7"}, findAllNetwork(t, older, "203.0.113.0/24"))
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Names of the metadata keys, before the prefix is applied
+const (
+	feedInfoKey           = "feed_info"
+	realtimeFeedInfoKey   = "realtime_feed_info"
+	currentGenerationKey  = "current_generation"
+	generationSeqKey      = "generation_seq"
+	retiredGenerationsKey = "retired_generations"
+	generationMetaKeyBase = "generation:"
+	realtimeSlotsKeyBase  = "realtime_slots:"
+	stringsKey            = "strings"
+	stringsKeyBase        = "strings:"
+)
+
+// keyspace - builds every Redis key used by the storage, all of them start with prefix so the data can share a
+// database with other applications or other feeds
+type keyspace struct {
+	prefix string
+}
+
+// record - the key an IP is stored under for the given generation
+func (k keyspace) record(generation int64, ip string) string {
+	if generation == 0 {
+		return k.prefix + ip
+	}
+	return k.generationPrefix(generation) + ip
+}
+
+// generationPrefix - the prefix of every record key in the given generation
+func (k keyspace) generationPrefix(generation int64) string {
+	return k.prefix + "g" + strconv.FormatInt(generation, 10) + ":"
+}
+
+// indexPrefix - the prefix of every secondary index set in the given generation
+func (k keyspace) indexPrefix(generation int64) string {
+	return k.prefix + "i" + strconv.FormatInt(generation, 10) + ":"
+}
+
+// index - the set of IPs in the given generation whose attribute has the given value
+func (k keyspace) index(generation int64, attribute, value string) string {
+	return k.indexPrefix(generation) + attribute + ":" + value
+}
+
+// addresses - the sorted set of the IPv4 addresses in the given generation, scored by their integer value
+func (k keyspace) addresses(generation int64) string {
+	return k.indexPrefix(generation) + addressesIndex
+}
+
+// generationMeta - the hash holding metadata about the given generation
+func (k keyspace) generationMeta(generation int64) string {
+	return k.prefix + generationMetaKeyBase + strconv.FormatInt(generation, 10)
+}
+
+// dictionary - the hash holding the string dictionary of the given generation
+func (k keyspace) dictionary(generation int64) string {
+	return k.prefix + stringsKeyBase + strconv.FormatInt(generation, 10)
+}
+
+// realtimeSlots - the set of realtime slots merged on top of the feed for the given date
+func (k keyspace) realtimeSlots(feedDate string) string {
+	return k.prefix + realtimeSlotsKeyBase + feedDate
+}
+
+func (k keyspace) feedInfo() string           { return k.prefix + feedInfoKey }
+func (k keyspace) realtimeFeedInfo() string   { return k.prefix + realtimeFeedInfoKey }
+func (k keyspace) currentGeneration() string  { return k.prefix + currentGenerationKey }
+func (k keyspace) generationSeq() string      { return k.prefix + generationSeqKey }
+func (k keyspace) retiredGenerations() string { return k.prefix + retiredGenerationsKey }
+func (k keyspace) strings() string            { return k.prefix + stringsKey }
+
+// escapeGlob - escape a literal string for use in a SCAN MATCH pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+var (
+	generationRecordKeyPattern = regexp.MustCompile(`^g([0-9]+):(.+)$`)
+	indexKeyPattern            = regexp.MustCompile(`^i([0-9]+):([a-z_]+:|` + addressesIndex + `$)`)
+	generationMetaKeyPattern   = regexp.MustCompile(`^` + generationMetaKeyBase + `[0-9]+$`)
+	realtimeSlotsKeyPattern    = regexp.MustCompile(`^` + realtimeSlotsKeyBase + `[0-9]{8}$`)
+	dictionaryKeyPattern       = regexp.MustCompile(`^` + stringsKeyBase + `[0-9]+$`)
+)
+
+// unprefixedKind - a kind of key this program writes when no prefix is configured. The names alone can clash with
+// other applications' keys, so each kind is told apart by its value before it is moved.
+type unprefixedKind int
+
+const (
+	unprefixedNone unprefixedKind = iota
+	// unprefixedLegacyRecord - a record stored under its bare IP by versions without generations
+	unprefixedLegacyRecord
+	unprefixedRecord
+	unprefixedIndex
+	unprefixedGenerationMeta
+	unprefixedFeedInfo
+	unprefixedCounter
+	unprefixedSet
+	unprefixedDictionary
+)
+
+// unprefixedKeyKind - the kind of key this program would have written under the name when no prefix is configured,
+// along with the generation records and index sets belong to
+func unprefixedKeyKind(key string) (unprefixedKind, int64) {
+	switch key {
+	case feedInfoKey, realtimeFeedInfoKey:
+		return unprefixedFeedInfo, 0
+	case currentGenerationKey, generationSeqKey:
+		return unprefixedCounter, 0
+	case retiredGenerationsKey:
+		return unprefixedSet, 0
+	case stringsKey:
+		return unprefixedDictionary, 0
+	}
+
+	switch {
+	case generationMetaKeyPattern.MatchString(key):
+		return unprefixedGenerationMeta, 0
+	case realtimeSlotsKeyPattern.MatchString(key):
+		return unprefixedSet, 0
+	case dictionaryKeyPattern.MatchString(key):
+		return unprefixedDictionary, 0
+	}
+
+	if m := indexKeyPattern.FindStringSubmatch(key); m != nil {
+		generation, _ := strconv.ParseInt(m[1], 10, 64)
+		return unprefixedIndex, generation
+	}
+
+	if m := generationRecordKeyPattern.FindStringSubmatch(key); m != nil && net.ParseIP(m[2]) != nil {
+		generation, _ := strconv.ParseInt(m[1], 10, 64)
+		return unprefixedRecord, generation
+	}
+
+	if net.ParseIP(key) != nil {
+		return unprefixedLegacyRecord, 0
+	}
+	return unprefixedNone, 0
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+
+	"feedexampleredis/internal/spur"
+
+	"github.com/go-redis/redis/v8"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// maxMergeAttempts - how many times an atomic merge retries records that other writers keep changing under it
+const maxMergeAttempts = 10
+
+// mergeRetryDelay - the most an atomic merge waits before its first retry, doubling with each attempt. Waiting a random
+// part of it lets writers racing for the same records take turns.
+const mergeRetryDelay = time.Millisecond
+
+// compareAndSetScript - set KEYS[1] to ARGV[2] only if it still holds ARGV[1], the value the merge was computed from,
+// with an empty ARGV[1] meaning the key must not exist. ARGV[3] is the TTL in milliseconds, zero for none. Returns 1 if
+// the key was set and 0 if it had changed.
+var compareAndSetScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current == false then
+	current = ''
+end
+if current ~= ARGV[1] then
+	return 0
+end
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// mergeTarget - the generation a merge writes into and how its records are written
+type mergeTarget struct {
+	rdb        redis.UniversalClient
+	ks         keyspace
+	generation int64
+	ttl        time.Duration
+	atomic     bool
+	codec      recordCodec
+}
+
+// script - the compare-and-set script atomic merges use for the target's layout
+func (t mergeTarget) script() *redis.Script {
+	if t.codec.layout == LayoutHash {
+		return hashCompareAndSetScript
+	}
+	return compareAndSetScript
+}
+
+// processMergeLines - merge realtime lines into the target generation a chunk at a time, so memory use stays the same
+// however large the file is. Lines for the same IP within a chunk are merged in the order they were read.
+func (t mergeTarget) processMergeLines(ctx context.Context, chunkSize int, workerID int, lines <-chan []byte, progress *ingestProgress) (int64, error) {
+	count := int64(0)
+	chunk := make(map[string]*spur.IPContext, chunkSize)
+	order := make([]string, 0, chunkSize)
+
+	flush := func() error {
+		written, err := t.mergeChunk(ctx, order, chunk, progress)
+		count += written
+		clear(chunk)
+		order = order[:0]
+		return err
+	}
+
+	for line := range lines {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+
+		var record spur.IPContext
+		if err := jsoniter.Unmarshal(line, &record); err != nil {
+			progress.reject(workerID, fmt.Sprintf("invalid json: %v", err), line)
+			continue
+		}
+		progress.parsed()
+
+		if partial, ok := chunk[record.IP]; ok {
+			partial.Merge(&record)
+			continue
+		}
+		chunk[record.IP] = &record
+		order = append(order, record.IP)
+
+		if len(order) >= chunkSize {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if len(order) > 0 {
+		if err := flush(); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// mergeChunk - merge a chunk of partial updates into the records already in the generation. When atomic, records that
+// another writer changed between reading and writing them are merged again from their new value.
+func (t mergeTarget) mergeChunk(ctx context.Context, ips []string, partials map[string]*spur.IPContext, progress *ingestProgress) (int64, error) {
+	written := int64(0)
+	pending := ips
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if attempt > maxMergeAttempts {
+			return written, fmt.Errorf("%d records kept changing during the merge, gave up after %d attempts", len(pending), maxMergeAttempts)
+		}
+
+		var conflicts []string
+		var err error
+		if t.codec.layout == LayoutHash {
+			conflicts, err = t.mergeRoundHash(ctx, pending, partials, progress)
+		} else {
+			conflicts, err = t.mergeRound(ctx, pending, partials, progress)
+		}
+		written += int64(len(pending) - len(conflicts))
+		if err != nil {
+			return written, err
+		}
+		pending = conflicts
+
+		if len(pending) > 0 {
+			select {
+			case <-ctx.Done():
+				return written, ctx.Err()
+			case <-time.After(time.Duration(rand.Int63n(int64(mergeRetryDelay<<(attempt-1))) + 1)):
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// mergeRound - fetch the existing records for the IPs with one MGET, merge the updates into them and write them back in
+// one pipeline, returning the IPs whose records changed in between
+func (t mergeTarget) mergeRound(ctx context.Context, ips []string, partials map[string]*spur.IPContext, progress *ingestProgress) ([]string, error) {
+	keys := make([]string, len(ips))
+	for i, ip := range ips {
+		keys[i] = t.ks.record(t.generation, ip)
+	}
+
+	state, err := mget(ctx, t.rdb, keys)
+	if err != nil {
+		return ips, fmt.Errorf("error fetching keys: %w", err)
+	}
+
+	pipe := t.rdb.Pipeline()
+	sets := make([]*redis.Cmd, len(ips))
+	changes := make([]indexChange, len(ips))
+	added := int64(0)
+	for i, ip := range ips {
+		// Merge a copy, the partial is needed again if this record has to be retried
+		record := *partials[ip]
+		var before *spur.IPContext
+		previous, exists := state[i].(string)
+		if exists {
+			var existing spur.IPContext
+			data, err := t.codec.decode(ctx, []byte(previous))
+			if err == nil {
+				err = json.Unmarshal(data, &existing)
+			}
+			if err != nil {
+				slog.Error("failed to unmarshal existing record, replacing it", "ip", ip, "error", err.Error())
+			} else {
+				before = &spur.IPContext{}
+				*before = existing
+				existing.Merge(&record)
+				record = existing
+			}
+		} else {
+			added++
+		}
+		changes[i] = diffIndexEntries(ip, before, &record)
+
+		data, err := json.Marshal(&record)
+		if err == nil {
+			data, err = t.codec.encode(ctx, data)
+		}
+		if err != nil {
+			return ips, fmt.Errorf("error serializing %s: %w", ip, err)
+		}
+
+		if t.atomic {
+			sets[i] = compareAndSetScript.EvalSha(ctx, pipe, []string{keys[i]}, previous, data, t.ttl.Milliseconds())
+		} else {
+			pipe.Set(ctx, keys[i], data, t.ttl)
+		}
+	}
+
+	return t.finishRound(ctx, pipe, ips, sets, changes, func(i int) bool { _, exists := state[i].(string); return !exists }, added, progress)
+}
+
+// finishRound - execute a merge round's pipeline, count the records it added to the generation and update the indexes
+// with each record's changes. When atomic, sets holds each record's compare-and-set and created whether the record was
+// new, and the IPs whose records changed in between are returned. Otherwise added is the number of new records.
+func (t mergeTarget) finishRound(ctx context.Context, pipe redis.Pipeliner, ips []string, sets []*redis.Cmd, changes []indexChange, created func(int) bool, added int64, progress *ingestProgress) ([]string, error) {
+	indexes := newIndexWriter(t.ks, t.generation, t.ttl, t.codec.recordFormat)
+	if !t.atomic {
+		if t.generation != 0 && added > 0 {
+			pipe.HIncrBy(ctx, t.ks.generationMeta(t.generation), generationCountField, added)
+		}
+		for _, change := range changes {
+			indexes.apply(ctx, pipe, change)
+		}
+		indexes.expire(ctx, pipe)
+	}
+
+	start := time.Now()
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			// The script cache was flushed or a failover lost it, load it again and retry the whole round
+			if loadErr := t.script().Load(ctx, t.rdb).Err(); loadErr != nil {
+				return ips, fmt.Errorf("failed to reload merge script: %w", loadErr)
+			}
+			return ips, nil
+		}
+		return ips, fmt.Errorf("error executing pipeline: %w", err)
+	}
+
+	if !t.atomic {
+		progress.wrote(len(ips), time.Since(start))
+		return nil, nil
+	}
+
+	// Only the records that were set are counted and indexed
+	var conflicts []string
+	added = 0
+	pipe = t.rdb.Pipeline()
+	for i, ip := range ips {
+		if sets[i].Val() != int64(1) {
+			conflicts = append(conflicts, ip)
+			continue
+		}
+		if created(i) {
+			added++
+		}
+		indexes.apply(ctx, pipe, changes[i])
+	}
+	if t.generation != 0 && added > 0 {
+		pipe.HIncrBy(ctx, t.ks.generationMeta(t.generation), generationCountField, added)
+	}
+	indexes.expire(ctx, pipe)
+	if pipe.Len() > 0 {
+		if _, err = pipe.Exec(ctx); err != nil {
+			return conflicts, fmt.Errorf("error updating generation count and indexes: %w", err)
+		}
+	}
+	progress.wrote(len(ips)-len(conflicts), time.Since(start))
+
+	return conflicts, nil
+}
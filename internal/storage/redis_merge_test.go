@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareAndSetScript(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{})
+
+	// Creating needs the key to be missing
+	set, err := compareAndSetScript.Run(ctx, r.client, []string{"k"}, "", "first", 0).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 1, set)
+	set, err = compareAndSetScript.Run(ctx, r.client, []string{"k"}, "", "again", 0).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 0, set)
+
+	// Updating needs the value the update was computed from
+	set, err = compareAndSetScript.Run(ctx, r.client, []string{"k"}, "stale", "second", 0).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 0, set)
+	set, err = compareAndSetScript.Run(ctx, r.client, []string{"k"}, "first", "second", time.Hour.Milliseconds()).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 1, set)
+
+	value, err := mr.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, "second", value)
+	assert.Equal(t, time.Hour, mr.TTL("k"))
+}
+
+func TestRedisAtomicMergeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{TTL: time.Hour, AtomicMerge: true})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"feed"}`,
+		`{"ip":"2.2.2.2","organization":"feed"}`,
+	))
+	require.NoError(t, err)
+
+	// Several merges racing to add their own tunnel to the same records, as two daemons would
+	const writers, merges = 4, 10
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for m := 0; m < merges; m++ {
+				line := fmt.Sprintf(`{"risks":["R%d-%d"]}`, w, m)
+				_, err := r.StreamingMergeInsert(ctx, gzipLines(
+					`{"ip":"1.1.1.1",`+line[1:],
+					`{"ip":"2.2.2.2",`+line[1:],
+					`{"ip":"3.3.3.3",`+line[1:],
+				))
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		ipCtx, err := r.GetByIP(ctx, ip)
+		require.NoError(t, err)
+		assert.Len(t, ipCtx.Risks, writers*merges, ip)
+	}
+
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "feed", ipCtx.Organization)
+
+	// 3.3.3.3 is only counted by the merge that created it
+	info, err := r.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), info.Count)
+}
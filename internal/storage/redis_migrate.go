@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// MigrateOptions - which unprefixed keys MigrateUnprefixedKeys moves, and whether it only lists them
+type MigrateOptions struct {
+	// IncludeLegacyIPKeys also moves the records stored under their bare IP by versions without generations
+	IncludeLegacyIPKeys bool
+	// DryRun lists the keys that would be moved without moving them
+	DryRun bool
+	// Listed is called with each key that is moved or would be moved, one call at a time
+	Listed func(key string)
+}
+
+// MigrateUnprefixedKeys - move the keys written before a key prefix or feed namespace was configured under the store's
+// prefix. A namespaced store moves the keys kept directly under its parent's prefix, the layout used before every feed
+// had its own namespace. Records, feed info and generation metadata are moved with their TTLs intact. Only keys whose names and values match what this program
+// writes are moved, keys belonging to anything else are left alone. Returns the number of keys moved, or that would be
+// moved on a dry run.
+func (r *Redis) MigrateUnprefixedKeys(ctx context.Context, opts MigrateOptions) (int64, error) {
+	if r.keys.prefix == r.legacyKeys.prefix {
+		return 0, fmt.Errorf("no key prefix or namespace configured")
+	}
+
+	var mu sync.Mutex
+	listed := opts.Listed
+	opts.Listed = func(key string) {
+		if listed != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			listed(key)
+		}
+	}
+
+	if opts.DryRun {
+		return r.migratePass(ctx, opts)
+	}
+
+	// Keep passing over the keyspace until nothing is left to move, SCAN may skip keys while others are being renamed
+	var moved int64
+	for {
+		n, err := r.migratePass(ctx, opts)
+		if err != nil {
+			return moved + n, err
+		}
+		if n == 0 {
+			return moved, nil
+		}
+		moved += n
+		slog.Info("migrated keys", slog.Int64("moved", moved))
+	}
+}
+
+// migratePass - one SCAN over every node moving the unprefixed keys it finds, or only listing them on a dry run
+func (r *Redis) migratePass(ctx context.Context, opts MigrateOptions) (int64, error) {
+	var moved int64
+	err := forEachScanNode(ctx, r.client, func(ctx context.Context, node redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, "*", int64(r.chunkSize)).Result()
+			if err != nil {
+				return err
+			}
+
+			candidates, err := r.verifyUnprefixedKeys(ctx, keys, opts.IncludeLegacyIPKeys)
+			if err != nil {
+				return err
+			}
+
+			for _, key := range candidates {
+				opts.Listed(key)
+			}
+			if opts.DryRun {
+				atomic.AddInt64(&moved, int64(len(candidates)))
+			} else if len(candidates) > 0 {
+				n, err := r.moveKeys(ctx, candidates)
+				atomic.AddInt64(&moved, n)
+				if err != nil {
+					return err
+				}
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+
+	return moved, err
+}
+
+// verifyUnprefixedKeys - the unprefixed keys whose values show they were written by this program. Records and index
+// sets need their generation's metadata, which may already have been moved under the prefix, and legacy records are
+// only included when asked for and when they hold the record for the IP they are named after. Keys are unprefixed
+// once the legacy prefix they were written under is taken off.
+func (r *Redis) verifyUnprefixedKeys(ctx context.Context, keys []string, includeLegacyIPKeys bool) ([]string, error) {
+	pipe := r.client.Pipeline()
+	var candidates []string
+	var checks []func() (bool, error)
+	generations := make(map[int64]func() (bool, error))
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, r.keys.prefix) || !strings.HasPrefix(key, r.legacyKeys.prefix) {
+			continue
+		}
+
+		var check func() (bool, error)
+		name := strings.TrimPrefix(key, r.legacyKeys.prefix)
+		kind, generation := unprefixedKeyKind(name)
+		switch kind {
+		case unprefixedLegacyRecord:
+			if !includeLegacyIPKeys {
+				continue
+			}
+			cmd := pipe.Get(ctx, key)
+			check = func() (bool, error) {
+				var record struct {
+					IP string `json:"ip"`
+				}
+				return checkValue(cmd.Err(), func() bool { return json.Unmarshal([]byte(cmd.Val()), &record) == nil && record.IP == name })
+			}
+		case unprefixedRecord, unprefixedIndex:
+			if _, ok := generations[generation]; !ok {
+				unprefixed := pipe.Exists(ctx, r.legacyKeys.generationMeta(generation))
+				prefixed := pipe.Exists(ctx, r.keys.generationMeta(generation))
+				generations[generation] = func() (bool, error) {
+					return checkValue(errors.Join(unprefixed.Err(), prefixed.Err()), func() bool { return unprefixed.Val()+prefixed.Val() > 0 })
+				}
+			}
+			check = generations[generation]
+		case unprefixedGenerationMeta:
+			cmd := pipe.HExists(ctx, key, generationCreatedField)
+			check = func() (bool, error) { return checkValue(cmd.Err(), cmd.Val) }
+		case unprefixedFeedInfo:
+			cmd := pipe.Get(ctx, key)
+			check = func() (bool, error) {
+				var info struct {
+					JSON map[string]interface{} `json:"json"`
+				}
+				return checkValue(cmd.Err(), func() bool { return json.Unmarshal([]byte(cmd.Val()), &info) == nil && info.JSON != nil })
+			}
+		case unprefixedCounter:
+			cmd := pipe.Get(ctx, key)
+			check = func() (bool, error) {
+				return checkValue(cmd.Err(), func() bool {
+					_, err := cmd.Int64()
+					return err == nil
+				})
+			}
+		case unprefixedSet:
+			cmd := pipe.Type(ctx, key)
+			check = func() (bool, error) { return checkValue(cmd.Err(), func() bool { return cmd.Val() == "set" }) }
+		case unprefixedDictionary:
+			cmd := pipe.HExists(ctx, key, "seq")
+			check = func() (bool, error) { return checkValue(cmd.Err(), cmd.Val) }
+		default:
+			continue
+		}
+
+		candidates = append(candidates, key)
+		checks = append(checks, check)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	// Failed commands are looked at one by one, a key of another type is just not one of ours
+	_, _ = pipe.Exec(ctx)
+
+	verified := candidates[:0]
+	for i, key := range candidates {
+		ok, err := checks[i]()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check key %s: %w", key, err)
+		}
+		if ok {
+			verified = append(verified, key)
+		}
+	}
+	return verified, nil
+}
+
+// checkValue - the result of checking a key's value, a key that has gone or holds another type doesn't match
+func checkValue(err error, matches func() bool) (bool, error) {
+	if err == redis.Nil || (err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return matches(), nil
+}
+
+// migratedKey - the name the unprefixed key is moved to under the store's prefix
+func (r *Redis) migratedKey(key string) string {
+	return r.keys.prefix + strings.TrimPrefix(key, r.legacyKeys.prefix)
+}
+
+// moveKeys - move each key under the prefix. RENAME keeps the TTL and is atomic but only works when both keys live on
+// the same node, in a cluster the keys are copied with DUMP and RESTORE instead and the original is unlinked.
+func (r *Redis) moveKeys(ctx context.Context, keys []string) (int64, error) {
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return r.copyKeys(ctx, keys)
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StatusCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Rename(ctx, key, r.migratedKey(key))
+	}
+
+	// A key that expired or was deleted since it was scanned fails with "no such key", which is fine
+	_, _ = pipe.Exec(ctx)
+
+	moved := int64(0)
+	for _, cmd := range cmds {
+		err := cmd.Err()
+		if err == nil {
+			moved++
+			continue
+		}
+		if !strings.Contains(err.Error(), "no such key") {
+			return moved, fmt.Errorf("failed to rename key: %w", err)
+		}
+	}
+
+	return moved, nil
+}
+
+// copyKeys - copy each key under the prefix with DUMP and RESTORE and unlink the original
+func (r *Redis) copyKeys(ctx context.Context, keys []string) (int64, error) {
+	pipe := r.client.Pipeline()
+	dumps := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		dumps[i] = pipe.Dump(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return 0, fmt.Errorf("failed to dump keys: %w", err)
+	}
+
+	moved := int64(0)
+	pipe = r.client.Pipeline()
+	for i, key := range keys {
+		// The key expired or was deleted since it was scanned
+		if dumps[i].Err() != nil || ttls[i].Val() == -2 {
+			continue
+		}
+
+		ttl := ttls[i].Val()
+		if ttl < 0 {
+			ttl = 0
+		}
+
+		pipe.RestoreReplace(ctx, r.migratedKey(key), ttl, dumps[i].Val())
+		pipe.Unlink(ctx, key)
+		moved++
+	}
+
+	if moved == 0 {
+		return 0, nil
+	}
+
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore keys: %w", err)
+	}
+
+	return moved, nil
+}
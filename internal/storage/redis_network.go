@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"feedexampleredis/internal/spur"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ipv4Score - an IPv4 address as the integer it is scored by in the addresses index, false for anything else
+func ipv4Score(ip string) (float64, bool) {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return 0, false
+	}
+	return float64(binary.BigEndian.Uint32(parsed)), true
+}
+
+// FindNetwork - page through the records in the current generation for the IPv4 addresses within network, in address
+// order. Start with an empty cursor and carry on with the returned one until it is empty. Records that expired since
+// they were indexed are left out, so a page can hold fewer than count records. IPv6 networks hold no records.
+func (r *Redis) FindNetwork(ctx context.Context, network *net.IPNet, cursor string, count int64) ([]*spur.IPContext, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 32 {
+		return nil, "", nil
+	}
+	start := uint64(binary.BigEndian.Uint32(ip))
+	end := start | (1<<(32-ones) - 1)
+
+	gen, err := r.currentGeneration(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cursor != "" {
+		rest, err := parseGenerationCursor(cursor, gen)
+		if err != nil {
+			return nil, "", err
+		}
+		from, err := strconv.ParseUint(rest, 10, 64)
+		if err != nil || from < start || from > end {
+			return nil, "", fmt.Errorf("%w %q", ErrorInvalidCursor, cursor)
+		}
+		start = from
+	}
+
+	format, err := r.generationFormat(ctx, gen)
+	if err != nil {
+		return nil, "", err
+	}
+	// Generations loaded without RedisOptions.NetworkIndex don't have one
+	if !format.addressed {
+		return nil, "", ErrorNotIndexed
+	}
+
+	found, err := r.client.ZRangeByScoreWithScores(ctx, r.keys.addresses(gen), &redis.ZRangeBy{
+		Min:   strconv.FormatUint(start, 10),
+		Max:   strconv.FormatUint(end, 10),
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read addresses: %w", err)
+	}
+	if len(found) == 0 {
+		return nil, "", nil
+	}
+
+	ips := make([]string, len(found))
+	for i, z := range found {
+		ips[i], _ = z.Member.(string)
+	}
+	records, err := r.getRecords(ctx, gen, format, ips)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Drop the records that have expired
+	kept := records[:0]
+	for _, record := range records {
+		if record != nil {
+			kept = append(kept, record)
+		}
+	}
+
+	next := uint64(found[len(found)-1].Score) + 1
+	if int64(len(found)) < count || next > end {
+		return kept, "", nil
+	}
+	return kept, generationCursor(gen, strconv.FormatUint(next, 10)), nil
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PutRealtimeCheckpoint - record that the realtime slot has been merged on top of the feed for the date
+func (r *Redis) PutRealtimeCheckpoint(ctx context.Context, feedDate string, slot time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	key := r.keys.realtimeSlots(feedDate)
+	pipe := r.client.Pipeline()
+	pipe.SAdd(ctx, key, slot.Unix())
+	pipe.Expire(ctx, key, realtimeCheckpointTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to store realtime checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// GetRealtimeCheckpoints - get the realtime slots merged on top of the feed for the date, oldest first
+func (r *Redis) GetRealtimeCheckpoints(ctx context.Context, feedDate string) ([]time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	members, err := r.client.SMembers(ctx, r.keys.realtimeSlots(feedDate)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get realtime checkpoints: %w", err)
+	}
+
+	slots := make([]time.Time, 0, len(members))
+	for _, member := range members {
+		unix, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			continue
+		}
+		slots = append(slots, time.Unix(unix, 0).UTC())
+	}
+	sortSlots(slots)
+
+	return slots, nil
+}
@@ -0,0 +1,497 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"feedexampleredis/internal/spur"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipLines(lines ...string) io.ReadCloser {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		if _, err := gz.Write([]byte(line + "\n")); err != nil {
+			panic(err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		panic(err)
+	}
+
+	return io.NopCloser(&buf)
+}
+
+// newTestRedis - a store with the given options connected to a new miniredis server, records expire after a day unless
+// the options set a TTL
+func newTestRedis(t *testing.T, opts RedisOptions) (*Redis, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	opts.Addr = mr.Addr()
+	if opts.TTL == 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	return connectTestRedis(t, opts), mr
+}
+
+// connectTestRedis - another store with the given options connected to the server at opts.Addr, loading in chunks of 2
+// with 2 workers unless the options say otherwise
+func connectTestRedis(t *testing.T, opts RedisOptions) *Redis {
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 2
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 2
+	}
+	r := NewRedis(opts)
+	require.NoError(t, r.Connect())
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestRedisGenerationSwap(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{})
+
+	count, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"first"}`,
+		`{"ip":"2.2.2.2","organization":"first"}`,
+		`{"ip":"3.3.3.3","organization":"first"}`,
+	))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+
+	first, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, first)
+
+	ipCtx, err := r.GetByIP(ctx, "3.3.3.3")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+
+	// 3.3.3.3 is dropped from the second feed
+	count, err = r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"second"}`,
+		`{"ip":"2.2.2.2","organization":"second"}`,
+	))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	second, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, second, first)
+
+	ipCtx, err = r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "second", ipCtx.Organization)
+
+	_, err = r.GetByIP(ctx, "3.3.3.3")
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+
+	info, err := r.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, second, info.Generation)
+	assert.Equal(t, int64(2), info.Count)
+	assert.Equal(t, int64(1), info.Removed)
+
+	// The previous generation is deleted once the purge completes
+	require.NoError(t, r.purgeRetiredGenerations(ctx))
+	for _, key := range mr.Keys() {
+		assert.NotContains(t, key, r.keys.generationPrefix(first))
+	}
+	assert.False(t, mr.Exists(r.keys.generationMeta(first)))
+}
+
+func TestRedisGenerationSwapEmptyFeed(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"first"}`))
+	require.NoError(t, err)
+
+	first, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+
+	// A feed with nothing usable in it must not replace the current generation
+	_, err = r.StreamingFeedInsert(ctx, gzipLines(`not json`))
+	assert.Error(t, err)
+
+	current, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, first, current)
+
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+}
+
+func TestRedisMergeIntoCurrentGeneration(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"first","risks":["TUNNEL"]}`))
+	require.NoError(t, err)
+
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(`{"ip":"1.1.1.1","risks":["CALLBACK_PROXY"]}`))
+	require.NoError(t, err)
+
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+	assert.Equal(t, []string{"TUNNEL", "CALLBACK_PROXY"}, ipCtx.Risks)
+
+	// IPs that only arrive through realtime updates are counted towards the generation
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(`{"ip":"2.2.2.2","risks":["TUNNEL"]}`))
+	require.NoError(t, err)
+
+	info, err := r.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Count)
+}
+
+func TestRedisMergeInChunks(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"10.0.0.0","organization":"feed","risks":["TUNNEL"]}`))
+	require.NoError(t, err)
+
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"ip":"10.0.0.%d","risks":["CALLBACK_PROXY"]}`, i))
+	}
+	count, err := r.StreamingMergeInsert(ctx, gzipLines(lines...))
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), count)
+
+	// Every chunk of two is fetched and written on its own
+	status, ok := r.IngestStatus()
+	require.True(t, ok)
+	assert.GreaterOrEqual(t, status.Batches, int64(10))
+
+	ipCtx, err := r.GetByIP(ctx, "10.0.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, "feed", ipCtx.Organization)
+	assert.Equal(t, []string{"TUNNEL", "CALLBACK_PROXY"}, ipCtx.Risks)
+
+	ipCtx, err = r.GetByIP(ctx, "10.0.0.19")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"CALLBACK_PROXY"}, ipCtx.Risks)
+
+	info, err := r.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), info.Count)
+}
+
+func TestRedisConnect(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireUserAuth("spur", "secret")
+
+	tests := []struct {
+		name    string
+		opts    RedisOptions
+		wantErr bool
+	}{
+		{
+			name: "ACL username and password",
+			opts: RedisOptions{Addr: mr.Addr(), Username: "spur", Password: "secret"},
+		},
+		{
+			name:    "Wrong password",
+			opts:    RedisOptions{Addr: mr.Addr(), Username: "spur", Password: "wrong"},
+			wantErr: true,
+		},
+		{
+			name:    "Unreachable server",
+			opts:    RedisOptions{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond},
+			wantErr: true,
+		},
+		{
+			name:    "Missing CA file",
+			opts:    RedisOptions{Addr: mr.Addr(), TLSEnabled: true, TLSCAFile: "does-not-exist.pem"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRedis(tt.opts)
+			err := r.Connect()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestRedisMigrateUnprefixedKeys(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"first"}`,
+		`{"ip":"2.2.2.2","organization":"first"}`,
+	))
+	require.NoError(t, err)
+	require.NoError(t, mr.Set("9.9.9.9", `{"ip":"9.9.9.9","organization":"legacy"}`))
+
+	// Other applications' keys can have the same names
+	require.NoError(t, mr.Set("unrelated", "value"))
+	require.NoError(t, mr.Set("feed_info", "another application's"))
+	mr.HSet("strings", "greeting", "hello")
+	require.NoError(t, mr.Set("8.8.8.8", "cached"))
+	require.NoError(t, mr.Set("g7:8.8.4.4", "cached"))
+
+	_, err = r.MigrateUnprefixedKeys(ctx, MigrateOptions{})
+	assert.Error(t, err, "migrating without a prefix must fail")
+
+	prefixed := connectTestRedis(t, RedisOptions{Addr: mr.Addr(), KeyPrefix: "spur:"})
+	_, err = prefixed.GetByIP(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+
+	// A dry run only lists the keys
+	var listed []string
+	count, err := prefixed.MigrateUnprefixedKeys(ctx, MigrateOptions{DryRun: true, Listed: func(key string) { listed = append(listed, key) }})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(listed)), count)
+	assert.Contains(t, listed, "current_generation")
+	assert.Contains(t, listed, "g1:1.1.1.1")
+	assert.NotContains(t, listed, "9.9.9.9")
+	assert.True(t, mr.Exists("current_generation"))
+
+	moved, err := prefixed.MigrateUnprefixedKeys(ctx, MigrateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, count, moved)
+
+	ipCtx, err := prefixed.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+	assert.Greater(t, mr.TTL(prefixed.keys.record(1, "1.1.1.1")), time.Duration(0), "record TTLs are kept")
+
+	info, err := prefixed.GetCurrentGenerationInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Count)
+
+	// Records from before generations are only moved when asked for
+	assert.True(t, mr.Exists("9.9.9.9"))
+	_, err = prefixed.MigrateUnprefixedKeys(ctx, MigrateOptions{IncludeLegacyIPKeys: true})
+	require.NoError(t, err)
+	assert.True(t, mr.Exists("spur:9.9.9.9"))
+
+	// Nothing outside of the program's own keys is touched
+	for _, key := range []string{"unrelated", "feed_info", "strings", "8.8.8.8", "g7:8.8.4.4"} {
+		assert.True(t, mr.Exists(key), key)
+	}
+	assert.False(t, mr.Exists("current_generation"))
+}
+
+func TestRedisMigrateIntoNamespace(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{KeyPrefix: "spur:"})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"first"}`))
+	require.NoError(t, err)
+	ipsummary := r.WithNamespace("ipsummary:", time.Hour)
+	_, err = ipsummary.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"ipsummary"}`))
+	require.NoError(t, err)
+
+	// The keys kept under the prefix before every feed was namespaced move into the feed's namespace
+	anonymous := r.WithNamespace("anonymous:", time.Hour)
+	moved, err := anonymous.MigrateUnprefixedKeys(ctx, MigrateOptions{})
+	require.NoError(t, err)
+	assert.Greater(t, moved, int64(0))
+
+	ipCtx, err := anonymous.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+	assert.True(t, mr.Exists("spur:anonymous:current_generation"))
+	assert.False(t, mr.Exists("spur:current_generation"))
+
+	// Other feeds' namespaces are left alone
+	ipCtx, err = ipsummary.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "ipsummary", ipCtx.Organization)
+	assert.True(t, mr.Exists("spur:ipsummary:current_generation"))
+}
+
+func TestRedisWithNamespace(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{})
+
+	anonymous := r.WithNamespace("anonymous:", time.Hour)
+	ipsummary := r.WithNamespace("ipsummary:", 2*time.Hour)
+
+	_, err := anonymous.StreamingFeedInsert(ctx, gzipLines(`{"ip":"1.1.1.1","organization":"anonymous"}`))
+	require.NoError(t, err)
+	_, err = ipsummary.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"ipsummary"}`,
+		`{"ip":"2.2.2.2","organization":"ipsummary"}`,
+	))
+	require.NoError(t, err)
+
+	ipCtx, err := anonymous.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", ipCtx.Organization)
+
+	ipCtx, err = ipsummary.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "ipsummary", ipCtx.Organization)
+
+	_, err = anonymous.GetByIP(ctx, "2.2.2.2")
+	assert.ErrorIs(t, err, ErrorIPNotFound)
+
+	// Each feed keeps its own TTL and its own generations
+	assert.Equal(t, time.Hour, mr.TTL(anonymous.keys.record(1, "1.1.1.1")))
+	assert.Equal(t, 2*time.Hour, mr.TTL(ipsummary.keys.record(1, "1.1.1.1")))
+	assert.True(t, mr.Exists("anonymous:current_generation"))
+	assert.True(t, mr.Exists("ipsummary:current_generation"))
+	assert.False(t, mr.Exists("current_generation"))
+}
+
+func TestRedisRealtimeCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{})
+
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	now := start.Add(30 * time.Minute)
+
+	// 00:00 through 00:20 are due, 00:25 is still waiting for its file to be published
+	gaps, err := RealtimeGaps(ctx, r, "20240102", now)
+	require.NoError(t, err)
+	assert.Len(t, gaps, 5)
+
+	require.NoError(t, r.PutRealtimeCheckpoint(ctx, "20240102", start.Add(5*time.Minute)))
+	require.NoError(t, r.PutRealtimeCheckpoint(ctx, "20240102", start))
+	require.NoError(t, r.PutRealtimeCheckpoint(ctx, "20240102", start))
+
+	merged, err := r.GetRealtimeCheckpoints(ctx, "20240102")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{start, start.Add(5 * time.Minute)}, merged)
+	assert.Greater(t, mr.TTL(r.keys.realtimeSlots("20240102")), time.Duration(0))
+
+	gaps, err = RealtimeGaps(ctx, r, "20240102", now)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{start.Add(10 * time.Minute), start.Add(15 * time.Minute), start.Add(20 * time.Minute)}, gaps)
+}
+
+func TestRedisIngestStatus(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t, RedisOptions{})
+
+	_, ok := r.IngestStatus()
+	assert.False(t, ok)
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"first"}`,
+		`not json`,
+		`{"ip":"2.2.2.2","organization":"first"}`,
+		`{"ip":"3.3.3.3","organization":"first"}`,
+	))
+	require.NoError(t, err)
+
+	status, ok := r.IngestStatus()
+	require.True(t, ok)
+	assert.Equal(t, IngestKindFeed, status.Kind)
+	assert.False(t, status.Running)
+	assert.NotNil(t, status.FinishedAt)
+	assert.Equal(t, int64(4), status.LinesRead)
+	assert.Equal(t, int64(3), status.LinesParsed)
+	assert.Equal(t, int64(1), status.ParseFailures)
+	assert.Equal(t, int64(3), status.RecordsWritten)
+	assert.NotZero(t, status.Batches)
+
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(`{"ip":"4.4.4.4","organization":"merged"}`))
+	require.NoError(t, err)
+
+	status, ok = r.IngestStatus()
+	require.True(t, ok)
+	assert.Equal(t, IngestKindMerge, status.Kind)
+	assert.Equal(t, int64(1), status.RecordsWritten)
+}
+
+func TestRedisFeedInsertFailures(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t, RedisOptions{})
+
+	_, err := r.StreamingFeedInsert(ctx, gzipLines(
+		`{"ip":"1.1.1.1","organization":"first"}`,
+		`{"ip":"2.2.2.2","organization":"first"}`,
+	))
+	require.NoError(t, err)
+	first, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+
+	// A download cut off partway through fails the load instead of swapping in half a feed
+	data, err := io.ReadAll(gzipLines(
+		`{"ip":"1.1.1.1","organization":"second"}`,
+		`{"ip":"2.2.2.2","organization":"second"}`,
+		`{"ip":"3.3.3.3","organization":"second"}`,
+	))
+	require.NoError(t, err)
+	_, err = r.StreamingFeedInsert(ctx, io.NopCloser(bytes.NewReader(data[:len(data)-10])))
+	assert.Error(t, err)
+
+	current, err := r.currentGeneration(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, first, current)
+
+	// A worker failing to write fails the load and the merge rather than exiting
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	_, err = r.StreamingMergeInsert(ctx, gzipLines(`{"ip":"4.4.4.4","organization":"merged"}`))
+	assert.ErrorContains(t, err, "LOADING")
+	mr.SetError("")
+
+	ipCtx, err := r.GetByIP(ctx, "1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "first", ipCtx.Organization)
+}
+
+func TestRedisGetByIPs(t *testing.T) {
+	ctx := context.Background()
+	plain, _ := newTestRedis(t, RedisOptions{})
+
+	for _, opts := range []RedisOptions{
+		{Layout: LayoutString, Encoding: EncodingJSON},
+		{Layout: LayoutString, Encoding: EncodingMsgpack},
+		{Layout: LayoutHash},
+	} {
+		t.Run(opts.Layout+"/"+opts.Encoding, func(t *testing.T) {
+			opts.Addr = plain.opts.Addr
+			opts.KeyPrefix = opts.Layout + opts.Encoding + ":"
+			opts.ChunkSize = 2
+			opts.Concurrency = 2
+			r := NewRedis(opts)
+			require.NoError(t, r.Connect())
+			defer r.Close()
+
+			// Nothing has been loaded yet
+			records, err := r.GetByIPs(ctx, []string{"1.1.1.1"})
+			require.NoError(t, err)
+			assert.Equal(t, []*spur.IPContext{nil}, records)
+
+			_, err = r.StreamingFeedInsert(ctx, gzipLines(
+				`{"ip":"1.1.1.1","organization":"one"}`,
+				`{"ip":"2.2.2.2","organization":"two"}`,
+			))
+			require.NoError(t, err)
+
+			records, err = r.GetByIPs(ctx, []string{"2.2.2.2", "3.3.3.3", "1.1.1.1"})
+			require.NoError(t, err)
+			require.Len(t, records, 3)
+			assert.Equal(t, "two", records[0].Organization)
+			assert.Nil(t, records[1])
+			assert.Equal(t, "one", records[2].Organization)
+		})
+	}
+}
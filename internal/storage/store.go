@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"feedexampleredis/internal/spur"
+)
+
+var (
+	ErrorIPNotFound   = fmt.Errorf("IP not found")
+	ErrorNotSupported = fmt.Errorf("operation not supported by this store")
+)
+
+// Store - a storage backend that feeds can be loaded into and IP context looked up from
+type Store interface {
+	// GetByIP - look up the IP context for an IP, returns ErrorIPNotFound if the IP is not in the store
+	GetByIP(ctx context.Context, ip string) (*spur.IPContext, error)
+
+	// StreamingFeedInsert - load a gzipped full feed, replacing the existing data
+	StreamingFeedInsert(ctx context.Context, rc io.ReadCloser) (int64, error)
+
+	// StreamingMergeInsert - merge a gzipped realtime feed into the existing data
+	StreamingMergeInsert(ctx context.Context, rc io.ReadCloser) (int64, error)
+
+	GetLatestFeedInfo(ctx context.Context) (*spur.FeedInfo, error)
+	PutLatestFeedInfo(ctx context.Context, fi *spur.FeedInfo) error
+	GetLatestRealtimeFeedInfo(ctx context.Context) (*spur.RealtimeFeedInfo, error)
+	PutLatestRealtimeFeedInfo(ctx context.Context, fi *spur.RealtimeFeedInfo) error
+}
+
+// FeedStore - the stores holding a single feed type, V6 is nil when the feed type has no IPv6 feed
+type FeedStore struct {
+	FeedType spur.FeedType
+	V4       Store
+	V6       Store
+}
+
+// GenerationInfo - metadata about a loaded generation
+type GenerationInfo struct {
+	Generation  int64     `json:"generation"`
+	Count       int64     `json:"count"`
+	Removed     int64     `json:"removed"`
+	CreatedAt   time.Time `json:"created_at"`
+	ActivatedAt time.Time `json:"activated_at"`
+}
+
+// Generational - a Store that loads each full feed into a new generation before swapping it in
+type Generational interface {
+	GetCurrentGenerationInfo(ctx context.Context) (*GenerationInfo, error)
+}
+
+// RealtimeCheckpointer - a Store that records which realtime slots have been merged on top of a full feed, so the
+// realtime backfill can resume where it left off after a restart. Slots are identified by their start time.
+type RealtimeCheckpointer interface {
+	PutRealtimeCheckpoint(ctx context.Context, feedDate string, slot time.Time) error
+	GetRealtimeCheckpoints(ctx context.Context, feedDate string) ([]time.Time, error)
+}
+
+// ProgressReporter - a Store that can report the progress of the load running in it
+type ProgressReporter interface {
+	// IngestStatus - the load currently running, or the last one to finish. False if nothing has been loaded yet.
+	IngestStatus() (IngestStatus, bool)
+}
+
+// Rejecter - a Store that can dead-letter the lines it can't load and fail loads that reject too many of them
+type Rejecter interface {
+	SetRejectPolicy(policy RejectPolicy)
+}
+
+// FieldGetter - a Store that can look up only some of the top level fields of an IP context
+type FieldGetter interface {
+	// GetFieldsByIP - look up the given fields of the IP context for an IP, along with its ip and network. Returns
+	// ErrorIPNotFound if the IP is not in the store.
+	GetFieldsByIP(ctx context.Context, ip string, fields []string) (*spur.IPContext, error)
+}
+
+// BatchGetter - a Store that can look up many IPs in a single round trip
+type BatchGetter interface {
+	// GetByIPs - look up the IP contexts for the given IPs, the result at each index is nil if that IP is not in the
+	// store
+	GetByIPs(ctx context.Context, ips []string) ([]*spur.IPContext, error)
+}
+
+// Indexer - a Store that keeps secondary indexes of its records' attributes
+type Indexer interface {
+	// FindIPs - page through the IPs whose indexed attributes have every one of the given values. Start with an empty
+	// cursor and carry on with the returned one until it is empty. Returns ErrorNotIndexed if the data has no indexes,
+	// and ErrorStaleCursor if the data was replaced since the cursor was returned.
+	FindIPs(ctx context.Context, query map[string]string, cursor string, count int64) ([]string, string, error)
+}
+
+// NetworkFinder - a Store that can find the records within a network
+type NetworkFinder interface {
+	// FindNetwork - page through the records for the IPs and networks intersecting network. Start with an empty cursor
+	// and carry on with the returned one until it is empty. Returns ErrorNotIndexed if the data can't be searched, and
+	// ErrorStaleCursor if the data was replaced since the cursor was returned.
+	FindNetwork(ctx context.Context, network *net.IPNet, cursor string, count int64) ([]*spur.IPContext, string, error)
+}
+
+// Pinger - a Store backed by a server that can be checked for reachability
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+var (
+	_ Store                = (*Redis)(nil)
+	_ Generational         = (*Redis)(nil)
+	_ RealtimeCheckpointer = (*Redis)(nil)
+	_ Store                = (*MMDB)(nil)
+	_ Store                = (*Bolt)(nil)
+	_ Generational         = (*Bolt)(nil)
+	_ RealtimeCheckpointer = (*Bolt)(nil)
+	_ ProgressReporter     = (*Redis)(nil)
+	_ ProgressReporter     = (*Bolt)(nil)
+	_ ProgressReporter     = (*MMDB)(nil)
+	_ Rejecter             = (*Redis)(nil)
+	_ Rejecter             = (*Bolt)(nil)
+	_ Rejecter             = (*MMDB)(nil)
+	_ FieldGetter          = (*Redis)(nil)
+	_ Indexer              = (*Redis)(nil)
+	_ BatchGetter          = (*Redis)(nil)
+	_ BatchGetter          = (*MMDB)(nil)
+	_ NetworkFinder        = (*Redis)(nil)
+	_ NetworkFinder        = (*MMDB)(nil)
+	_ Pinger               = (*Redis)(nil)
+)